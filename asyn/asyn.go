@@ -3,6 +3,7 @@ package asyn
 import (
 	"context"
 	"fmt"
+	"github.com/sniperHW/kendynet/clock"
 	"time"
 )
 
@@ -15,6 +16,7 @@ type Future struct {
 	ret     []interface{}
 	c       int
 	cancel  context.CancelFunc
+	clock   clock.Clock //超时使用的时钟
 }
 
 /*
@@ -24,16 +26,9 @@ type Future struct {
 func (this *Future) Wait(timeout ...time.Duration) ([]interface{}, error) {
 	defer this.cancel()
 	if len(timeout) > 0 {
-
-		deadline := time.Now().Add(timeout[0])
+		timer := this.clock.NewTimer(timeout[0])
+		defer timer.Stop()
 		for {
-			now := time.Now()
-			if now.Equal(deadline) || now.After(deadline) {
-				this.cancel()
-				return nil, ErrTimeout
-			}
-
-			remain := deadline.Sub(now)
 			select {
 			case ret := <-this.channel: //拿到锁
 				this.c++
@@ -43,7 +38,7 @@ func (this *Future) Wait(timeout ...time.Duration) ([]interface{}, error) {
 					//只有接收到所有结果才返回
 					return this.ret, nil
 				}
-			case <-time.After(remain):
+			case <-timer.Chan():
 				return nil, ErrTimeout
 			}
 		}
@@ -68,10 +63,12 @@ func (this *Future) Wait(timeout ...time.Duration) ([]interface{}, error) {
 func (this *Future) WaitAny(timeout ...time.Duration) (interface{}, error) {
 	defer this.cancel()
 	if len(timeout) > 0 {
+		timer := this.clock.NewTimer(timeout[0])
+		defer timer.Stop()
 		select {
 		case ret := <-this.channel: //拿到锁
 			return ret.([2]interface{})[1], nil
-		case <-time.After(timeout[0]):
+		case <-timer.Chan():
 			return nil, ErrTimeout
 		}
 	} else {
@@ -86,11 +83,18 @@ func (this *Future) WaitAny(timeout ...time.Duration) (interface{}, error) {
 *  返回一个future,可以在将来的任何时刻等待闭包执行结果
  */
 func Paralell(funcs ...func(ctx context.Context) interface{}) *Future {
+	return ParalellWithClock(clock.Real, funcs...)
+}
+
+/*
+*  与Paralell相同,Wait/WaitAny的超时使用时钟c计时
+ */
+func ParalellWithClock(c clock.Clock, funcs ...func(ctx context.Context) interface{}) *Future {
 	if 0 == len(funcs) {
 		return nil
 	}
 	var ctx context.Context
-	future := &Future{}
+	future := &Future{clock: clock.Get(c)}
 	future.channel = make(chan interface{}, len(funcs))
 	future.ret = make([]interface{}, len(funcs))
 	ctx, future.cancel = context.WithCancel(context.Background())
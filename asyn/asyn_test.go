@@ -4,6 +4,7 @@ package asyn
 import (
 	"context"
 	"fmt"
+	"github.com/sniperHW/kendynet/clock"
 	"github.com/sniperHW/kendynet/event"
 	"github.com/stretchr/testify/assert"
 	"sync"
@@ -196,3 +197,52 @@ func TestAsyn(t *testing.T) {
 		queue.Run()
 	}
 }
+
+func TestFutureClock(t *testing.T) {
+	c := clock.NewFake()
+	release := make(chan struct{})
+	future := ParalellWithClock(c,
+		func(_ context.Context) interface{} {
+			return 1
+		},
+		func(ctx context.Context) interface{} {
+			select {
+			case <-release:
+				return 2
+			case <-ctx.Done():
+				return nil
+			}
+		},
+	)
+
+	done := make(chan error)
+	go func() {
+		_, err := future.Wait(time.Minute)
+		done <- err
+	}()
+
+	c.BlockUntil(1)
+	c.Advance(time.Minute - time.Millisecond)
+	select {
+	case <-done:
+		assert.Fail(t, "Wait returned before timeout")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Advance(time.Millisecond)
+	assert.Equal(t, ErrTimeout, <-done)
+
+	future = ParalellWithClock(c,
+		func(_ context.Context) interface{} {
+			<-release
+			return 1
+		},
+	)
+	go func() {
+		_, err := future.WaitAny(time.Second)
+		done <- err
+	}()
+	c.BlockUntil(1)
+	c.Advance(time.Second)
+	assert.Equal(t, ErrTimeout, <-done)
+	close(release)
+}
@@ -0,0 +1,100 @@
+package clock
+
+import (
+	"time"
+)
+
+/*
+ *  时钟抽象
+ *
+ *  timer、rpc调用超时、session读写超时以及asyn.Future.Wait都可以指定使用的时钟,
+ *  默认使用Real(系统时钟)。测试中使用Fake,通过Advance手动推进时间以确定地触发定时器。
+ */
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Until(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+	AfterFunc(d time.Duration, f func()) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+/*
+ *  与time.Timer相同,AfterFunc创建的Timer的Chan()返回nil
+ */
+type Timer interface {
+	Chan() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+var Real Clock = realClock{}
+
+/*
+ *  c为nil时返回Real
+ */
+func Get(c Clock) Clock {
+	if nil == c {
+		return Real
+	} else {
+		return c
+	}
+}
+
+type realClock struct {
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (this realTimer) Chan() <-chan time.Time {
+	return this.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (this realTicker) Chan() <-chan time.Time {
+	return this.C
+}
+
+func (this realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (this realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (this realClock) Until(t time.Time) time.Duration {
+	return time.Until(t)
+}
+
+func (this realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (this realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (this realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (this realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+func (this realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
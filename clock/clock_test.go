@@ -0,0 +1,106 @@
+package clock
+
+//go test -covermode=count -v -run=.
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+	assert.Equal(t, start, c.Now())
+
+	{
+		var fired []int
+		c.AfterFunc(2*time.Second, func() {
+			fired = append(fired, 2)
+		})
+		c.AfterFunc(time.Second, func() {
+			fired = append(fired, 1)
+			assert.Equal(t, start.Add(time.Second), c.Now())
+			//回调中创建的定时器在推进范围内到期,本次Advance中触发
+			c.AfterFunc(500*time.Millisecond, func() {
+				fired = append(fired, 3)
+			})
+		})
+		stopped := c.AfterFunc(time.Second, func() {
+			fired = append(fired, 4)
+		})
+		assert.Equal(t, 3, c.Pending())
+		assert.True(t, stopped.Stop())
+		assert.False(t, stopped.Stop())
+
+		c.Advance(999 * time.Millisecond)
+		assert.Equal(t, 0, len(fired))
+		c.Advance(time.Second)
+		assert.Equal(t, []int{1, 3}, fired)
+		assert.Equal(t, start.Add(1999*time.Millisecond), c.Now())
+		c.Advance(time.Millisecond)
+		assert.Equal(t, []int{1, 3, 2}, fired)
+		assert.Equal(t, 0, c.Pending())
+	}
+
+	{
+		timer := c.NewTimer(time.Second)
+		assert.True(t, timer.Reset(2*time.Second))
+		c.Advance(time.Second)
+		select {
+		case <-timer.Chan():
+			assert.Fail(t, "timer fired before deadline")
+		default:
+		}
+		c.Advance(time.Second)
+		assert.Equal(t, c.Now(), <-timer.Chan())
+		assert.False(t, timer.Reset(time.Second))
+		assert.True(t, timer.Stop())
+	}
+
+	{
+		ticker := c.NewTicker(time.Second)
+		c.Advance(time.Second)
+		<-ticker.Chan()
+		//没有读取的tick被丢弃
+		c.Advance(3 * time.Second)
+		<-ticker.Chan()
+		select {
+		case <-ticker.Chan():
+			assert.Fail(t, "unexpected tick")
+		default:
+		}
+		ticker.Stop()
+		assert.Equal(t, 0, c.Pending())
+	}
+
+	{
+		done := make(chan time.Time)
+		go func() {
+			c.Sleep(time.Minute)
+			done <- c.Now()
+		}()
+		c.BlockUntil(1)
+		now := c.Now()
+		c.Advance(time.Minute)
+		assert.Equal(t, now.Add(time.Minute), <-done)
+	}
+
+	{
+		var fired bool
+		c.AfterFunc(0, func() {
+			fired = true
+		})
+		assert.False(t, fired)
+		c.Advance(0)
+		assert.True(t, fired)
+
+		now := c.Now()
+		c.Set(now.Add(-time.Hour))
+		assert.Equal(t, now, c.Now())
+		c.Set(now.Add(time.Hour))
+		assert.Equal(t, now.Add(time.Hour), c.Now())
+	}
+
+	assert.Equal(t, Real, Get(nil))
+	assert.Equal(t, Clock(c), Get(c))
+}
@@ -0,0 +1,251 @@
+package clock
+
+import (
+	"github.com/sniperHW/kendynet/util"
+	"sync"
+	"time"
+)
+
+/*
+ *  手动推进的时钟
+ *
+ *  时间只在调用Advance/Set时前进,到期的定时器按到期时间依次触发,触发时Now()返回该定时器的到期时间。
+ *  AfterFunc的回调在调用Advance的goroutine上执行,Advance返回时所有到期的回调都已执行完毕,
+ *  回调中创建的在推进范围内到期的定时器也会在本次Advance中触发。
+ *  到期时间不晚于当前时间的定时器在下一次调用Advance(包括Advance(0))时触发。
+ *
+ *  被测代码在另外的goroutine上创建定时器时,用BlockUntil等待定时器创建之后再推进时间。
+ */
+type Fake struct {
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	seq    uint64
+	timers util.MinHeap
+}
+
+type fakeTimer struct {
+	f      *Fake
+	when   time.Time
+	seq    uint64        //同时到期的定时器按创建/重置的顺序触发
+	period time.Duration //Ticker的间隔
+	c      chan time.Time
+	fn     func()
+	index  int
+}
+
+func (this *fakeTimer) Less(o util.HeapElement) bool {
+	other := o.(*fakeTimer)
+	if this.when.Equal(other.when) {
+		return this.seq < other.seq
+	} else {
+		return this.when.Before(other.when)
+	}
+}
+
+func (this *fakeTimer) GetIndex() int {
+	return this.index
+}
+
+func (this *fakeTimer) SetIndex(idx int) {
+	this.index = idx
+}
+
+func (this *fakeTimer) Chan() <-chan time.Time {
+	return this.c
+}
+
+func (this *fakeTimer) Stop() bool {
+	this.f.mtx.Lock()
+	defer this.f.mtx.Unlock()
+	return this.f.remove(this)
+}
+
+func (this *fakeTimer) Reset(d time.Duration) bool {
+	this.f.mtx.Lock()
+	defer this.f.mtx.Unlock()
+	active := this.f.remove(this)
+	this.f.add(this, d)
+	return active
+}
+
+type fakeTicker struct {
+	t *fakeTimer
+}
+
+func (this fakeTicker) Chan() <-chan time.Time {
+	return this.t.c
+}
+
+func (this fakeTicker) Stop() {
+	this.t.Stop()
+}
+
+/*
+ *  now为时钟的初始时间,默认为time.Now()
+ */
+func NewFake(now ...time.Time) *Fake {
+	f := &Fake{
+		timers: util.NewMinHeap(64),
+	}
+	if len(now) > 0 {
+		f.now = now[0]
+	} else {
+		f.now = time.Now()
+	}
+	f.cond = sync.NewCond(&f.mtx)
+	return f
+}
+
+//调用时持有锁
+func (this *Fake) add(t *fakeTimer, d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	this.seq++
+	t.seq = this.seq
+	t.when = this.now.Add(d)
+	this.timers.Insert(t)
+	this.cond.Broadcast()
+}
+
+//调用时持有锁
+func (this *Fake) remove(t *fakeTimer) bool {
+	if t.index < 0 {
+		return false
+	}
+	this.timers.Remove(t)
+	return true
+}
+
+func (this *Fake) newTimer(d time.Duration, period time.Duration, fn func()) *fakeTimer {
+	t := &fakeTimer{
+		f:      this,
+		period: period,
+		fn:     fn,
+		index:  -1,
+	}
+	if nil == fn {
+		t.c = make(chan time.Time, 1)
+	}
+	this.mtx.Lock()
+	this.add(t, d)
+	this.mtx.Unlock()
+	return t
+}
+
+func (this *Fake) Now() time.Time {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	return this.now
+}
+
+func (this *Fake) Since(t time.Time) time.Duration {
+	return this.Now().Sub(t)
+}
+
+func (this *Fake) Until(t time.Time) time.Duration {
+	return t.Sub(this.Now())
+}
+
+/*
+ *  阻塞直到时钟被推进了d
+ */
+func (this *Fake) Sleep(d time.Duration) {
+	<-this.After(d)
+}
+
+func (this *Fake) After(d time.Duration) <-chan time.Time {
+	return this.NewTimer(d).Chan()
+}
+
+func (this *Fake) NewTimer(d time.Duration) Timer {
+	return this.newTimer(d, 0, nil)
+}
+
+func (this *Fake) AfterFunc(d time.Duration, f func()) Timer {
+	if nil == f {
+		panic("f == nil")
+	}
+	return this.newTimer(d, 0, f)
+}
+
+func (this *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{this.newTimer(d, d, nil)}
+}
+
+/*
+ *  尚未到期的定时器数量
+ */
+func (this *Fake) Pending() int {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	return this.timers.Size()
+}
+
+/*
+ *  阻塞直到尚未到期的定时器数量不少于n
+ */
+func (this *Fake) BlockUntil(n int) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	for this.timers.Size() < n {
+		this.cond.Wait()
+	}
+}
+
+/*
+ *  将时钟推进d,依次触发到期的定时器
+ */
+func (this *Fake) Advance(d time.Duration) {
+	this.mtx.Lock()
+	target := this.now.Add(d)
+	this.mtx.Unlock()
+	this.advanceTo(target)
+}
+
+/*
+ *  将时钟推进到t,t早于当前时间时只触发已经到期的定时器
+ */
+func (this *Fake) Set(t time.Time) {
+	this.advanceTo(t)
+}
+
+func (this *Fake) advanceTo(target time.Time) {
+	for {
+		this.mtx.Lock()
+		min := this.timers.Min()
+		if nil == min || min.(*fakeTimer).when.After(target) {
+			if target.After(this.now) {
+				this.now = target
+			}
+			this.mtx.Unlock()
+			return
+		}
+
+		t := this.timers.PopMin().(*fakeTimer)
+		if t.when.After(this.now) {
+			this.now = t.when
+		}
+		now := this.now
+		if t.period > 0 {
+			this.seq++
+			t.seq = this.seq
+			t.when = t.when.Add(t.period)
+			this.timers.Insert(t)
+		}
+		this.mtx.Unlock()
+
+		if nil != t.fn {
+			t.fn()
+		} else {
+			select {
+			case t.c <- now:
+			default:
+			}
+		}
+	}
+}
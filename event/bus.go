@@ -0,0 +1,211 @@
+package event
+
+import (
+	"fmt"
+	"github.com/sniperHW/kendynet"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ *  按类型分发的事件总线
+ *
+ *  以事件的类型作为事件名,Publish[T]触发所有Subscribe[T]注册的回调。回调的签名在编译期检查,
+ *  触发时不经过反射。
+ *
+ *  与EventHandler相同:
+ *  SubscribeOnce注册的回调只执行一次。
+ *  回调执行中可以Unsubscribe(包括自身),被移除的回调不会再被执行。
+ *  指定了processQueue时回调在processQueue中执行,否则在调用Publish的goroutine上执行。
+ */
+type Bus struct {
+	sync.RWMutex
+	slots        map[interface{}]interface{} //typeKey[T] -> *typedSlot[T]
+	processQueue *EventQueue
+}
+
+//每个T对应一个不同的key类型,查找slot不需要反射
+type typeKey[T any] struct{}
+
+type Subscription[T any] struct {
+	fn      func(T)
+	once    bool
+	fired   int32
+	removed int32
+	slot    *typedSlot[T]
+}
+
+type typedSlot[T any] struct {
+	sync.Mutex
+	bus     *Bus
+	subs    []*Subscription[T] //写时复制,emit时不需要持有锁
+	removed int32
+}
+
+func NewBus(processQueue ...*EventQueue) *Bus {
+	var q *EventQueue
+	if len(processQueue) > 0 {
+		q = processQueue[0]
+	}
+	return &Bus{
+		slots:        map[interface{}]interface{}{},
+		processQueue: q,
+	}
+}
+
+func getSlot[T any](bus *Bus) *typedSlot[T] {
+	bus.RLock()
+	slot, ok := bus.slots[typeKey[T]{}]
+	bus.RUnlock()
+	if ok {
+		return slot.(*typedSlot[T])
+	} else {
+		return nil
+	}
+}
+
+func subscribe[T any](bus *Bus, once bool, fn func(T)) *Subscription[T] {
+	if nil == bus {
+		panic("bus == nil")
+	}
+
+	if nil == fn {
+		panic("fn == nil")
+	}
+
+	bus.Lock()
+	defer bus.Unlock()
+	var slot *typedSlot[T]
+	if s, ok := bus.slots[typeKey[T]{}]; ok {
+		slot = s.(*typedSlot[T])
+	} else {
+		slot = &typedSlot[T]{bus: bus}
+		bus.slots[typeKey[T]{}] = slot
+	}
+
+	s := &Subscription[T]{
+		fn:   fn,
+		once: once,
+		slot: slot,
+	}
+
+	slot.Lock()
+	subs := make([]*Subscription[T], len(slot.subs), len(slot.subs)+1)
+	copy(subs, slot.subs)
+	slot.subs = append(subs, s)
+	slot.Unlock()
+
+	return s
+}
+
+func Subscribe[T any](bus *Bus, fn func(T)) *Subscription[T] {
+	return subscribe(bus, false, fn)
+}
+
+func SubscribeOnce[T any](bus *Bus, fn func(T)) *Subscription[T] {
+	return subscribe(bus, true, fn)
+}
+
+/*
+ *  触发类型为T的事件
+ */
+func Publish[T any](bus *Bus, ev T) {
+	slot := getSlot[T](bus)
+	if nil != slot {
+		if bus.processQueue != nil {
+			bus.processQueue.PostNoWait(func() {
+				slot.emit(ev)
+			})
+		} else {
+			slot.emit(ev)
+		}
+	}
+}
+
+/*
+ *  移除类型为T的所有回调,正在执行的Publish不再执行剩余的回调
+ */
+func Clear[T any](bus *Bus) {
+	bus.Lock()
+	defer bus.Unlock()
+	if slot, ok := bus.slots[typeKey[T]{}]; ok {
+		atomic.StoreInt32(&slot.(*typedSlot[T]).removed, 1)
+		delete(bus.slots, typeKey[T]{})
+	}
+}
+
+func (this *Subscription[T]) Unsubscribe() {
+	if atomic.CompareAndSwapInt32(&this.removed, 0, 1) {
+		this.slot.remove(this)
+	}
+}
+
+func (this *typedSlot[T]) remove(s *Subscription[T]) {
+	this.Lock()
+	defer this.Unlock()
+	for i, v := range this.subs {
+		if v == s {
+			subs := make([]*Subscription[T], 0, len(this.subs)-1)
+			subs = append(subs, this.subs[:i]...)
+			this.subs = append(subs, this.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (this *typedSlot[T]) emit(ev T) {
+	this.Lock()
+	subs := this.subs
+	this.Unlock()
+
+	for _, s := range subs {
+		if atomic.LoadInt32(&this.removed) == 1 {
+			//当前slot已经被清除
+			return
+		}
+		if atomic.LoadInt32(&s.removed) == 1 {
+			continue
+		}
+		if s.once {
+			if !atomic.CompareAndSwapInt32(&s.fired, 0, 1) {
+				continue
+			}
+			s.Unsubscribe()
+		}
+		if err := pcall1(s.fn, ev); nil != err {
+			if nil != this.bus.processQueue {
+				this.bus.processQueue.handlePanic(err)
+			} else if logger := kendynet.GetLogger(); logger != nil {
+				logger.Errorln(err)
+			}
+		}
+	}
+}
+
+func panicError(r interface{}) error {
+	buf := make([]byte, 65535)
+	l := runtime.Stack(buf, false)
+	return fmt.Errorf("%v: %s", r, buf[:l])
+}
+
+//不经过反射调用fn,panic转换成error
+func pcall0(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError(r)
+		}
+	}()
+	fn()
+	return
+}
+
+func pcall1[T any](fn func(T), ev T) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError(r)
+		}
+	}()
+	fn(ev)
+	return
+}
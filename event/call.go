@@ -0,0 +1,143 @@
+package event
+
+import (
+	"context"
+	"github.com/sniperHW/kendynet/util"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ *  在队列中执行并取得返回值
+ *
+ *  fn在队列的goroutine上执行,用于在其它goroutine上读取/修改队列拥有的状态。
+ *  fn panic时队列继续运行,panic作为*PanicError返回给调用方。
+ *  不能在队列自身的goroutine上调用Call/CallTimeout/CallContext,否则会死锁。
+ */
+
+/*
+ *  fn在队列中panic时返回的错误,Error()包含panic的值和调用栈
+ */
+type PanicError struct {
+	err error
+}
+
+func (this *PanicError) Error() string {
+	return this.err.Error()
+}
+
+type Future struct {
+	done chan struct{}
+	ret  []interface{}
+	err  error
+	ctx  context.Context
+}
+
+//在队列中执行
+func (this *Future) run(fn interface{}, args []interface{}) {
+	if nil != this.ctx {
+		//调用方已经放弃等待,不再执行
+		if err := this.ctx.Err(); nil != err {
+			this.err = err
+			close(this.done)
+			return
+		}
+	}
+	ret, err := util.ProtectCall(fn, args...)
+	if nil != err {
+		err = &PanicError{err: err}
+	}
+	this.ret, this.err = ret, err
+	close(this.done)
+}
+
+//Shutdown超时被丢弃时在Run的goroutine上调用
+func (this *Future) drop() {
+	this.err = ErrDropped
+	close(this.done)
+}
+
+/*
+ *  fn执行完毕或被丢弃后关闭
+ */
+func (this *Future) Done() <-chan struct{} {
+	return this.done
+}
+
+/*
+ *  阻塞直到fn执行完毕,返回fn的返回值。被Shutdown丢弃时返回ErrDropped
+ */
+func (this *Future) Get() ([]interface{}, error) {
+	<-this.done
+	return this.ret, this.err
+}
+
+/*
+ *  ctx结束时返回ctx.Err(),fn仍然会被执行
+ */
+func (this *Future) GetContext(ctx context.Context) ([]interface{}, error) {
+	select {
+	case <-this.done:
+		return this.ret, this.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (this *EventQueue) postFuture(ctx context.Context, fn interface{}, args []interface{}) (*Future, error) {
+	if nil == fn {
+		panic("fn == nil")
+	}
+	future := &Future{
+		done: make(chan struct{}),
+		ctx:  ctx,
+	}
+	e := this.preparePost(future.run, fn, args)
+	e.onDrop = future.drop
+	atomic.AddInt64(&this.pending, 1)
+	if err := this.onPost(this.eventQueue.AddNoWait(e)); nil != err {
+		return nil, err
+	}
+	return future, nil
+}
+
+/*
+ *  投递fn,返回的Future用于在将来等待fn的返回值
+ */
+func (this *EventQueue) PostFuture(fn interface{}, args ...interface{}) (*Future, error) {
+	return this.postFuture(nil, fn, args)
+}
+
+/*
+ *  投递fn并阻塞直到fn执行完毕
+ */
+func (this *EventQueue) Call(fn interface{}, args ...interface{}) ([]interface{}, error) {
+	future, err := this.postFuture(nil, fn, args)
+	if nil != err {
+		return nil, err
+	}
+	return future.Get()
+}
+
+/*
+ *  ctx结束时返回ctx.Err(),此时fn尚未开始执行则不会再执行
+ */
+func (this *EventQueue) CallContext(ctx context.Context, fn interface{}, args ...interface{}) ([]interface{}, error) {
+	if err := ctx.Err(); nil != err {
+		return nil, err
+	}
+	future, err := this.postFuture(ctx, fn, args)
+	if nil != err {
+		return nil, err
+	}
+	return future.GetContext(ctx)
+}
+
+/*
+ *  超时返回context.DeadlineExceeded
+ */
+func (this *EventQueue) CallTimeout(timeout time.Duration, fn interface{}, args ...interface{}) ([]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return this.CallContext(ctx, fn, args...)
+}
@@ -0,0 +1,66 @@
+package event
+
+import (
+	"github.com/sniperHW/kendynet/timer"
+	"github.com/sniperHW/kendynet/util"
+	"time"
+)
+
+/*
+ *  延时投递
+ *
+ *  到期后事件投递到队列中执行,返回的定时器可以用来取消。
+ *  在队列中调用Cancel返回true就保证事件不会被执行(到期后已投递尚未执行的事件也会被取消)。
+ *  队列关闭后到期的事件被丢弃。
+ */
+
+/*
+ *  指定延时投递使用的TimerMgr,默认使用timer包的全局TimerMgr
+ */
+func (this *EventQueue) SetTimerMgr(mgr *timer.TimerMgr) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	this.timerMgr = mgr
+}
+
+func (this *EventQueue) getTimerMgr() *timer.TimerMgr {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	return this.timerMgr
+}
+
+func (this *EventQueue) delayCallback(fn interface{}, args []interface{}) func(*timer.Timer, interface{}) {
+	return func(_ *timer.Timer, _ interface{}) {
+		if _, err := util.ProtectCall(fn, args...); err != nil {
+			this.handlePanic(err)
+		}
+	}
+}
+
+/*
+ *  d之后将事件投递到队列
+ */
+func (this *EventQueue) PostAfter(d time.Duration, fn interface{}, args ...interface{}) (*timer.Timer, error) {
+	if this.eventQueue.Closed() {
+		return nil, util.ErrQueueClosed
+	}
+	if mgr := this.getTimerMgr(); nil != mgr {
+		return mgr.Once(d, this.delayCallback(fn, args), nil, this), nil
+	} else {
+		return timer.Once(d, this.delayCallback(fn, args), nil, this), nil
+	}
+}
+
+/*
+ *  在when将事件投递到队列,when早于当前时间时立即投递
+ */
+func (this *EventQueue) PostAt(when time.Time, fn interface{}, args ...interface{}) (*timer.Timer, error) {
+	if this.eventQueue.Closed() {
+		return nil, util.ErrQueueClosed
+	}
+	if mgr := this.getTimerMgr(); nil != mgr {
+		return mgr.At(when, this.delayCallback(fn, args), nil, this), nil
+	} else {
+		return timer.At(when, this.delayCallback(fn, args), nil, this), nil
+	}
+}
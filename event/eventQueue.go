@@ -1,71 +1,185 @@
 package event
 
 import (
-	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/timer"
 	"github.com/sniperHW/kendynet/util"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type element struct {
-	args []interface{}
-	fn   interface{}
+	args   []interface{}
+	fn     interface{}
+	posted time.Time
+	onDrop func() //Shutdown超时被丢弃时调用
+}
+
+/*
+ *  队列统计
+ *  Wait为从投递到开始执行的时间,Exec为执行耗时
+ */
+type QueueStats struct {
+	Len       int //已投递尚未执行完的事件
+	Processed uint64
+	TotalWait time.Duration
+	MaxWait   time.Duration
+	TotalExec time.Duration
+	MaxExec   time.Duration
+	Dropped   uint64 //Shutdown超时被丢弃的事件
 }
 
 type EventQueue struct {
 	eventQueue *util.BlockQueue
 	started    int32
+	pending    int64
+	processed  uint64
+	totalWait  int64
+	maxWait    int64
+	totalExec  int64
+	maxExec    int64
+	mtx        sync.Mutex
+	high       []*element
+	low        []*element
+	nhigh      int32
+	drained    bool //Run已经退出,高/低优先级队列不再接受投递
+	timerMgr   *timer.TimerMgr
+	abort      int32 //Shutdown超时,丢弃剩余的事件
+	dropped    uint64
+	done       chan struct{}
+	onPanic    func(error)
 }
 
 func NewEventQueueWithName(name string, fullSize ...int) *EventQueue {
-	r := &EventQueue{}
+	r := &EventQueue{done: make(chan struct{})}
 	r.eventQueue = util.NewBlockQueueWithName(name, fullSize...)
 	return r
 }
 
 func NewEventQueue(fullSize ...int) *EventQueue {
-	r := &EventQueue{}
+	r := &EventQueue{done: make(chan struct{})}
 	r.eventQueue = util.NewBlockQueue(fullSize...)
 	return r
 }
 
 func (this *EventQueue) preparePost(fn interface{}, args ...interface{}) *element {
 	return &element{
-		fn:   fn,
-		args: args,
+		fn:     fn,
+		args:   args,
+		posted: time.Now(),
+	}
+}
+
+func (this *EventQueue) onPost(err error) error {
+	if nil != err {
+		atomic.AddInt64(&this.pending, -1)
 	}
+	return err
 }
 
 func (this *EventQueue) PostFullReturn(fn interface{}, args ...interface{}) error {
-	return this.eventQueue.AddNoWait(this.preparePost(fn, args...), true)
+	atomic.AddInt64(&this.pending, 1)
+	return this.onPost(this.eventQueue.AddNoWait(this.preparePost(fn, args...), true))
 }
 
 func (this *EventQueue) PostNoWait(fn interface{}, args ...interface{}) error {
-	return this.eventQueue.AddNoWait(this.preparePost(fn, args...))
+	atomic.AddInt64(&this.pending, 1)
+	return this.onPost(this.eventQueue.AddNoWait(this.preparePost(fn, args...)))
 }
 
 func (this *EventQueue) Post(fn interface{}, args ...interface{}) error {
-	return this.eventQueue.Add(this.preparePost(fn, args...))
+	atomic.AddInt64(&this.pending, 1)
+	return this.onPost(this.eventQueue.Add(this.preparePost(fn, args...)))
 }
 
 func (this *EventQueue) Close() {
 	this.eventQueue.Close()
 }
 
-func (this *EventQueue) Run() {
+/*
+ *  已投递尚未执行完的事件数量
+ */
+func (this *EventQueue) Len() int {
+	return int(atomic.LoadInt64(&this.pending))
+}
+
+func (this *EventQueue) Stats() QueueStats {
+	return QueueStats{
+		Len:       this.Len(),
+		Processed: atomic.LoadUint64(&this.processed),
+		TotalWait: time.Duration(atomic.LoadInt64(&this.totalWait)),
+		MaxWait:   time.Duration(atomic.LoadInt64(&this.maxWait)),
+		TotalExec: time.Duration(atomic.LoadInt64(&this.totalExec)),
+		MaxExec:   time.Duration(atomic.LoadInt64(&this.maxExec)),
+		Dropped:   atomic.LoadUint64(&this.dropped),
+	}
+}
+
+//只在Run的goroutine上调用
+func (this *EventQueue) record(wait time.Duration, exec time.Duration) {
+	atomic.AddUint64(&this.processed, 1)
+	atomic.AddInt64(&this.totalWait, int64(wait))
+	if int64(wait) > atomic.LoadInt64(&this.maxWait) {
+		atomic.StoreInt64(&this.maxWait, int64(wait))
+	}
+	atomic.AddInt64(&this.totalExec, int64(exec))
+	if int64(exec) > atomic.LoadInt64(&this.maxExec) {
+		atomic.StoreInt64(&this.maxExec, int64(exec))
+	}
+	atomic.AddInt64(&this.pending, -1)
+}
+
+func (this *EventQueue) exec(e *element) {
+	if atomic.LoadInt32(&this.abort) == 1 {
+		this.drop(e)
+		return
+	}
+	start := time.Now()
+	var err error
+	if fn, ok := e.fn.(func()); ok && len(e.args) == 0 {
+		err = pcall0(fn)
+	} else {
+		_, err = util.ProtectCall(e.fn, e.args...)
+	}
+	if err != nil {
+		this.handlePanic(err)
+	}
+	this.record(start.Sub(e.posted), time.Since(start))
+}
+
+/*
+ *  执行事件直到队列关闭,返回退出的原因。
+ *  Run只能执行一次,重复调用立即返回ExitAlreadyStarted。
+ */
+func (this *EventQueue) Run() ExitReason {
 	if atomic.CompareAndSwapInt32(&this.started, 0, 1) {
-		for {
-			closed, localList := this.eventQueue.Get()
-			for _, v := range localList {
-				e := v.(*element)
-				if _, err := util.ProtectCall(e.fn, e.args...); err != nil {
-					logger := kendynet.GetLogger()
-					if logger != nil {
-						logger.Errorln(err)
-					}
-				}
+		return this.run()
+	} else {
+		return ExitAlreadyStarted
+	}
+}
+
+func (this *EventQueue) run() ExitReason {
+	defer close(this.done)
+	for {
+		closed, localList := this.eventQueue.Get()
+		for _, v := range localList {
+			this.runHigh()
+			if e, ok := v.(*element); ok {
+				this.exec(e)
+			}
+		}
+		this.runHigh()
+		this.runLow()
+		if closed {
+			for !this.finish() {
+				this.runHigh()
+				this.runLow()
 			}
-			if closed {
-				return
+			if atomic.LoadUint64(&this.dropped) > 0 {
+				return ExitDropped
+			} else {
+				return ExitClosed
 			}
 		}
 	}
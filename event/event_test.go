@@ -2,8 +2,15 @@ package event
 
 //go test -covermode=count -v -run=.
 import (
+	"context"
 	"fmt"
+	"github.com/sniperHW/kendynet/clock"
+	"github.com/sniperHW/kendynet/timer"
+	"github.com/sniperHW/kendynet/util"
+	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
+	"time"
 )
 
 func testQueueMode() {
@@ -182,3 +189,530 @@ func TestEvent(t *testing.T) {
 
 	testUseEventQueue()
 }
+
+func TestEventQueueStats(t *testing.T) {
+	queue := NewEventQueue()
+	for i := 0; i < 3; i++ {
+		queue.Post(func() {
+			time.Sleep(10 * time.Millisecond)
+		})
+	}
+	assert.Equal(t, 3, queue.Len())
+	queue.PostNoWait(func() {
+		queue.Close()
+	})
+	queue.Run()
+
+	stats := queue.Stats()
+	assert.Equal(t, 0, stats.Len)
+	assert.Equal(t, uint64(4), stats.Processed)
+	assert.True(t, stats.MaxExec >= 10*time.Millisecond)
+	assert.True(t, stats.TotalExec >= 30*time.Millisecond)
+	assert.True(t, stats.MaxWait >= 30*time.Millisecond)
+
+	//关闭后投递失败不计入
+	assert.NotNil(t, queue.PostNoWait(func() {}))
+	assert.Equal(t, 0, queue.Len())
+}
+
+func TestEventQueuePool(t *testing.T) {
+	pool := NewEventQueuePool(4)
+	assert.Equal(t, 4, pool.Workers())
+	assert.Equal(t, pool.Worker(1), pool.Worker(5))
+	assert.Equal(t, HashKey("room1"), HashKey("room1"))
+
+	done := make(chan struct{})
+	go func() {
+		pool.Run()
+		close(done)
+	}()
+
+	//相同key按投递顺序执行
+	const keys = 8
+	const count = 1000
+	var mtx sync.Mutex
+	results := make([][]int, keys)
+	for i := 0; i < count; i++ {
+		for k := 0; k < keys; k++ {
+			k, i := k, i
+			assert.Nil(t, pool.PostKey(uint64(k), func() {
+				mtx.Lock()
+				results[k] = append(results[k], i)
+				mtx.Unlock()
+			}))
+		}
+	}
+
+	//不同worker上的事件并发执行
+	block := make(chan struct{})
+	pool.PostKeyNoWait(0, func() {
+		<-block
+	})
+	ran := make(chan struct{})
+	pool.PostKeyNoWait(1, func() {
+		close(ran)
+	})
+	<-ran
+	assert.True(t, pool.Len() > 0)
+	close(block)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	pool.PostKeyNoWait(HashKey("room1"), wg.Done)
+	wg.Wait()
+
+	pool.Close()
+	<-done
+
+	for k := 0; k < keys; k++ {
+		assert.Equal(t, count, len(results[k]))
+		for i := 0; i < count; i++ {
+			if results[k][i] != i {
+				t.Fatalf("key %d out of order at %d", k, i)
+			}
+		}
+	}
+
+	stats := pool.Stats()
+	assert.Equal(t, 0, stats.Len)
+	assert.Equal(t, uint64(keys*count+3), stats.Processed)
+	var processed uint64
+	for _, v := range pool.WorkerStats() {
+		processed += v.Processed
+	}
+	assert.Equal(t, stats.Processed, processed)
+	assert.NotNil(t, pool.Post(func() {}))
+}
+
+func TestEventQueuePriority(t *testing.T) {
+	queue := NewEventQueue()
+	go queue.Run()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	queue.PostNoWait(func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	var order []string
+	queue.PostNoWait(func() {
+		order = append(order, "n1")
+		//执行中投递的高优先级事件先于后续的普通事件执行
+		queue.PostPriority(PriorityHigh, func() {
+			order = append(order, "h3")
+		})
+	})
+	queue.PostNoWait(func() {
+		order = append(order, "n2")
+	})
+	queue.PostPriority(PriorityLow, func() {
+		order = append(order, "l1")
+	})
+	queue.PostPriority(PriorityHigh, func() {
+		order = append(order, "h1")
+	})
+	queue.PostPriority(PriorityHigh, func() {
+		order = append(order, "h2")
+	})
+	queue.PostPriority(PriorityNormal, func() {
+		order = append(order, "n3")
+	})
+	queue.PostPriority(PriorityLow, func() {
+		order = append(order, "l2")
+	})
+	close(release)
+
+	done := make(chan struct{})
+	queue.PostPriority(PriorityLow, func() {
+		close(done)
+	})
+	<-done
+	assert.Equal(t, []string{"h1", "h2", "n1", "h3", "n2", "n3", "l1", "l2"}, order)
+	assert.Equal(t, 0, queue.Len())
+
+	//未设置的优先级为PriorityNormal
+	var priority Priority
+	assert.Equal(t, PriorityNormal, priority)
+
+	//关闭前投递的事件都会被执行
+	queue = NewEventQueue()
+	var count int
+	for i := 0; i < 10; i++ {
+		queue.PostPriority(Priority(i%3-1), func() {
+			count++
+		})
+	}
+	queue.Close()
+	assert.Equal(t, util.ErrQueueClosed, queue.PostPriority(PriorityHigh, func() {}))
+	assert.Equal(t, util.ErrQueueClosed, queue.PostPriority(PriorityLow, func() {}))
+	queue.Run()
+	assert.Equal(t, 10, count)
+	assert.Equal(t, 0, queue.Len())
+}
+
+func TestEventQueuePostAfter(t *testing.T) {
+	c := clock.NewFake()
+	queue := NewEventQueue()
+	queue.SetTimerMgr(timer.NewTimerMgr(1, c))
+	go queue.Run()
+	defer queue.Close()
+
+	fired := make(chan string, 3)
+	queue.PostAfter(time.Second, func(s string) {
+		fired <- s
+	}, "after")
+	queue.PostAt(c.Now().Add(2*time.Second), func() {
+		fired <- "at"
+	})
+	canceled, _ := queue.PostAfter(time.Second, func() {
+		fired <- "canceled"
+	})
+	assert.True(t, canceled.Cancel())
+
+	c.Advance(time.Second)
+	assert.Equal(t, "after", <-fired)
+	c.Advance(time.Second)
+	assert.Equal(t, "at", <-fired)
+
+	//到期后已投递尚未执行时,在队列中取消
+	started := make(chan struct{})
+	release := make(chan struct{})
+	queue.PostNoWait(func() {
+		close(started)
+		<-release
+	})
+	<-started
+	delayed, _ := queue.PostAfter(time.Second, func() {
+		fired <- "delayed"
+	})
+	c.Advance(time.Second)
+	result := make(chan bool, 1)
+	queue.PostPriority(PriorityHigh, func() {
+		result <- delayed.Cancel()
+	})
+	close(release)
+	assert.True(t, <-result)
+
+	done := make(chan struct{})
+	queue.PostNoWait(func() {
+		close(done)
+	})
+	<-done
+	assert.Equal(t, 0, len(fired))
+
+	closed := NewEventQueue()
+	closed.Close()
+	_, err := closed.PostAfter(time.Second, func() {})
+	assert.Equal(t, util.ErrQueueClosed, err)
+}
+
+func TestEventQueueCall(t *testing.T) {
+	queue := NewEventQueue()
+	go queue.Run()
+	defer queue.Close()
+
+	state := map[string]int{"a": 1}
+	ret, err := queue.Call(func(k string) (int, bool) {
+		v, ok := state[k]
+		return v, ok
+	}, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{1, true}, ret)
+
+	future, err := queue.PostFuture(func(k string, v int) {
+		state[k] = v
+	}, "b", 2)
+	assert.Nil(t, err)
+	<-future.Done()
+	ret, err = future.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ret))
+
+	ret, err = queue.CallTimeout(time.Second, func() int {
+		return len(state)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{2}, ret)
+
+	//panic返回给调用方,队列继续运行
+	_, err = queue.Call(func() {
+		panic("call panic")
+	})
+	_, ok := err.(*PanicError)
+	assert.True(t, ok)
+	assert.Contains(t, err.Error(), "call panic")
+
+	//超时之后fn尚未开始执行则不再执行
+	started := make(chan struct{})
+	release := make(chan struct{})
+	queue.PostNoWait(func() {
+		close(started)
+		<-release
+	})
+	<-started
+	var called bool
+	_, err = queue.CallTimeout(10*time.Millisecond, func() {
+		called = true
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = queue.CallContext(ctx, func() {
+		called = true
+	})
+	assert.Equal(t, context.Canceled, err)
+
+	future, _ = queue.PostFuture(func() int {
+		return 3
+	})
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = future.GetContext(ctx)
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+	close(release)
+	ret, err = future.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{3}, ret)
+	ret, _ = queue.Call(func() bool {
+		return called
+	})
+	assert.Equal(t, []interface{}{false}, ret)
+
+	closed := NewEventQueue()
+	closed.Close()
+	_, err = closed.Call(func() {})
+	assert.Equal(t, util.ErrQueueClosed, err)
+}
+
+func TestEventQueueShutdown(t *testing.T) {
+	{
+		//超时前执行完毕
+		queue := NewEventQueue()
+		reason := make(chan ExitReason, 1)
+		go func() {
+			reason <- queue.Run()
+		}()
+		queue.Call(func() {})
+		var count int
+		for i := 0; i < 10; i++ {
+			queue.PostNoWait(func() {
+				count++
+			})
+		}
+		dropped, ok := queue.Shutdown(time.Second)
+		assert.Equal(t, 0, dropped)
+		assert.True(t, ok)
+		assert.Equal(t, 10, count)
+		assert.Equal(t, ExitClosed, <-reason)
+		assert.Equal(t, util.ErrQueueClosed, queue.PostNoWait(func() {}))
+		assert.Equal(t, ExitAlreadyStarted, queue.Run())
+	}
+
+	{
+		//超时后丢弃剩余的事件,等待正在执行的事件返回
+		queue := NewEventQueue()
+		reason := make(chan ExitReason, 1)
+		go func() {
+			reason <- queue.Run()
+		}()
+		started := make(chan struct{})
+		queue.PostNoWait(func() {
+			close(started)
+			time.Sleep(50 * time.Millisecond)
+		})
+		<-started
+		var count int
+		for i := 0; i < 5; i++ {
+			queue.PostNoWait(func() {
+				count++
+			})
+		}
+		queue.PostPriority(PriorityLow, func() {
+			count++
+		})
+		future, _ := queue.PostFuture(func() {})
+		dropped, ok := queue.Shutdown(40 * time.Millisecond)
+		assert.Equal(t, 7, dropped)
+		assert.True(t, ok)
+		assert.Equal(t, 0, count)
+		assert.Equal(t, ExitDropped, <-reason)
+		_, err := future.Get()
+		assert.Equal(t, ErrDropped, err)
+		assert.Equal(t, 0, queue.Len())
+		assert.Equal(t, uint64(7), queue.Stats().Dropped)
+		<-queue.Done()
+	}
+
+	{
+		//正在执行的事件不返回时Shutdown不会一直阻塞
+		queue := NewEventQueue()
+		reason := make(chan ExitReason, 1)
+		go func() {
+			reason <- queue.Run()
+		}()
+		started := make(chan struct{})
+		block := make(chan struct{})
+		queue.PostNoWait(func() {
+			close(started)
+			<-block
+		})
+		<-started
+		for i := 0; i < 3; i++ {
+			queue.PostNoWait(func() {})
+		}
+		beg := time.Now()
+		dropped, ok := queue.Shutdown(10 * time.Millisecond)
+		assert.True(t, time.Since(beg) < time.Second)
+		assert.False(t, ok)
+		assert.Equal(t, 0, dropped)
+		select {
+		case <-queue.Done():
+			assert.Fail(t, "Run exited while blocked")
+		default:
+		}
+		//事件返回后剩余的事件被丢弃
+		close(block)
+		assert.Equal(t, ExitDropped, <-reason)
+		assert.Equal(t, uint64(3), queue.Stats().Dropped)
+	}
+
+	{
+		//Run尚未启动
+		queue := NewEventQueue()
+		queue.PostNoWait(func() {})
+		queue.PostNoWait(func() {})
+		dropped, ok := queue.Shutdown(time.Second)
+		assert.Equal(t, 2, dropped)
+		assert.True(t, ok)
+		assert.Equal(t, ExitAlreadyStarted, queue.Run())
+	}
+
+	{
+		pool := NewEventQueuePool(2)
+		go pool.Run()
+		//等待worker启动
+		for i := 0; i < pool.Workers(); i++ {
+			pool.Worker(uint64(i)).Call(func() {})
+		}
+		for i := 0; i < 10; i++ {
+			pool.PostNoWait(func() {})
+		}
+		dropped, ok := pool.Shutdown(time.Second)
+		assert.Equal(t, 0, dropped)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(12), pool.Stats().Processed)
+	}
+}
+
+func TestEventQueuePanicHandler(t *testing.T) {
+	queue := NewEventQueue()
+	errs := make(chan error, 2)
+	queue.SetPanicHandler(func(err error) {
+		errs <- err
+	})
+	go queue.Run()
+	defer queue.Close()
+
+	queue.PostNoWait(func() {
+		panic("post panic")
+	})
+	assert.Contains(t, (<-errs).Error(), "post panic")
+
+	c := clock.NewFake()
+	queue.SetTimerMgr(timer.NewTimerMgr(1, c))
+	queue.PostAfter(time.Second, func() {
+		panic("delay panic")
+	})
+	c.Advance(time.Second)
+	assert.Contains(t, (<-errs).Error(), "delay panic")
+
+	//Call的panic返回给调用方,不经过panic handler
+	_, err := queue.Call(func() {
+		panic("call panic")
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(errs))
+}
+
+type testEventA struct {
+	n int
+}
+
+type testEventB string
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+
+	var got []string
+	Subscribe(bus, func(ev testEventA) {
+		got = append(got, fmt.Sprintf("a1:%d", ev.n))
+	})
+	SubscribeOnce(bus, func(ev testEventA) {
+		got = append(got, fmt.Sprintf("once:%d", ev.n))
+	})
+	var self, other *Subscription[testEventA]
+	self = Subscribe(bus, func(ev testEventA) {
+		got = append(got, fmt.Sprintf("self:%d", ev.n))
+		//执行中移除自身和后面的回调
+		self.Unsubscribe()
+		other.Unsubscribe()
+	})
+	other = Subscribe(bus, func(ev testEventA) {
+		got = append(got, fmt.Sprintf("other:%d", ev.n))
+	})
+	Subscribe(bus, func(ev testEventA) {
+		panic("bus panic")
+	})
+	Subscribe(bus, func(ev testEventB) {
+		got = append(got, "b:"+string(ev))
+	})
+
+	Publish(bus, testEventA{1})
+	Publish(bus, testEventA{2})
+	Publish(bus, testEventB("x"))
+	//没有订阅的类型
+	Publish(bus, 1)
+	assert.Equal(t, []string{"a1:1", "once:1", "self:1", "a1:2", "b:x"}, got)
+
+	Clear[testEventA](bus)
+	got = nil
+	Publish(bus, testEventA{3})
+	Publish(bus, testEventB("y"))
+	assert.Equal(t, []string{"b:y"}, got)
+
+	//回调在processQueue中执行
+	queue := NewEventQueue()
+	errs := make(chan error, 1)
+	queue.SetPanicHandler(func(err error) {
+		errs <- err
+	})
+	go queue.Run()
+	defer queue.Close()
+	bus = NewBus(queue)
+	done := make(chan int)
+	Subscribe(bus, func(ev testEventA) {
+		panic("queue panic")
+	})
+	Subscribe(bus, func(ev testEventA) {
+		done <- ev.n
+	})
+	Publish(bus, testEventA{4})
+	assert.Equal(t, 4, <-done)
+	assert.Contains(t, (<-errs).Error(), "queue panic")
+}
+
+func BenchmarkBusPublish(b *testing.B) {
+	bus := NewBus()
+	var sum int
+	Subscribe(bus, func(ev testEventA) {
+		sum += ev.n
+	})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Publish(bus, testEventA{1})
+	}
+}
@@ -0,0 +1,175 @@
+package event
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ *  多个worker处理的事件队列
+ *
+ *  每个worker是一个EventQueue,在各自的goroutine上执行。
+ *  带key投递的事件按key % workers分配到固定的worker,相同key的事件按投递顺序依次执行,
+ *  不同key的事件可能在不同的worker上并发执行(类似按key分片的actor)。
+ *  不带key投递的事件轮流分配到各个worker,相互之间不保证顺序。
+ *
+ *  需要将同一个key的回调(例如定时器、rpc响应)与其它事件串行执行时,把Worker(key)返回的EventQueue
+ *  传给timer/rpc即可。
+ */
+type EventQueuePool struct {
+	workers []*EventQueue
+	next    uint32
+	started int32
+}
+
+/*
+ *  fullSize为每个worker的队列上限
+ */
+func NewEventQueuePool(workers int, fullSize ...int) *EventQueuePool {
+	if workers <= 0 {
+		panic("workers <= 0")
+	}
+	p := &EventQueuePool{
+		workers: make([]*EventQueue, workers),
+	}
+	for i := range p.workers {
+		p.workers[i] = NewEventQueue(fullSize...)
+	}
+	return p
+}
+
+/*
+ *  字符串key的哈希,用于PostKey等方法
+ */
+func HashKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func (this *EventQueuePool) Workers() int {
+	return len(this.workers)
+}
+
+/*
+ *  key对应的worker
+ */
+func (this *EventQueuePool) Worker(key uint64) *EventQueue {
+	return this.workers[key%uint64(len(this.workers))]
+}
+
+func (this *EventQueuePool) nextWorker() *EventQueue {
+	return this.workers[atomic.AddUint32(&this.next, 1)%uint32(len(this.workers))]
+}
+
+func (this *EventQueuePool) PostKey(key uint64, fn interface{}, args ...interface{}) error {
+	return this.Worker(key).Post(fn, args...)
+}
+
+func (this *EventQueuePool) PostKeyNoWait(key uint64, fn interface{}, args ...interface{}) error {
+	return this.Worker(key).PostNoWait(fn, args...)
+}
+
+func (this *EventQueuePool) PostKeyFullReturn(key uint64, fn interface{}, args ...interface{}) error {
+	return this.Worker(key).PostFullReturn(fn, args...)
+}
+
+func (this *EventQueuePool) Post(fn interface{}, args ...interface{}) error {
+	return this.nextWorker().Post(fn, args...)
+}
+
+func (this *EventQueuePool) PostNoWait(fn interface{}, args ...interface{}) error {
+	return this.nextWorker().PostNoWait(fn, args...)
+}
+
+func (this *EventQueuePool) PostFullReturn(fn interface{}, args ...interface{}) error {
+	return this.nextWorker().PostFullReturn(fn, args...)
+}
+
+func (this *EventQueuePool) Close() {
+	for _, v := range this.workers {
+		v.Close()
+	}
+}
+
+/*
+ *  并行Shutdown所有worker,返回丢弃的事件总数,有worker仍阻塞在事件中时ok为false
+ */
+func (this *EventQueuePool) Shutdown(timeout time.Duration) (dropped int, ok bool) {
+	var wg sync.WaitGroup
+	var total int64
+	var stuck int32
+	wg.Add(len(this.workers))
+	for _, v := range this.workers {
+		go func(q *EventQueue) {
+			n, done := q.Shutdown(timeout)
+			atomic.AddInt64(&total, int64(n))
+			if !done {
+				atomic.StoreInt32(&stuck, 1)
+			}
+			wg.Done()
+		}(v)
+	}
+	wg.Wait()
+	return int(total), atomic.LoadInt32(&stuck) == 0
+}
+
+/*
+ *  启动所有worker,阻塞直到Close之后所有worker处理完队列中的事件
+ */
+func (this *EventQueuePool) Run() {
+	if atomic.CompareAndSwapInt32(&this.started, 0, 1) {
+		var wg sync.WaitGroup
+		wg.Add(len(this.workers))
+		for _, v := range this.workers {
+			go func(q *EventQueue) {
+				q.Run()
+				wg.Done()
+			}(v)
+		}
+		wg.Wait()
+	}
+}
+
+/*
+ *  已投递尚未执行完的事件数量
+ */
+func (this *EventQueuePool) Len() int {
+	n := 0
+	for _, v := range this.workers {
+		n += v.Len()
+	}
+	return n
+}
+
+/*
+ *  所有worker的汇总统计
+ */
+func (this *EventQueuePool) Stats() QueueStats {
+	var stats QueueStats
+	for _, v := range this.workers {
+		s := v.Stats()
+		stats.Len += s.Len
+		stats.Processed += s.Processed
+		stats.TotalWait += s.TotalWait
+		stats.TotalExec += s.TotalExec
+		stats.Dropped += s.Dropped
+		if s.MaxWait > stats.MaxWait {
+			stats.MaxWait = s.MaxWait
+		}
+		if s.MaxExec > stats.MaxExec {
+			stats.MaxExec = s.MaxExec
+		}
+	}
+	return stats
+}
+
+func (this *EventQueuePool) WorkerStats() []QueueStats {
+	stats := make([]QueueStats, len(this.workers))
+	for i, v := range this.workers {
+		stats[i] = v.Stats()
+	}
+	return stats
+}
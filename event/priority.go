@@ -0,0 +1,107 @@
+package event
+
+import (
+	"github.com/sniperHW/kendynet/util"
+	"sync/atomic"
+)
+
+/*
+ *  事件优先级
+ *
+ *  高优先级的事件在当前正在执行的事件返回后立即执行,先于所有已投递的普通/低优先级事件。
+ *  低优先级的事件只在没有待执行的高优先级和普通事件时执行。
+ *  同一优先级的事件按投递顺序执行。零值为PriorityNormal。
+ */
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+//唤醒Run的占位元素
+type wakeup struct{}
+
+/*
+ *  按优先级投递,PriorityNormal与PostNoWait相同。
+ *  高/低优先级的投递不受fullSize限制,不会阻塞。
+ */
+func (this *EventQueue) PostPriority(priority Priority, fn interface{}, args ...interface{}) error {
+	switch priority {
+	case PriorityHigh, PriorityLow:
+	default:
+		return this.PostNoWait(fn, args...)
+	}
+
+	atomic.AddInt64(&this.pending, 1)
+	e := this.preparePost(fn, args...)
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	if this.drained || this.eventQueue.Closed() {
+		return this.onPost(util.ErrQueueClosed)
+	}
+
+	list := &this.low
+	if priority == PriorityHigh {
+		list = &this.high
+	}
+
+	//列表非空时Run一定会再次处理列表,只在列表为空时唤醒
+	if len(*list) == 0 {
+		if err := this.eventQueue.AddNoWait(wakeup{}); nil != err {
+			return this.onPost(err)
+		}
+	}
+
+	*list = append(*list, e)
+	if priority == PriorityHigh {
+		atomic.AddInt32(&this.nhigh, 1)
+	}
+	return nil
+}
+
+//只在Run的goroutine上调用
+func (this *EventQueue) runHigh() {
+	for atomic.LoadInt32(&this.nhigh) > 0 {
+		this.mtx.Lock()
+		high := this.high
+		this.high = nil
+		atomic.StoreInt32(&this.nhigh, 0)
+		this.mtx.Unlock()
+		for _, e := range high {
+			this.exec(e)
+		}
+	}
+}
+
+//只在Run的goroutine上调用,有普通事件待执行时返回
+func (this *EventQueue) runLow() {
+	for this.eventQueue.Len() == 0 {
+		this.mtx.Lock()
+		if len(this.low) == 0 {
+			this.mtx.Unlock()
+			return
+		}
+		e := this.low[0]
+		this.low[0] = nil
+		this.low = this.low[1:]
+		this.mtx.Unlock()
+		this.exec(e)
+		this.runHigh()
+	}
+}
+
+//队列关闭后调用,高/低优先级队列都已经清空返回true
+func (this *EventQueue) finish() bool {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	if len(this.high) == 0 && len(this.low) == 0 {
+		this.drained = true
+		return true
+	} else {
+		return false
+	}
+}
@@ -0,0 +1,115 @@
+package event
+
+import (
+	"errors"
+	"github.com/sniperHW/kendynet"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrDropped = errors.New("event dropped")
+)
+
+/*
+ *  Run退出的原因
+ */
+type ExitReason int
+
+const (
+	ExitClosed         ExitReason = 1 //队列关闭,已投递的事件全部执行完毕
+	ExitDropped        ExitReason = 2 //Shutdown超时,剩余的事件被丢弃
+	ExitAlreadyStarted ExitReason = 3 //Run已经在运行或已经退出
+)
+
+func (this ExitReason) String() string {
+	switch this {
+	case ExitClosed:
+		return "closed"
+	case ExitDropped:
+		return "dropped"
+	case ExitAlreadyStarted:
+		return "already started"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+ *  设置回调panic时的处理函数,err包含panic的值和调用栈。
+ *  没有设置时通过kendynet.GetLogger()输出。
+ */
+func (this *EventQueue) SetPanicHandler(onPanic func(error)) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	this.onPanic = onPanic
+}
+
+func (this *EventQueue) handlePanic(err error) {
+	this.mtx.Lock()
+	onPanic := this.onPanic
+	this.mtx.Unlock()
+	if nil != onPanic {
+		onPanic(err)
+	} else if logger := kendynet.GetLogger(); logger != nil {
+		logger.Errorln(err)
+	}
+}
+
+//只在Run的goroutine上调用
+func (this *EventQueue) drop(e *element) {
+	atomic.AddUint64(&this.dropped, 1)
+	atomic.AddInt64(&this.pending, -1)
+	if nil != e.onDrop {
+		e.onDrop()
+	}
+}
+
+/*
+ *  Run退出后关闭
+ */
+func (this *EventQueue) Done() <-chan struct{} {
+	return this.done
+}
+
+/*
+ *  关闭队列(不再接受投递)并等待Run执行完已投递的事件。
+ *  timeout之后尚未执行的事件被丢弃。正在执行的事件不会被中断,Shutdown最多再等待timeout让其返回,
+ *  仍未返回时ok为false:Run阻塞在该事件中,事件返回后剩余的事件才被丢弃,可以通过Done及Stats().Dropped观察。
+ *  返回已经丢弃的数量。
+ *  Run尚未启动时丢弃所有事件,之后调用Run立即返回ExitAlreadyStarted。
+ *  被丢弃的PostFuture/Call返回ErrDropped。
+ */
+func (this *EventQueue) Shutdown(timeout time.Duration) (dropped int, ok bool) {
+	this.Close()
+	if atomic.CompareAndSwapInt32(&this.started, 0, 1) {
+		atomic.StoreInt32(&this.abort, 1)
+		this.run()
+		ok = true
+	} else {
+		this.waitDone(timeout)
+		atomic.StoreInt32(&this.abort, 1)
+		ok = this.waitDone(timeout)
+	}
+	return int(atomic.LoadUint64(&this.dropped)), ok
+}
+
+//Run在timeout内退出返回true
+func (this *EventQueue) waitDone(timeout time.Duration) bool {
+	if timeout <= 0 {
+		select {
+		case <-this.done:
+			return true
+		default:
+			return false
+		}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-this.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
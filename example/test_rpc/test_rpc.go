@@ -65,7 +65,10 @@ func (this *TestEncoder) Encode(message rpc.RPCMessage) (interface{}, error) {
 		resp := message.(*rpc.RPCResponse)
 		response := &testproto.RPCResponse{Seq: proto.Uint64(resp.Seq)}
 		if resp.Err != nil {
-			response.Err = proto.String(resp.Err.Error())
+			s := rpc.StatusOf(resp.Err)
+			response.Err = proto.String(s.Message)
+			response.Code = proto.Int32(int32(s.Code))
+			response.Details = s.Details
 		}
 		if resp.Ret != nil {
 			buff, err := pb.Encode(resp.Ret, 1000)
@@ -104,7 +107,11 @@ func (this *TestDecoder) Decode(o interface{}) (rpc.RPCMessage, error) {
 		resp := o.(*testproto.RPCResponse)
 		response := &rpc.RPCResponse{Seq: resp.GetSeq()}
 		if resp.Err != nil {
-			response.Err = fmt.Errorf(resp.GetErr())
+			code := rpc.Code(resp.GetCode())
+			if code == rpc.CodeOK {
+				code = rpc.CodeUnknown
+			}
+			response.Err = rpc.NewStatus(code, resp.GetErr(), resp.GetDetails())
 		}
 		if len(resp.Ret) > 0 {
 			var err error
@@ -0,0 +1,98 @@
+// Code generated by protoc-gen-kendynet. DO NOT EDIT.
+// source: echo.proto
+
+package echo
+
+import (
+	fmt "fmt"
+	testproto "github.com/sniperHW/kendynet/example/testproto"
+	rpc "github.com/sniperHW/kendynet/rpc"
+	time "time"
+)
+
+type EchoClient struct {
+	client  *rpc.RPCClient
+	channel rpc.RPCChannel
+}
+
+func NewEchoClient(client *rpc.RPCClient, channel rpc.RPCChannel) *EchoClient {
+	return &EchoClient{client: client, channel: channel}
+}
+
+func (this *EchoClient) SayHello(arg *testproto.Hello, timeout time.Duration) (*testproto.World, error) {
+	ret, err := this.client.Call(this.channel, "Echo.SayHello", arg, timeout)
+	if nil != err {
+		return nil, err
+	}
+	return echoSayHelloRet(ret)
+}
+
+func (this *EchoClient) AsynSayHello(arg *testproto.Hello, timeout time.Duration, cb func(*testproto.World, error)) error {
+	return this.client.AsynCall(this.channel, "Echo.SayHello", arg, timeout, func(ret interface{}, err error) {
+		if nil != err {
+			cb(nil, err)
+		} else {
+			cb(echoSayHelloRet(ret))
+		}
+	})
+}
+
+func (this *EchoClient) PostSayHello(arg *testproto.Hello) error {
+	return this.client.Post(this.channel, "Echo.SayHello", arg)
+}
+
+func echoSayHelloRet(ret interface{}) (*testproto.World, error) {
+	if nil == ret {
+		return nil, nil
+	} else if r, ok := ret.(*testproto.World); ok {
+		return r, nil
+	} else {
+		return nil, fmt.Errorf("method Echo.SayHello: invaild response type:%T,want:*World", ret)
+	}
+}
+
+type EchoSayHelloReplyer struct {
+	*rpc.RPCReplyer
+}
+
+func (this *EchoSayHelloReplyer) Reply(ret *testproto.World, err error) {
+	if nil == ret {
+		this.RPCReplyer.Reply(nil, err)
+	} else {
+		this.RPCReplyer.Reply(ret, err)
+	}
+}
+
+type EchoServer interface {
+	SayHello(*EchoSayHelloReplyer, *testproto.Hello)
+}
+
+func RegisterEchoServer(server *rpc.RPCServer, impl EchoServer) error {
+	methods := []struct {
+		name    string
+		handler rpc.RPCMethodHandler
+	}{
+		{
+			name: "Echo.SayHello",
+			handler: func(replyer *rpc.RPCReplyer, arg interface{}) {
+				if nil == arg {
+					impl.SayHello(&EchoSayHelloReplyer{replyer}, &testproto.Hello{})
+				} else if a, ok := arg.(*testproto.Hello); ok {
+					impl.SayHello(&EchoSayHelloReplyer{replyer}, a)
+				} else {
+					replyer.Reply(nil, rpc.Errorf(rpc.CodeInvaildArg, "method Echo.SayHello: invaild arg type:%T,want:*Hello", arg))
+				}
+			},
+		},
+	}
+
+	for i, v := range methods {
+		if err := server.RegisterMethod(v.name, v.handler); nil != err {
+			for _, vv := range methods[:i] {
+				server.UnRegisterMethod(vv.name)
+			}
+			return err
+		}
+	}
+	return nil
+}
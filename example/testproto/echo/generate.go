@@ -0,0 +1,3 @@
+package echo
+
+//go:generate protoc -I. -I.. --kendynet_out=paths=source_relative:. echo.proto
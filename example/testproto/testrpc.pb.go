@@ -57,6 +57,8 @@ type RPCResponse struct {
 	Seq              *uint64 `protobuf:"varint,1,req,name=seq" json:"seq,omitempty"`
 	Err              *string `protobuf:"bytes,2,opt,name=err" json:"err,omitempty"`
 	Ret              []byte  `protobuf:"bytes,3,opt,name=ret" json:"ret,omitempty"`
+	Code             *int32  `protobuf:"varint,4,opt,name=code" json:"code,omitempty"`
+	Details          []byte  `protobuf:"bytes,5,opt,name=details" json:"details,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -86,6 +88,20 @@ func (m *RPCResponse) GetRet() []byte {
 	return nil
 }
 
+func (m *RPCResponse) GetCode() int32 {
+	if m != nil && m.Code != nil {
+		return *m.Code
+	}
+	return 0
+}
+
+func (m *RPCResponse) GetDetails() []byte {
+	if m != nil {
+		return m.Details
+	}
+	return nil
+}
+
 type RPCPing struct {
 	Seq              *uint64 `protobuf:"varint,1,req,name=seq" json:"seq,omitempty"`
 	Timestamp        *int64  `protobuf:"varint,2,req,name=timestamp" json:"timestamp,omitempty"`
@@ -182,19 +198,20 @@ func init() {
 func init() { proto.RegisterFile("testrpc.proto", fileDescriptor1) }
 
 var fileDescriptor1 = []byte{
-	// 220 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x8e, 0xc1, 0x4a, 0xc3, 0x40,
-	0x10, 0x86, 0x49, 0x52, 0xb5, 0x3b, 0x2a, 0x94, 0x45, 0x64, 0x11, 0x85, 0x25, 0xa7, 0x3d, 0x79,
-	0xf7, 0x9c, 0x17, 0x08, 0xf3, 0x06, 0xc5, 0x0c, 0x6d, 0x21, 0xc9, 0x6e, 0x67, 0x47, 0x7c, 0x7d,
-	0x99, 0xb5, 0xd1, 0x4b, 0x4e, 0xbd, 0x7d, 0xdf, 0xfc, 0xf9, 0xf3, 0x2f, 0x3c, 0x0a, 0x65, 0xe1,
-	0xf4, 0xf9, 0x9e, 0x38, 0x4a, 0xb4, 0x46, 0xb5, 0x60, 0x3b, 0x00, 0x60, 0xdf, 0x21, 0x9d, 0xbf,
-	0x28, 0x8b, 0xdd, 0x41, 0x93, 0xe9, 0xec, 0x2a, 0x5f, 0x87, 0x0d, 0x2a, 0xda, 0x67, 0xb8, 0x9d,
-	0x48, 0x8e, 0x71, 0x70, 0xb5, 0xaf, 0x83, 0xc1, 0x8b, 0xe9, 0x97, 0x7b, 0x3e, 0xb8, 0xc6, 0x57,
-	0xe1, 0x01, 0x15, 0xed, 0x0b, 0x6c, 0x67, 0xa2, 0x01, 0x29, 0x27, 0xb7, 0xf1, 0x55, 0xd8, 0xe2,
-	0x9f, 0xb7, 0x1d, 0xdc, 0x97, 0x95, 0x9c, 0xe2, 0x9c, 0x69, 0x65, 0x66, 0x07, 0x0d, 0x31, 0xbb,
-	0xda, 0x57, 0xc1, 0xa0, 0xa2, 0x5e, 0x98, 0x64, 0x19, 0x60, 0x92, 0xf6, 0x03, 0xee, 0xb0, 0xef,
-	0xfa, 0xd3, 0x7c, 0x58, 0xf9, 0xc1, 0x2b, 0x18, 0x39, 0x4d, 0x94, 0x65, 0x3f, 0xa5, 0xf2, 0xd4,
-	0x06, 0xff, 0x0f, 0x4b, 0x35, 0x5e, 0x51, 0x7d, 0x83, 0x9b, 0x23, 0x8d, 0x63, 0xb4, 0x4f, 0x17,
-	0x28, 0x55, 0x83, 0xbf, 0xa2, 0xf1, 0x77, 0xe4, 0x71, 0xd0, 0xb8, 0xc0, 0x12, 0x17, 0xf9, 0x09,
-	0x00, 0x00, 0xff, 0xff, 0xa2, 0xf5, 0x3b, 0x12, 0x79, 0x01, 0x00, 0x00,
+	// 238 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x8f, 0x4d, 0x6a, 0xc3, 0x30,
+	0x10, 0x85, 0xf1, 0x5f, 0x13, 0x4d, 0x5b, 0x08, 0x22, 0x14, 0x51, 0x5a, 0x10, 0x5e, 0x69, 0xd5,
+	0x7d, 0xd7, 0xb9, 0x80, 0x99, 0x1b, 0x98, 0x68, 0x48, 0x0c, 0xb6, 0x25, 0x4b, 0x53, 0x7a, 0xfd,
+	0x22, 0xd5, 0x6e, 0x37, 0x59, 0x65, 0xf7, 0x7d, 0x33, 0xf3, 0xf4, 0x10, 0x3c, 0x33, 0x45, 0x0e,
+	0xfe, 0xfc, 0xe1, 0x83, 0x63, 0x27, 0x45, 0xd2, 0x8c, 0xad, 0x05, 0xc0, 0xee, 0x84, 0xb4, 0x7c,
+	0x51, 0x64, 0x79, 0x80, 0x2a, 0xd2, 0xa2, 0x0a, 0x5d, 0x9a, 0x1a, 0x13, 0xca, 0x17, 0x78, 0x98,
+	0x88, 0xaf, 0xce, 0xaa, 0x52, 0x97, 0x46, 0xe0, 0x6a, 0xe9, 0xb2, 0x0f, 0x17, 0x55, 0xe9, 0xc2,
+	0x3c, 0x61, 0x42, 0xf9, 0x0a, 0xfb, 0x99, 0xc8, 0x22, 0x45, 0xaf, 0x6a, 0x5d, 0x98, 0x3d, 0xfe,
+	0x79, 0xbb, 0xc0, 0x63, 0x6e, 0x89, 0xde, 0xcd, 0x91, 0x6e, 0xd4, 0x1c, 0xa0, 0xa2, 0x10, 0x54,
+	0xa9, 0x0b, 0x23, 0x30, 0x61, 0x9a, 0x04, 0xe2, 0xad, 0x20, 0x10, 0x4b, 0x09, 0xf5, 0xd9, 0x59,
+	0xca, 0x8f, 0x37, 0x98, 0x59, 0x2a, 0xd8, 0x59, 0xe2, 0x7e, 0x18, 0xa3, 0x6a, 0xf2, 0xe5, 0xa6,
+	0xed, 0x27, 0xec, 0xb0, 0x3b, 0x75, 0xc3, 0x7c, 0xb9, 0x51, 0xf7, 0x06, 0x82, 0x87, 0x89, 0x22,
+	0xf7, 0x93, 0xcf, 0x1f, 0xab, 0xf0, 0x7f, 0xb0, 0x45, 0xdd, 0x1d, 0xd1, 0x77, 0x68, 0xae, 0x34,
+	0x8e, 0x4e, 0x1e, 0x57, 0xc8, 0x51, 0x81, 0xbf, 0x92, 0xd6, 0xdf, 0x2e, 0x8c, 0x56, 0x1e, 0x57,
+	0xd8, 0xd6, 0x59, 0x7e, 0x06, 0x00, 0x40, 0xc8, 0x81, 0xd6, 0xa7, 0x01, 0x00, 0x00,
 }
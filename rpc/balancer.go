@@ -0,0 +1,369 @@
+package rpc
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ *  客户端负载均衡，在一组RPCChannel之间选择通道发起调用
+ *
+ *  通道的健康状态由调用结果维护：连续maxFailures次调用以超时/通道关闭/过载失败，
+ *  该通道在cooldown时间内不会被选中，冷却结束后重新参与选择，成功一次即恢复。
+ *  如果所有通道都不健康，则忽略健康状态在全部通道中选择。
+ */
+
+type BalancePolicy int
+
+const (
+	RoundRobin     BalancePolicy = 0 //轮询
+	LeastPending   BalancePolicy = 1 //选择未返回调用最少的通道
+	RandomWeighted BalancePolicy = 2 //按权重随机
+	ConsistentHash BalancePolicy = 3 //按key一致性hash,使用XXXWithKey接口调用
+)
+
+const (
+	defaultMaxFailures = 3
+	defaultCooldown    = 5 * time.Second
+	virtualNodes       = 40 //一致性hash中每单位权重的虚拟节点数量
+)
+
+var ErrNoAvailableChannel error = NewStatus(CodeUnavailable, "no available rpc channel")
+
+type balancerNode struct {
+	channel        RPCChannel
+	weight         int
+	pending        int32
+	failures       int32
+	unhealthyUntil int64 //unix nano
+}
+
+func (this *balancerNode) healthy(now int64) bool {
+	return atomic.LoadInt64(&this.unhealthyUntil) <= now
+}
+
+type hashNode struct {
+	hash uint32
+	node *balancerNode
+}
+
+type Balancer struct {
+	sync.RWMutex
+	client      *RPCClient
+	policy      BalancePolicy
+	nodes       []*balancerNode
+	ring        []hashNode
+	next        uint64
+	maxFailures int32
+	cooldown    time.Duration
+}
+
+func NewBalancer(client *RPCClient, policy BalancePolicy) *Balancer {
+	if nil == client {
+		panic("client == nil")
+	}
+
+	if policy < RoundRobin || policy > ConsistentHash {
+		panic(fmt.Sprintf("invaild balance policy:%d", policy))
+	}
+
+	return &Balancer{
+		client:      client,
+		policy:      policy,
+		maxFailures: defaultMaxFailures,
+		cooldown:    defaultCooldown,
+	}
+}
+
+/*
+ *  设置健康检查参数，连续maxFailures次失败后通道在cooldown时间内不被选中
+ */
+func (this *Balancer) SetHealthCheck(maxFailures int, cooldown time.Duration) {
+	this.Lock()
+	defer this.Unlock()
+	if maxFailures > 0 {
+		this.maxFailures = int32(maxFailures)
+	}
+	if cooldown > 0 {
+		this.cooldown = cooldown
+	}
+}
+
+/*
+ *  添加通道,weight默认为1,只对RandomWeighted及ConsistentHash有效
+ */
+func (this *Balancer) Add(channel RPCChannel, weight ...int) {
+	w := 1
+	if len(weight) > 0 && weight[0] > 0 {
+		w = weight[0]
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	for _, v := range this.nodes {
+		if v.channel == channel {
+			v.weight = w
+			this.buildRing()
+			return
+		}
+	}
+
+	this.nodes = append(this.nodes, &balancerNode{channel: channel, weight: w})
+	this.buildRing()
+}
+
+func (this *Balancer) Remove(channel RPCChannel) {
+	this.Lock()
+	defer this.Unlock()
+
+	for i, v := range this.nodes {
+		if v.channel == channel {
+			this.nodes = append(this.nodes[:i], this.nodes[i+1:]...)
+			this.buildRing()
+			return
+		}
+	}
+}
+
+func (this *Balancer) Channels() []RPCChannel {
+	this.RLock()
+	defer this.RUnlock()
+	channels := make([]RPCChannel, 0, len(this.nodes))
+	for _, v := range this.nodes {
+		channels = append(channels, v.channel)
+	}
+	return channels
+}
+
+/*
+ *  通道当前是否健康，不在Balancer中的通道返回false
+ */
+func (this *Balancer) IsHealthy(channel RPCChannel) bool {
+	this.RLock()
+	defer this.RUnlock()
+	now := this.client.getClock().Now().UnixNano()
+	for _, v := range this.nodes {
+		if v.channel == channel {
+			return v.healthy(now)
+		}
+	}
+	return false
+}
+
+func (this *Balancer) buildRing() {
+	if this.policy != ConsistentHash {
+		return
+	}
+
+	this.ring = this.ring[:0]
+	for _, v := range this.nodes {
+		for i := 0; i < v.weight*virtualNodes; i++ {
+			this.ring = append(this.ring, hashNode{
+				hash: crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", v.channel.Name(), i))),
+				node: v,
+			})
+		}
+	}
+
+	sort.Slice(this.ring, func(i, j int) bool {
+		return this.ring[i].hash < this.ring[j].hash
+	})
+}
+
+func (this *Balancer) candidates(now int64) []*balancerNode {
+	healthy := make([]*balancerNode, 0, len(this.nodes))
+	for _, v := range this.nodes {
+		if v.healthy(now) {
+			healthy = append(healthy, v)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return this.nodes
+	} else {
+		return healthy
+	}
+}
+
+func (this *Balancer) pickByHash(key string, now int64) *balancerNode {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(this.ring), func(i int) bool {
+		return this.ring[i].hash >= h
+	})
+
+	//从hash位置顺时针查找第一个健康的节点
+	for j := 0; j < len(this.ring); j++ {
+		n := this.ring[(i+j)%len(this.ring)].node
+		if n.healthy(now) {
+			return n
+		}
+	}
+
+	return this.ring[i%len(this.ring)].node
+}
+
+func (this *Balancer) pick(key string) *balancerNode {
+	this.RLock()
+	defer this.RUnlock()
+
+	if len(this.nodes) == 0 {
+		return nil
+	}
+
+	now := this.client.getClock().Now().UnixNano()
+
+	switch this.policy {
+	case ConsistentHash:
+		return this.pickByHash(key, now)
+	case LeastPending:
+		var n *balancerNode
+		for _, v := range this.candidates(now) {
+			if nil == n || atomic.LoadInt32(&v.pending) < atomic.LoadInt32(&n.pending) {
+				n = v
+			}
+		}
+		return n
+	case RandomWeighted:
+		nodes := this.candidates(now)
+		total := 0
+		for _, v := range nodes {
+			total += v.weight
+		}
+		r := rand.Intn(total)
+		for _, v := range nodes {
+			if r < v.weight {
+				return v
+			}
+			r -= v.weight
+		}
+		return nodes[len(nodes)-1]
+	default:
+		nodes := this.candidates(now)
+		return nodes[atomic.AddUint64(&this.next, 1)%uint64(len(nodes))]
+	}
+}
+
+/*
+ *  按策略选择一个通道,key只对ConsistentHash有效
+ */
+func (this *Balancer) Pick(key ...string) (RPCChannel, error) {
+	k := ""
+	if len(key) > 0 {
+		k = key[0]
+	}
+
+	if n := this.pick(k); nil == n {
+		return nil, ErrNoAvailableChannel
+	} else {
+		return n.channel, nil
+	}
+}
+
+func isChannelFailure(err error) bool {
+	switch CodeOf(err) {
+	case CodeTimeout, CodeChannelClosed, CodeOverloaded, CodeUnavailable, CodeCircuitOpen, CodeShuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+func (this *Balancer) onResult(n *balancerNode, err error) {
+	if isChannelFailure(err) {
+		this.RLock()
+		maxFailures := this.maxFailures
+		cooldown := this.cooldown
+		this.RUnlock()
+		if atomic.AddInt32(&n.failures, 1) >= maxFailures {
+			atomic.StoreInt64(&n.unhealthyUntil, this.client.getClock().Now().Add(cooldown).UnixNano())
+		}
+	} else {
+		atomic.StoreInt32(&n.failures, 0)
+		atomic.StoreInt64(&n.unhealthyUntil, 0)
+	}
+}
+
+/*
+ *  如果为method设置了重试策略,每次尝试都会重新选择通道
+ */
+func (this *Balancer) AsynCallWithKey(key string, method string, arg interface{}, timeout time.Duration, cb RPCResponseHandler) error {
+	if cb == nil {
+		panic("cb == nil")
+	}
+
+	attempt := func(cb RPCResponseHandler) error {
+		n := this.pick(key)
+		if nil == n {
+			return ErrNoAvailableChannel
+		}
+
+		atomic.AddInt32(&n.pending, 1)
+
+		err := this.client.asynCall(n.channel, "", method, arg, timeout, func(ret interface{}, err error) {
+			atomic.AddInt32(&n.pending, -1)
+			this.onResult(n, err)
+			cb(ret, err)
+		})
+
+		if nil != err {
+			atomic.AddInt32(&n.pending, -1)
+			if IsCode(err, CodeCircuitOpen) {
+				this.onResult(n, err)
+			} else {
+				this.onResult(n, NewStatus(CodeUnavailable, err.Error()))
+			}
+		}
+
+		return err
+	}
+
+	if policy := this.client.getRetryPolicy(method); nil != policy && policy.MaxAttempts > 1 {
+		return newRetryCall(policy, attempt, cb, this.client).start()
+	} else {
+		return attempt(cb)
+	}
+}
+
+func (this *Balancer) AsynCall(method string, arg interface{}, timeout time.Duration, cb RPCResponseHandler) error {
+	return this.AsynCallWithKey("", method, arg, timeout, cb)
+}
+
+//同步调用
+func (this *Balancer) CallWithKey(key string, method string, arg interface{}, timeout time.Duration) (ret interface{}, err error) {
+	respChan := make(chan struct{})
+	f := func(ret_ interface{}, err_ error) {
+		ret = ret_
+		err = err_
+		close(respChan)
+	}
+
+	if err_ := this.AsynCallWithKey(key, method, arg, timeout, f); nil != err_ {
+		return nil, err_
+	}
+
+	<-respChan
+
+	return
+}
+
+func (this *Balancer) Call(method string, arg interface{}, timeout time.Duration) (interface{}, error) {
+	return this.CallWithKey("", method, arg, timeout)
+}
+
+func (this *Balancer) PostWithKey(key string, method string, arg interface{}) error {
+	n := this.pick(key)
+	if nil == n {
+		return ErrNoAvailableChannel
+	}
+	return this.client.Post(n.channel, method, arg)
+}
+
+func (this *Balancer) Post(method string, arg interface{}) error {
+	return this.PostWithKey("", method, arg)
+}
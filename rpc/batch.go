@@ -0,0 +1,256 @@
+package rpc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ *  批量调用
+ *
+ *  Batch收集对同一个通道的多个调用,Flush时编码成一个RPCBatchRequest发送,
+ *  每个调用单独响应、单独超时。批量中的调用不使用重试策略。
+ *
+ *  服务端按SetBatchMode的设置处理批量请求:
+ *      BatchConcurrent  依次分发所有请求,不等待前一个请求完成(默认)
+ *      BatchInOrder     前一个请求完成(Reply/DropResponse)后才分发下一个请求
+ *  处理函数的执行方式与普通请求相同(见SetEventQueue/SetRoutinePool)。
+ *
+ *  编码器需要支持RPCBatchRequest,内置的StreamChannel及JSONRPCCodec均已支持。
+ *  JSONRPCCodec将批量请求编码为json数组,接收端的JSONRPCChannel按JSON-RPC 2.0逐个分发,
+ *  不受SetBatchMode影响。
+ */
+
+type BatchMode int
+
+const (
+	BatchConcurrent BatchMode = 0
+	BatchInOrder    BatchMode = 1
+)
+
+func (this *RPCServer) SetBatchMode(mode BatchMode) {
+	atomic.StoreInt32(&this.batchMode, int32(mode))
+}
+
+func (this *RPCServer) onBatchRequest(channel RPCChannel, batch *RPCBatchRequest) {
+	if BatchMode(atomic.LoadInt32(&this.batchMode)) == BatchInOrder {
+		(&batchRunner{server: this, channel: channel, requests: batch.Requests}).run()
+	} else {
+		for _, v := range batch.Requests {
+			this.onRequest(channel, v, nil)
+		}
+	}
+}
+
+const (
+	batchRunning   = int32(0) //正在分发当前请求
+	batchWaiting   = int32(1) //当前请求尚未完成,等待done
+	batchCompleted = int32(2) //当前请求在分发过程中已经完成
+)
+
+/*
+ *  按顺序处理批量请求
+ *  请求在分发过程中同步完成时由run继续循环,否则由完成请求的done调用run,避免递归过深
+ */
+type batchRunner struct {
+	server   *RPCServer
+	channel  RPCChannel
+	requests []*RPCRequest
+	next     int
+	state    int32
+}
+
+func (this *batchRunner) run() {
+	for this.next < len(this.requests) {
+		req := this.requests[this.next]
+		this.next++
+		atomic.StoreInt32(&this.state, batchRunning)
+		this.server.onRequest(this.channel, req, this.done)
+		if atomic.CompareAndSwapInt32(&this.state, batchRunning, batchWaiting) {
+			return
+		}
+	}
+}
+
+func (this *batchRunner) done() {
+	if !atomic.CompareAndSwapInt32(&this.state, batchRunning, batchCompleted) {
+		this.run()
+	}
+}
+
+type batchCall struct {
+	req     *RPCRequest
+	timeout time.Duration
+	cb      RPCResponseHandler
+}
+
+type Batch struct {
+	client  *RPCClient
+	channel RPCChannel
+	calls   []*batchCall
+}
+
+func (this *RPCClient) NewBatch(channel RPCChannel) *Batch {
+	return &Batch{
+		client:  this,
+		channel: channel,
+	}
+}
+
+func (this *Batch) Call(method string, arg interface{}, timeout time.Duration, cb RPCResponseHandler) {
+	if cb == nil {
+		panic("cb == nil")
+	}
+
+	this.calls = append(this.calls, &batchCall{
+		req:     &RPCRequest{Method: method, Arg: arg, NeedResp: true},
+		timeout: timeout,
+		cb:      cb,
+	})
+}
+
+func (this *Batch) Post(method string, arg interface{}) {
+	this.calls = append(this.calls, &batchCall{
+		req: &RPCRequest{Method: method, Arg: arg},
+	})
+}
+
+func (this *Batch) Len() int {
+	return len(this.calls)
+}
+
+/*
+ *  发送收集的调用并清空Batch
+ *  返回错误时尚未被回调的调用不会再被回调
+ */
+func (this *Batch) Flush() error {
+	calls := this.calls
+	this.calls = nil
+	if len(calls) == 0 {
+		return nil
+	}
+	return this.client.sendBatch(this.channel, calls)
+}
+
+func (this *RPCClient) sendBatch(channel RPCChannel, calls []*batchCall) error {
+	if this.IsClosed() {
+		return ErrClientClosed
+	}
+
+	batch := &RPCBatchRequest{}
+	contexts := []*reqContext{}
+	timeouts := []time.Duration{}
+
+	for _, v := range calls {
+		v.req.Seq = atomic.AddUint64(&this.sequence, 1)
+		batch.Requests = append(batch.Requests, v.req)
+		if v.req.NeedResp {
+			contexts = append(contexts, &reqContext{
+				onResponse:   v.cb,
+				seq:          v.req.Seq,
+				cbEventQueue: this.cbEventQueue,
+				c:            this,
+				channel:      channel,
+			})
+			timeouts = append(timeouts, v.timeout)
+		}
+	}
+
+	request, err := this.encoder.Encode(batch)
+	if nil != err {
+		return err
+	}
+
+	var result *batchResult
+	breaker := this.GetCircuitBreaker(channel)
+	if nil != breaker {
+		if len(contexts) == 0 {
+			if breaker.State() == BreakerOpen {
+				return ErrCircuitOpen
+			}
+			breaker = nil
+		} else if !breaker.Allow() {
+			return ErrCircuitOpen
+		} else {
+			result = &batchResult{breaker: breaker, remain: int32(len(contexts))}
+			for _, v := range contexts {
+				cb := v.onResponse
+				v.onResponse = func(ret interface{}, err error) {
+					result.onResult(err)
+					cb(ret, err)
+				}
+			}
+		}
+	}
+
+	mgr := this.getTimerMgr()
+
+	//撤销已经登记的调用,被撤销的调用以err计入熔断结果
+	cancel := func(contexts []*reqContext, err error) {
+		for _, v := range contexts {
+			this.removeCall(v)
+			if ok, _ := mgr.CancelByIndex(v.seq); ok {
+				if nil != result {
+					result.onResult(err)
+				}
+			} else {
+				//回调已经由超时或OnChannelClose触发
+				atomic.AddInt32(&this.pendingCount, 1)
+			}
+		}
+	}
+
+	for i, v := range contexts {
+		if !this.addCall(v) {
+			cancel(contexts[:i], nil)
+			if nil != result {
+				//未登记的调用
+				for range contexts[i:] {
+					result.onResult(nil)
+				}
+			}
+			return ErrClientClosed
+		}
+		mgr.OnceWithIndex(timeouts[i], v.onTimeout, v, v.seq)
+	}
+
+	//Close可能发生在addCall与设置定时器之间
+	if this.IsClosed() {
+		cancel(contexts, nil)
+		return ErrClientClosed
+	}
+
+	if err = channel.SendRequest(request); nil == err {
+		atomic.AddInt32(&this.pendingCount, int32(len(contexts)))
+		return nil
+	} else {
+		cancel(contexts, NewStatus(CodeUnavailable, err.Error()))
+		return err
+	}
+}
+
+/*
+ *  整个批量作为一次调用报告给熔断器(Allow只调用一次)
+ *  所有调用完成后报告一次结果,任意调用以通道错误失败则报告失败
+ */
+type batchResult struct {
+	sync.Mutex
+	breaker *CircuitBreaker
+	remain  int32
+	err     error
+}
+
+func (this *batchResult) onResult(err error) {
+	this.Lock()
+	if nil == this.err && isChannelFailure(err) {
+		this.err = err
+	}
+	this.remain--
+	done := this.remain == 0
+	err = this.err
+	this.Unlock()
+	if done {
+		this.breaker.OnResult(err)
+	}
+}
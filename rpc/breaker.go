@@ -0,0 +1,118 @@
+package rpc
+
+import (
+	"github.com/sniperHW/kendynet/clock"
+	"sync"
+	"time"
+)
+
+/*
+ *  通道熔断器
+ *
+ *  连续failureThreshold次调用以超时/通道关闭/过载等通道错误失败后熔断器打开，
+ *  打开期间的调用立即以ErrCircuitOpen失败，不会发往对端。
+ *  openTimeout之后进入半开状态，放行一个探测调用，探测成功则关闭，失败则重新打开。
+ */
+
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = 0
+	BreakerOpen     BreakerState = 1
+	BreakerHalfOpen BreakerState = 2
+)
+
+func (this BreakerState) String() string {
+	switch this {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+var ErrCircuitOpen error = NewStatus(CodeCircuitOpen, "rpc circuit breaker open")
+
+type CircuitBreaker struct {
+	sync.Mutex
+	failureThreshold int
+	openTimeout      time.Duration
+	state            BreakerState
+	failures         int
+	openedAt         time.Time
+	probing          bool
+	clock            clock.Clock
+}
+
+/*
+ *  c:  计算openTimeout使用的时钟,默认为clock.Real
+ */
+func NewCircuitBreaker(failureThreshold int, openTimeout time.Duration, c ...clock.Clock) *CircuitBreaker {
+	if failureThreshold <= 0 {
+		panic("failureThreshold <= 0")
+	}
+
+	b := &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		clock:            clock.Real,
+	}
+	if len(c) > 0 {
+		b.clock = clock.Get(c[0])
+	}
+	return b
+}
+
+func (this *CircuitBreaker) State() BreakerState {
+	this.Lock()
+	defer this.Unlock()
+	if this.state == BreakerOpen && this.clock.Since(this.openedAt) >= this.openTimeout {
+		return BreakerHalfOpen
+	}
+	return this.state
+}
+
+/*
+ *  调用前检查是否放行,放行的调用必须通过OnResult报告结果
+ */
+func (this *CircuitBreaker) Allow() bool {
+	this.Lock()
+	defer this.Unlock()
+	switch this.state {
+	case BreakerOpen:
+		if this.clock.Since(this.openedAt) < this.openTimeout {
+			return false
+		}
+		this.state = BreakerHalfOpen
+		this.probing = true
+		return true
+	case BreakerHalfOpen:
+		if this.probing {
+			return false
+		}
+		this.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (this *CircuitBreaker) OnResult(err error) {
+	this.Lock()
+	defer this.Unlock()
+	if isChannelFailure(err) {
+		this.failures++
+		if this.state == BreakerHalfOpen || this.failures >= this.failureThreshold {
+			this.state = BreakerOpen
+			this.openedAt = this.clock.Now()
+		}
+	} else {
+		this.failures = 0
+		this.state = BreakerClosed
+	}
+	this.probing = false
+}
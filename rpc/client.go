@@ -3,6 +3,7 @@ package rpc
 import (
 	"fmt"
 	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/clock"
 	"github.com/sniperHW/kendynet/event"
 	"github.com/sniperHW/kendynet/timer"
 	"github.com/sniperHW/kendynet/util"
@@ -11,10 +12,10 @@ import (
 	"time"
 )
 
-var ErrCallTimeout error = fmt.Errorf("rpc call timeout")
-var sequence uint64
-var client_once sync.Once
-var timerMgrs []*timer.TimerMgr
+var ErrCallTimeout error = NewStatus(CodeTimeout, "rpc call timeout")
+var ErrClientClosed error = NewStatus(CodeCancelled, "rpc client closed")
+
+const clientTimerSlots = 61
 
 type RPCResponseHandler func(interface{}, error)
 
@@ -23,6 +24,7 @@ type reqContext struct {
 	onResponse   RPCResponseHandler
 	cbEventQueue *event.EventQueue
 	c            *RPCClient
+	channel      RPCChannel
 }
 
 func (this *reqContext) callResponseCB(ret interface{}, err error) {
@@ -42,14 +44,239 @@ func (this *reqContext) callResponseCB_(ret interface{}, err error) {
 
 func (this *reqContext) onTimeout(_ *timer.Timer, _ interface{}) {
 	kendynet.GetLogger().Infoln("req timeout", this.seq)
+	this.c.removeCall(this)
 	this.callResponseCB(nil, ErrCallTimeout)
 }
 
 type RPCClient struct {
+	sync.Mutex
 	encoder      RPCMessageEncoder
 	decoder      RPCMessageDecoder
 	cbEventQueue *event.EventQueue
 	pendingCount int32
+	channelCalls map[RPCChannel]map[uint64]*reqContext //每个通道上尚未返回的调用
+	retry        map[string]*RetryPolicy
+	retryDefault *RetryPolicy
+	breakers     map[RPCChannel]*CircuitBreaker
+	breakerCfg   *CircuitBreaker //熔断参数,nil表示不启用熔断
+	sequence     uint64
+	timerMgr     *timer.TimerMgr //调用超时定时器,以seq为索引
+	ownTimerMgr  bool            //timerMgr由客户端创建,Close时停止
+	retries      map[*retryCall]struct{}
+	closed       bool
+}
+
+/*
+ *  替换调用超时使用的定时器管理器(例如时间轮),必须在发起调用之前设置。默认每个RPCClient创建自己的TimerMgr
+ *  定时器以调用序号为索引,mgr不能与其它RPCClient共用,由调用方负责停止
+ *  调用超时、重试间隔及熔断器都使用mgr的时钟
+ */
+func (this *RPCClient) SetTimerMgr(mgr *timer.TimerMgr) {
+	if nil == mgr {
+		panic("mgr == nil")
+	}
+	this.setTimerMgr(mgr, false)
+}
+
+func (this *RPCClient) setTimerMgr(mgr *timer.TimerMgr, own bool) {
+	this.Lock()
+	old, oldOwn := this.timerMgr, this.ownTimerMgr
+	this.timerMgr, this.ownTimerMgr = mgr, own
+	this.Unlock()
+	if oldOwn {
+		old.Stop()
+	}
+}
+
+func (this *RPCClient) getTimerMgr() *timer.TimerMgr {
+	this.Lock()
+	defer this.Unlock()
+	return this.timerMgr
+}
+
+/*
+ *  使用时钟c计时,必须在发起调用之前设置。测试中可以使用clock.Fake确定地触发调用超时
+ *  客户端创建自己的TimerMgr,Close时停止
+ */
+func (this *RPCClient) SetClock(c clock.Clock) {
+	this.setTimerMgr(timer.NewTimerMgr(clientTimerSlots, c), true)
+}
+
+func (this *RPCClient) getClock() clock.Clock {
+	return this.getTimerMgr().Clock()
+}
+
+/*
+ *  关闭客户端,所有尚未返回的调用(包括等待重试的调用)立即以ErrClientClosed失败,
+ *  之后的调用直接返回ErrClientClosed。客户端自己创建的TimerMgr被停止
+ */
+func (this *RPCClient) Close() {
+	this.Lock()
+	if this.closed {
+		this.Unlock()
+		return
+	}
+	this.closed = true
+	channelCalls := this.channelCalls
+	this.channelCalls = map[RPCChannel]map[uint64]*reqContext{}
+	this.breakers = map[RPCChannel]*CircuitBreaker{}
+	retries := this.retries
+	this.retries = map[*retryCall]struct{}{}
+	mgr := this.timerMgr
+	ownTimerMgr := this.ownTimerMgr
+	this.Unlock()
+
+	//先结束重试,尚未返回的尝试失败后不会再重试
+	for r := range retries {
+		r.close(ErrClientClosed)
+	}
+
+	for _, calls := range channelCalls {
+		for seq, context := range calls {
+			if ok, _ := mgr.CancelByIndex(seq); ok {
+				context.callResponseCB(nil, ErrClientClosed)
+			}
+		}
+	}
+
+	if ownTimerMgr {
+		mgr.Stop()
+	}
+}
+
+//客户端已经关闭返回false
+func (this *RPCClient) addRetry(r *retryCall) bool {
+	this.Lock()
+	defer this.Unlock()
+	if this.closed {
+		return false
+	}
+	this.retries[r] = struct{}{}
+	return true
+}
+
+func (this *RPCClient) removeRetry(r *retryCall) {
+	this.Lock()
+	defer this.Unlock()
+	delete(this.retries, r)
+}
+
+func (this *RPCClient) IsClosed() bool {
+	this.Lock()
+	defer this.Unlock()
+	return this.closed
+}
+
+/*
+ *  设置方法的重试策略,policy为nil时取消
+ */
+func (this *RPCClient) SetRetryPolicy(method string, policy *RetryPolicy) {
+	this.Lock()
+	defer this.Unlock()
+	if nil == policy {
+		delete(this.retry, method)
+	} else {
+		this.retry[method] = policy
+	}
+}
+
+/*
+ *  设置没有单独设置重试策略的方法使用的重试策略
+ */
+func (this *RPCClient) SetDefaultRetryPolicy(policy *RetryPolicy) {
+	this.Lock()
+	defer this.Unlock()
+	this.retryDefault = policy
+}
+
+func (this *RPCClient) getRetryPolicy(method string) *RetryPolicy {
+	this.Lock()
+	defer this.Unlock()
+	if policy, ok := this.retry[method]; ok {
+		return policy
+	} else {
+		return this.retryDefault
+	}
+}
+
+/*
+ *  为每个通道启用熔断器,参数见NewCircuitBreaker,failureThreshold<=0关闭熔断
+ */
+func (this *RPCClient) SetCircuitBreaker(failureThreshold int, openTimeout time.Duration) {
+	this.Lock()
+	defer this.Unlock()
+	this.breakers = map[RPCChannel]*CircuitBreaker{}
+	if failureThreshold > 0 {
+		this.breakerCfg = NewCircuitBreaker(failureThreshold, openTimeout)
+	} else {
+		this.breakerCfg = nil
+	}
+}
+
+/*
+ *  返回通道的熔断器,没有启用熔断返回nil
+ */
+func (this *RPCClient) GetCircuitBreaker(channel RPCChannel) *CircuitBreaker {
+	this.Lock()
+	defer this.Unlock()
+	if nil == this.breakerCfg {
+		return nil
+	}
+	breaker, ok := this.breakers[channel]
+	if !ok {
+		breaker = NewCircuitBreaker(this.breakerCfg.failureThreshold, this.breakerCfg.openTimeout, this.timerMgr.Clock())
+		this.breakers[channel] = breaker
+	}
+	return breaker
+}
+
+//客户端已经关闭返回false
+func (this *RPCClient) addCall(context *reqContext) bool {
+	this.Lock()
+	defer this.Unlock()
+	if this.closed {
+		return false
+	}
+	calls, ok := this.channelCalls[context.channel]
+	if !ok {
+		calls = map[uint64]*reqContext{}
+		this.channelCalls[context.channel] = calls
+	}
+	calls[context.seq] = context
+	return true
+}
+
+func (this *RPCClient) removeCall(context *reqContext) {
+	this.Lock()
+	defer this.Unlock()
+	if calls, ok := this.channelCalls[context.channel]; ok {
+		delete(calls, context.seq)
+		if len(calls) == 0 {
+			delete(this.channelCalls, context.channel)
+		}
+	}
+}
+
+/*
+ *  通道关闭后调用，该通道上所有尚未返回的调用立即以ErrChannelClosed失败
+ */
+func (this *RPCClient) OnChannelClose(channel RPCChannel) {
+	this.Lock()
+	calls := this.channelCalls[channel]
+	delete(this.channelCalls, channel)
+	this.Unlock()
+
+	mgr := this.getTimerMgr()
+	for seq, context := range calls {
+		//CancelByIndex成功才回调，避免与超时及响应重复
+		if ok, _ := mgr.CancelByIndex(seq); ok {
+			context.callResponseCB(nil, ErrChannelClosed)
+		}
+	}
+
+	this.Lock()
+	delete(this.breakers, channel)
+	this.Unlock()
 }
 
 //收到RPC消息后调用
@@ -58,9 +285,10 @@ func (this *RPCClient) OnRPCMessage(message interface{}) {
 		kendynet.GetLogger().Errorf(util.FormatFileLine("RPCClient rpc message decode err:%s\n", err.Error()))
 	} else {
 		if resp, ok := msg.(*RPCResponse); ok {
-			mgr := timerMgrs[msg.GetSeq()%uint64(len(timerMgrs))]
-			if ok, ctx := mgr.CancelByIndex(resp.GetSeq()); ok {
-				ctx.(*reqContext).callResponseCB(resp.Ret, resp.Err)
+			if ok, ctx := this.getTimerMgr().CancelByIndex(resp.GetSeq()); ok {
+				context := ctx.(*reqContext)
+				context.c.removeCall(context)
+				context.callResponseCB(resp.Ret, resp.Err)
 			} else if nil == ctx {
 				kendynet.GetLogger().Infoln("onResponse with no reqContext", resp.GetSeq())
 			}
@@ -73,9 +301,13 @@ func (this *RPCClient) OnRPCMessage(message interface{}) {
 //投递，不关心响应和是否失败
 func (this *RPCClient) Post(channel RPCChannel, method string, arg interface{}) error {
 
+	if this.IsClosed() {
+		return ErrClientClosed
+	}
+
 	req := &RPCRequest{
 		Method:   method,
-		Seq:      atomic.AddUint64(&sequence, 1),
+		Seq:      atomic.AddUint64(&this.sequence, 1),
 		Arg:      arg,
 		NeedResp: false,
 	}
@@ -83,6 +315,9 @@ func (this *RPCClient) Post(channel RPCChannel, method string, arg interface{})
 	if request, err := this.encoder.Encode(req); nil != err {
 		return fmt.Errorf("encode error:%s\n", err.Error())
 	} else {
+		if breaker := this.GetCircuitBreaker(channel); nil != breaker && breaker.State() == BreakerOpen {
+			return ErrCircuitOpen
+		}
 		if err = channel.SendRequest(request); nil != err {
 			return err
 		} else {
@@ -91,17 +326,42 @@ func (this *RPCClient) Post(channel RPCChannel, method string, arg interface{})
 	}
 }
 
+/*
+ *  异步调用,如果为method设置了重试策略则按策略重试,cb只在最终结果确定后被调用一次
+ *  返回错误时cb不会被调用
+ */
 func (this *RPCClient) AsynCall(channel RPCChannel, method string, arg interface{}, timeout time.Duration, cb RPCResponseHandler) error {
+	return this.AsynCallWithRequestID(channel, "", method, arg, timeout, cb)
+}
+
+/*
+ *  reqID非空时,对端RPCServer启用了去重(SetDedup)的情况下相同reqID的请求只执行一次,
+ *  重复的请求得到第一次执行的结果。按重试策略重试时每次尝试使用相同的reqID。
+ *  reqID由调用方生成,需要全局唯一(例如uuid)
+ */
+func (this *RPCClient) AsynCallWithRequestID(channel RPCChannel, reqID string, method string, arg interface{}, timeout time.Duration, cb RPCResponseHandler) error {
 
 	if cb == nil {
 		panic("cb == nil")
 	}
 
+	if policy := this.getRetryPolicy(method); nil != policy && policy.MaxAttempts > 1 {
+		return newRetryCall(policy, func(cb RPCResponseHandler) error {
+			return this.asynCall(channel, reqID, method, arg, timeout, cb)
+		}, cb, this).start()
+	} else {
+		return this.asynCall(channel, reqID, method, arg, timeout, cb)
+	}
+}
+
+func (this *RPCClient) asynCall(channel RPCChannel, reqID string, method string, arg interface{}, timeout time.Duration, cb RPCResponseHandler) error {
+
 	req := &RPCRequest{
-		Method:   method,
-		Seq:      atomic.AddUint64(&sequence, 1),
-		Arg:      arg,
-		NeedResp: true,
+		Method:    method,
+		Seq:       atomic.AddUint64(&this.sequence, 1),
+		Arg:       arg,
+		NeedResp:  true,
+		RequestID: reqID,
 	}
 
 	context := &reqContext{
@@ -109,25 +369,71 @@ func (this *RPCClient) AsynCall(channel RPCChannel, method string, arg interface
 		seq:          req.Seq,
 		cbEventQueue: this.cbEventQueue,
 		c:            this,
+		channel:      channel,
 	}
 
 	if request, err := this.encoder.Encode(req); err != nil {
 		return err
 	} else {
-		mgr := timerMgrs[req.Seq%uint64(len(timerMgrs))]
+		breaker := this.GetCircuitBreaker(channel)
+		if nil != breaker {
+			if !breaker.Allow() {
+				return ErrCircuitOpen
+			}
+			context.onResponse = func(ret interface{}, err error) {
+				breaker.OnResult(err)
+				cb(ret, err)
+			}
+		}
+
+		if !this.addCall(context) {
+			if nil != breaker {
+				breaker.OnResult(nil)
+			}
+			return ErrClientClosed
+		}
+		mgr := this.getTimerMgr()
 		mgr.OnceWithIndex(timeout, context.onTimeout, context, context.seq)
+
+		//Close可能发生在addCall与设置定时器之间
+		if this.IsClosed() {
+			this.removeCall(context)
+			if ok, _ := mgr.CancelByIndex(context.seq); ok {
+				if nil != breaker {
+					breaker.OnResult(nil)
+				}
+				return ErrClientClosed
+			} else {
+				atomic.AddInt32(&this.pendingCount, 1)
+				return nil
+			}
+		}
+
 		if err = channel.SendRequest(request); err == nil {
 			atomic.AddInt32(&this.pendingCount, 1)
 			return nil
 		} else {
-			mgr.CancelByIndex(context.seq)
-			return err
+			this.removeCall(context)
+			if ok, _ := mgr.CancelByIndex(context.seq); ok {
+				if nil != breaker {
+					breaker.OnResult(NewStatus(CodeUnavailable, err.Error()))
+				}
+				return err
+			} else {
+				//回调已经由超时或OnChannelClose触发
+				atomic.AddInt32(&this.pendingCount, 1)
+				return nil
+			}
 		}
 	}
 }
 
 //同步调用
 func (this *RPCClient) Call(channel RPCChannel, method string, arg interface{}, timeout time.Duration) (ret interface{}, err error) {
+	return this.CallWithRequestID(channel, "", method, arg, timeout)
+}
+
+func (this *RPCClient) CallWithRequestID(channel RPCChannel, reqID string, method string, arg interface{}, timeout time.Duration) (ret interface{}, err error) {
 	respChan := make(chan interface{})
 	f := func(ret_ interface{}, err_ error) {
 		ret = ret_
@@ -135,10 +441,13 @@ func (this *RPCClient) Call(channel RPCChannel, method string, arg interface{},
 		respChan <- nil
 	}
 
-	if err = this.AsynCall(channel, method, arg, timeout, f); nil == err {
-		_ = <-respChan
+	//回调可能先于AsynCall返回被执行,不能直接将AsynCall的返回值赋给err
+	if err_ := this.AsynCallWithRequestID(channel, reqID, method, arg, timeout, f); nil != err_ {
+		return nil, err_
 	}
 
+	_ = <-respChan
+
 	return
 }
 
@@ -155,13 +464,6 @@ func NewClient(decoder RPCMessageDecoder, encoder RPCMessageEncoder, cbEventQueu
 		panic("encoder == nil")
 	}
 
-	client_once.Do(func() {
-		timerMgrs = make([]*timer.TimerMgr, 61)
-		for i, _ := range timerMgrs {
-			timerMgrs[i] = timer.NewTimerMgr(1)
-		}
-	})
-
 	var q *event.EventQueue
 
 	if len(cbEventQueue) > 0 {
@@ -172,6 +474,12 @@ func NewClient(decoder RPCMessageDecoder, encoder RPCMessageEncoder, cbEventQueu
 		encoder:      encoder,
 		decoder:      decoder,
 		cbEventQueue: q,
+		channelCalls: map[RPCChannel]map[uint64]*reqContext{},
+		retry:        map[string]*RetryPolicy{},
+		breakers:     map[RPCChannel]*CircuitBreaker{},
+		retries:      map[*retryCall]struct{}{},
+		timerMgr:     timer.NewTimerMgr(clientTimerSlots),
+		ownTimerMgr:  true,
 	}
 
 	return c
@@ -0,0 +1,194 @@
+package rpc
+
+import (
+	"container/list"
+	"github.com/sniperHW/kendynet/clock"
+	"sync"
+	"time"
+)
+
+/*
+ *  请求去重
+ *
+ *  SetDedup启用后,带RequestID的请求以(method,RequestID)为键缓存处理结果,处理函数只执行一次:
+ *      相同的请求到达时第一次的请求已经完成,直接返回缓存的结果(第一次调用DropResponse则同样丢弃响应),
+ *      第一次的请求仍在处理中,等待其完成后返回相同的结果。
+ *  请求没有被执行就被拒绝(过载/服务关闭)时不缓存结果,之后的重试会被正常处理。
+ *
+ *  结果在请求完成后window时间内有效。缓存的条目(包括处理中的条目)不超过maxEntries,
+ *  加入新条目时淘汰最早完成的条目,全部是处理中的条目时新的请求以ErrDedupExhausted拒绝(不会执行处理函数)。
+ *  每个处理中的请求最多有maxWaiters个等待的重复请求,超过的以ErrDedupExhausted拒绝。
+ *  缓存持有返回值的引用,处理函数在Reply之后不应再修改返回值。
+ */
+
+var ErrDedupExhausted error = NewStatus(CodeResourceExhausted, "rpc dedup cache exhausted")
+
+const defaultDedupEntries = 10000
+const defaultDedupWaiters = 16
+
+type dedupEntry struct {
+	cache   *dedupCache
+	key     string
+	done    bool
+	dropped bool
+	ret     interface{}
+	err     error
+	expire  time.Time
+	waiters []*RPCReplyer //等待第一次请求完成的重复请求
+	elem    *list.Element
+}
+
+func (this *dedupEntry) replay(replyer *RPCReplyer) {
+	if this.dropped {
+		replyer.DropResponse()
+	} else {
+		replyer.Reply(this.ret, this.err)
+	}
+}
+
+type dedupCache struct {
+	sync.Mutex
+	window     time.Duration
+	maxEntries int
+	maxWaiters int
+	entries    map[string]*dedupEntry
+	completed  *list.List //已完成的条目,按完成时间排序
+	clock      clock.Clock
+}
+
+func newDedupCache(window time.Duration, maxEntries int, maxWaiters int, c clock.Clock) *dedupCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultDedupEntries
+	}
+	if maxWaiters <= 0 {
+		maxWaiters = defaultDedupWaiters
+	}
+	return &dedupCache{
+		window:     window,
+		maxEntries: maxEntries,
+		maxWaiters: maxWaiters,
+		entries:    map[string]*dedupEntry{},
+		completed:  list.New(),
+		clock:      c,
+	}
+}
+
+/*
+ *  window<=0关闭去重,maxEntries<=0使用默认值10000
+ *  maxWaiters:每个处理中的请求最多等待的重复请求数量,默认16
+ */
+func (this *RPCServer) SetDedup(window time.Duration, maxEntries int, maxWaiters ...int) {
+	this.Lock()
+	defer this.Unlock()
+	if window <= 0 {
+		this.dedup = nil
+	} else {
+		var waiters int
+		if len(maxWaiters) > 0 {
+			waiters = maxWaiters[0]
+		}
+		this.dedup = newDedupCache(window, maxEntries, waiters, this.clock)
+	}
+}
+
+/*
+ *  缓存中的条目数量(包括处理中的条目)
+ */
+func (this *RPCServer) DedupLength() int {
+	this.RLock()
+	dedup := this.dedup
+	this.RUnlock()
+	if nil == dedup {
+		return 0
+	}
+	dedup.Lock()
+	defer dedup.Unlock()
+	return len(dedup.entries)
+}
+
+//调用时持有锁
+func (this *dedupCache) remove(e *dedupEntry) {
+	if this.entries[e.key] == e {
+		delete(this.entries, e.key)
+	}
+	if nil != e.elem {
+		this.completed.Remove(e.elem)
+		e.elem = nil
+	}
+}
+
+//调用时持有锁,淘汰过期的条目,条目数量超过limit时按完成的先后淘汰已完成的条目
+func (this *dedupCache) evict(now time.Time, limit int) {
+	for this.completed.Len() > 0 {
+		e := this.completed.Front().Value.(*dedupEntry)
+		if len(this.entries) > limit || !now.Before(e.expire) {
+			this.remove(e)
+		} else {
+			break
+		}
+	}
+}
+
+/*
+ *  返回true表示是第一次收到的请求,需要执行处理函数,
+ *  否则请求已经以缓存的结果返回或等待第一次请求完成
+ */
+func (this *dedupCache) begin(replyer *RPCReplyer) bool {
+	key := replyer.req.Method + ":" + replyer.req.RequestID
+	this.Lock()
+	now := this.clock.Now()
+	this.evict(now, this.maxEntries)
+	if e, ok := this.entries[key]; ok {
+		if e.done {
+			this.Unlock()
+			e.replay(replyer)
+		} else if len(e.waiters) >= this.maxWaiters {
+			this.Unlock()
+			replyer.Reply(nil, ErrDedupExhausted)
+		} else {
+			e.waiters = append(e.waiters, replyer)
+			this.Unlock()
+		}
+		return false
+	}
+	//为新的条目腾出位置
+	this.evict(now, this.maxEntries-1)
+	if len(this.entries) >= this.maxEntries {
+		this.Unlock()
+		replyer.Reply(nil, ErrDedupExhausted)
+		return false
+	}
+	e := &dedupEntry{cache: this, key: key}
+	this.entries[key] = e
+	replyer.dedup = e
+	this.Unlock()
+	return true
+}
+
+func (this *dedupCache) end(e *dedupEntry, ret interface{}, err error, dropped bool) {
+	this.Lock()
+	waiters := e.waiters
+	e.waiters = nil
+	if !dropped && nil != err && notExecuted(CodeOf(err)) {
+		//请求没有被执行,不缓存
+		this.remove(e)
+	} else {
+		e.done = true
+		e.dropped = dropped
+		e.ret = ret
+		e.err = err
+		now := this.clock.Now()
+		e.expire = now.Add(this.window)
+		e.elem = this.completed.PushBack(e)
+		this.evict(now, this.maxEntries)
+	}
+	this.Unlock()
+
+	for _, v := range waiters {
+		if dropped {
+			v.DropResponse()
+		} else {
+			v.Reply(ret, err)
+		}
+	}
+}
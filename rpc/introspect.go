@@ -0,0 +1,171 @@
+package rpc
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ *  内置方法
+ *
+ *  以"rpc."开头的方法名保留给RPCServer,RegisterMethod不能注册这些方法。
+ *  内置方法不受并发上限限制,在调用OnRPCMessage的goroutine上直接执行。
+ *
+ *  BuiltinListMethods  返回[]string,已注册的方法名(按字典序,不包括内置方法)
+ *  BuiltinStats        返回*ServerStats,内置方法不计入方法统计
+ *  BuiltinHealth       健康时返回"SERVING",否则返回错误:
+ *                      Shutdown之后返回ErrServerShuttingDown,
+ *                      SetHealthCheck设置的检查函数返回错误时返回CodeUnavailable。
+ *                      连接器/负载均衡器可以用Call(channel,BuiltinHealth,nil,timeout)探测服务
+ *
+ *  返回值需要通道的编解码器能够编码,StreamChannel的PayloadCodec需要支持[]string及*ServerStats。
+ */
+
+const (
+	reservedPrefix = "rpc."
+
+	BuiltinListMethods = "rpc.listMethods"
+	BuiltinStats       = "rpc.stats"
+	BuiltinHealth      = "rpc.health"
+
+	HealthServing = "SERVING"
+)
+
+/*
+ *  方法的统计,耗时从收到请求(包括在等待队列中的时间)到Reply/DropResponse
+ */
+type MethodStats struct {
+	Calls       uint64        `json:"calls"`   //完成的调用次数
+	Errors      uint64        `json:"errors"`  //以错误返回的次数
+	Pending     int32         `json:"pending"` //尚未完成的调用
+	TotalTime   time.Duration `json:"totalTime"`
+	MaxTime     time.Duration `json:"maxTime"`
+	LastCallEnd time.Time     `json:"lastCallEnd"`
+}
+
+type ServerStats struct {
+	Pending int32                   `json:"pending"` //尚未完成的请求
+	Queued  int                     `json:"queued"`  //等待队列中的请求
+	Methods map[string]*MethodStats `json:"methods"`
+}
+
+type methodStats struct {
+	sync.Mutex
+	stats MethodStats
+}
+
+func (this *methodStats) begin() {
+	this.Lock()
+	this.stats.Pending++
+	this.Unlock()
+}
+
+func (this *methodStats) end(now time.Time, elapsed time.Duration, failed bool) {
+	this.Lock()
+	this.stats.Pending--
+	this.stats.Calls++
+	if failed {
+		this.stats.Errors++
+	}
+	this.stats.TotalTime += elapsed
+	if elapsed > this.stats.MaxTime {
+		this.stats.MaxTime = elapsed
+	}
+	this.stats.LastCallEnd = now
+	this.Unlock()
+}
+
+func (this *methodStats) get() *MethodStats {
+	this.Lock()
+	defer this.Unlock()
+	s := this.stats
+	return &s
+}
+
+func isReserved(name string) bool {
+	return strings.HasPrefix(name, reservedPrefix)
+}
+
+/*
+ *  设置BuiltinHealth使用的检查函数,返回非nil表示服务不可用
+ */
+func (this *RPCServer) SetHealthCheck(check func() error) {
+	this.Lock()
+	defer this.Unlock()
+	this.healthCheck = check
+}
+
+/*
+ *  已注册的方法名,按字典序
+ */
+func (this *RPCServer) Methods() []string {
+	this.RLock()
+	defer this.RUnlock()
+	methods := make([]string, 0, len(this.methods))
+	for k := range this.methods {
+		methods = append(methods, k)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+func (this *RPCServer) Stats() *ServerStats {
+	stats := &ServerStats{
+		Pending: this.PendingCount(),
+		Queued:  this.QueueLength(),
+		Methods: map[string]*MethodStats{},
+	}
+	this.RLock()
+	defer this.RUnlock()
+	for k, v := range this.stats {
+		stats.Methods[k] = v.get()
+	}
+	return stats
+}
+
+/*
+ *  返回nil表示健康
+ */
+func (this *RPCServer) Health() error {
+	if this.IsShuttingDown() {
+		return ErrServerShuttingDown
+	}
+	this.RLock()
+	check := this.healthCheck
+	this.RUnlock()
+	if nil != check {
+		if err := check(); nil != err {
+			if _, ok := err.(*Status); ok {
+				return err
+			} else {
+				return NewStatus(CodeUnavailable, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func (this *RPCServer) getBuiltin(name string) (RPCMethodHandler, bool) {
+	switch name {
+	case BuiltinListMethods:
+		return func(replyer *RPCReplyer, _ interface{}) {
+			replyer.Reply(this.Methods(), nil)
+		}, true
+	case BuiltinStats:
+		return func(replyer *RPCReplyer, _ interface{}) {
+			replyer.Reply(this.Stats(), nil)
+		}, true
+	case BuiltinHealth:
+		return func(replyer *RPCReplyer, _ interface{}) {
+			if err := this.Health(); nil != err {
+				replyer.Reply(nil, err)
+			} else {
+				replyer.Reply(HealthServing, nil)
+			}
+		}, true
+	default:
+		return nil, false
+	}
+}
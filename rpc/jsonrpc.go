@@ -0,0 +1,720 @@
+package rpc
+
+/*
+ *  JSON-RPC 2.0
+ *
+ *  JSONRPCCodec实现RPCMessageEncoder/RPCMessageDecoder,编码结果为单个json对象的[]byte:
+ *      请求:   {"jsonrpc":"2.0","method":"xxx","params":...,"id":seq}
+ *      通知:   不带id的请求,对应NeedResp为false的请求(RPCClient.Post)
+ *      响应:   {"jsonrpc":"2.0","result":...,"id":seq}
+ *              {"jsonrpc":"2.0","error":{"code":...,"message":...,"data":...},"id":seq}
+ *
+ *  参数及返回值使用encoding/json编码,解码得到的Arg/Ret为json.RawMessage,
+ *  通过RegisterService注册的方法会将json.RawMessage解码成方法的参数类型。
+ *  JSON-RPC要求params必须是对象或数组,其它类型的参数被包装成单元素数组发送。
+ *
+ *  请求id可以是整数或字符串,非整数id在服务端被映射为内部序号,响应时还原(DropResponse时释放)。
+ *  请求可以带扩展字段"requestId"(字符串),对应RPCRequest.RequestID。
+ *
+ *  错误码映射: CodeMissingMethod <-> -32601, CodeInvaildArg <-> -32602, CodePanic <-> -32603,
+ *  其余错误码原样使用。Status.Details是合法json时原样作为error.data,否则编码为base64字符串。
+ *
+ *  JSONRPCChannel在StreamSession上收发JSON-RPC消息:websocket每个文本消息一个json,
+ *  tcp/unix/aio每行一个json。支持批量请求,批量请求的响应在全部请求返回(或DropResponse)后以数组一次发送,
+ *  所有请求都没有响应时不发送。
+ *  与JSONRPCChannel配合的RPCClient/RPCServer使用同一个JSONRPCCodec作为编解码器。
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/message"
+	"github.com/sniperHW/kendynet/util"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCInternalError  = -32603
+
+	jsonrpcVersion = "2.0"
+	jsonIDBase     = uint64(1) << 63 //非整数id映射的内部序号从jsonIDBase开始
+)
+
+type jsonrpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (this *jsonrpcError) Error() string {
+	return this.Message
+}
+
+type jsonrpcMessage struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+
+	RequestID string `json:"requestId,omitempty"`
+}
+
+func (this *jsonrpcMessage) isRequest() bool {
+	return this.Method != ""
+}
+
+func (this *jsonrpcMessage) isResponse() bool {
+	return this.Method == "" && (nil != this.Result || nil != this.Error)
+}
+
+func isNull(raw json.RawMessage) bool {
+	return nil == raw || string(raw) == "null"
+}
+
+func toJSONCode(code Code) int {
+	switch code {
+	case CodeMissingMethod:
+		return JSONRPCMethodNotFound
+	case CodeInvaildArg:
+		return JSONRPCInvalidParams
+	case CodePanic:
+		return JSONRPCInternalError
+	default:
+		return int(code)
+	}
+}
+
+func fromJSONCode(code int) Code {
+	switch code {
+	case JSONRPCMethodNotFound:
+		return CodeMissingMethod
+	case JSONRPCInvalidParams:
+		return CodeInvaildArg
+	case JSONRPCInternalError:
+		return CodePanic
+	default:
+		return Code(code)
+	}
+}
+
+//解析单个json对象,返回的错误为*jsonrpcError
+func parseJSONRPC(b []byte) (*jsonrpcMessage, error) {
+	m := &jsonrpcMessage{}
+	if err := json.Unmarshal(b, m); nil != err {
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			return m, &jsonrpcError{Code: JSONRPCInvalidRequest, Message: "invaild request"}
+		}
+		return nil, &jsonrpcError{Code: JSONRPCParseError, Message: "parse error"}
+	}
+
+	if m.Version != jsonrpcVersion {
+		return m, &jsonrpcError{Code: JSONRPCInvalidRequest, Message: "invaild jsonrpc version"}
+	}
+
+	if !m.isRequest() && !m.isResponse() {
+		return m, &jsonrpcError{Code: JSONRPCInvalidRequest, Message: "invaild request"}
+	}
+
+	if m.isRequest() && nil != m.Params && !isNull(m.Params) {
+		if p := bytes.TrimSpace(m.Params); len(p) == 0 || (p[0] != '{' && p[0] != '[') {
+			return m, &jsonrpcError{Code: JSONRPCInvalidParams, Message: "params must be object or array"}
+		}
+	}
+
+	return m, nil
+}
+
+func marshalParams(arg interface{}) (json.RawMessage, error) {
+	b, err := json.Marshal(arg)
+	if nil != err {
+		return nil, err
+	}
+	if b = bytes.TrimSpace(b); len(b) > 0 && (b[0] == '{' || b[0] == '[') {
+		return b, nil
+	}
+	return append(append([]byte{'['}, b...), ']'), nil
+}
+
+/*
+ *  将json参数解码到v,参数是单元素数组而v不是数组时解码数组中的元素
+ */
+func unmarshalParams(params json.RawMessage, v interface{}) error {
+	err := json.Unmarshal(params, v)
+	if nil != err {
+		var elems []json.RawMessage
+		if nil == json.Unmarshal(params, &elems) && len(elems) == 1 {
+			if nil == json.Unmarshal(elems[0], v) {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+func jsonrpcErrorResponse(id json.RawMessage, err *jsonrpcError) []byte {
+	if nil == id {
+		id = json.RawMessage("null")
+	}
+	b, _ := json.Marshal(&jsonrpcMessage{Version: jsonrpcVersion, Error: err, ID: id})
+	return b
+}
+
+type JSONRPCCodec struct {
+	sync.Mutex
+	seq uint64
+	ids map[uint64]json.RawMessage //内部序号到非整数id的映射
+}
+
+func NewJSONRPCCodec() *JSONRPCCodec {
+	return &JSONRPCCodec{
+		ids: map[uint64]json.RawMessage{},
+	}
+}
+
+func (this *JSONRPCCodec) requestSeq(id json.RawMessage) uint64 {
+	if n, err := strconv.ParseUint(string(id), 10, 64); nil == err && n < jsonIDBase {
+		return n
+	}
+	seq := jsonIDBase | (atomic.AddUint64(&this.seq, 1) & (jsonIDBase - 1))
+	this.Lock()
+	this.ids[seq] = id
+	this.Unlock()
+	return seq
+}
+
+func (this *JSONRPCCodec) responseID(seq uint64) json.RawMessage {
+	if seq >= jsonIDBase {
+		this.Lock()
+		id, ok := this.ids[seq]
+		delete(this.ids, seq)
+		this.Unlock()
+		if ok {
+			return id
+		}
+	}
+	return json.RawMessage(strconv.FormatUint(seq, 10))
+}
+
+/*
+ *  释放不会再响应的请求的id映射
+ */
+func (this *JSONRPCCodec) OnDropResponse(seq uint64) {
+	if seq >= jsonIDBase {
+		this.Lock()
+		delete(this.ids, seq)
+		this.Unlock()
+	}
+}
+
+func encodeJSONRequest(req *RPCRequest) (*jsonrpcMessage, error) {
+	m := &jsonrpcMessage{Version: jsonrpcVersion, Method: req.Method, RequestID: req.RequestID}
+	if nil != req.Arg {
+		params, err := marshalParams(req.Arg)
+		if nil != err {
+			return nil, err
+		}
+		m.Params = params
+	}
+	if req.NeedResp {
+		m.ID = json.RawMessage(strconv.FormatUint(req.Seq, 10))
+	}
+	return m, nil
+}
+
+func (this *JSONRPCCodec) Encode(msg RPCMessage) (interface{}, error) {
+	var m *jsonrpcMessage
+
+	switch msg.(type) {
+	case *RPCRequest:
+		var err error
+		if m, err = encodeJSONRequest(msg.(*RPCRequest)); nil != err {
+			return nil, err
+		}
+	case *RPCBatchRequest:
+		//批量请求编码为json数组
+		batch := []*jsonrpcMessage{}
+		for _, v := range msg.(*RPCBatchRequest).Requests {
+			if r, err := encodeJSONRequest(v); nil != err {
+				return nil, err
+			} else {
+				batch = append(batch, r)
+			}
+		}
+		if b, err := json.Marshal(batch); nil != err {
+			return nil, err
+		} else {
+			return b, nil
+		}
+	case *RPCResponse:
+		resp := msg.(*RPCResponse)
+		m = &jsonrpcMessage{Version: jsonrpcVersion, ID: this.responseID(resp.Seq)}
+		if nil != resp.Err {
+			s := StatusOf(resp.Err)
+			m.Error = &jsonrpcError{Code: toJSONCode(s.Code), Message: s.Message}
+			if len(s.Details) > 0 {
+				if json.Valid(s.Details) {
+					m.Error.Data = s.Details
+				} else {
+					m.Error.Data, _ = json.Marshal(s.Details)
+				}
+			}
+		} else {
+			result, err := json.Marshal(resp.Ret)
+			if nil != err {
+				return nil, err
+			}
+			m.Result = result
+		}
+	default:
+		return nil, fmt.Errorf("invaild msg type:%s", reflect.TypeOf(msg).String())
+	}
+
+	if b, err := json.Marshal(m); nil != err {
+		return nil, err
+	} else {
+		return b, nil
+	}
+}
+
+/*
+ *  o可以是[]byte,string或JSONRPCChannel解析后的消息
+ */
+func (this *JSONRPCCodec) Decode(o interface{}) (RPCMessage, error) {
+	var m *jsonrpcMessage
+	var err error
+
+	switch o.(type) {
+	case *jsonrpcMessage:
+		m = o.(*jsonrpcMessage)
+	case []byte:
+		m, err = parseJSONRPC(o.([]byte))
+	case json.RawMessage:
+		m, err = parseJSONRPC(o.(json.RawMessage))
+	case string:
+		m, err = parseJSONRPC([]byte(o.(string)))
+	default:
+		return nil, fmt.Errorf("invaild obj type:%s", reflect.TypeOf(o).String())
+	}
+
+	if nil != err {
+		return nil, err
+	}
+
+	if m.isRequest() {
+		req := &RPCRequest{Method: m.Method, NeedResp: nil != m.ID, RequestID: m.RequestID}
+		if !isNull(m.Params) {
+			req.Arg = m.Params
+		}
+		if req.NeedResp {
+			req.Seq = this.requestSeq(m.ID)
+		}
+		return req, nil
+	} else {
+		resp := &RPCResponse{}
+		if resp.Seq, err = strconv.ParseUint(string(m.ID), 10, 64); nil != err {
+			return nil, fmt.Errorf("invaild response id:%s", string(m.ID))
+		}
+		if nil != m.Error {
+			var details []byte
+			if len(m.Error.Data) > 0 {
+				details = m.Error.Data
+			}
+			resp.Err = NewStatus(fromJSONCode(m.Error.Code), m.Error.Message, details)
+		} else if !isNull(m.Result) {
+			resp.Ret = m.Result
+		}
+		return resp, nil
+	}
+}
+
+/*
+ *  session的编码器,o为JSONRPCCodec编码得到的[]byte
+ */
+type jsonTextEncoder struct {
+	maxPacket uint32
+	ws        bool
+}
+
+func (this *jsonTextEncoder) EnCode(o interface{}) (kendynet.Message, error) {
+	b, ok := o.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("invaild obj type:%s", reflect.TypeOf(o).String())
+	}
+
+	if len(b) > int(this.maxPacket) {
+		return nil, fmt.Errorf("message size limite maxPacket[%d],msg payload[%d]", this.maxPacket, len(b))
+	}
+
+	if this.ws {
+		return message.NewWSMessage(message.WSTextMessage, b), nil
+	} else {
+		buff := kendynet.NewByteBuffer(len(b) + 1)
+		buff.AppendBytes(b)
+		buff.AppendByte('\n')
+		return buff, nil
+	}
+}
+
+/*
+ *  tcp/unix域套接字的按行接收器
+ */
+type lineReceiver struct {
+	maxPacket uint32
+	buffer    []byte
+	r         int
+	w         int
+}
+
+func newLineReceiver(maxPacket uint32) *lineReceiver {
+	return &lineReceiver{
+		maxPacket: maxPacket,
+		buffer:    make([]byte, int(maxPacket)+2), //\r\n
+	}
+}
+
+func (this *lineReceiver) unpack() ([]byte, error) {
+	for {
+		i := bytes.IndexByte(this.buffer[this.r:this.w], '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimSpace(this.buffer[this.r : this.r+i])
+		this.r += i + 1
+		if len(line) > 0 {
+			//buffer会被复用,需要拷贝
+			return append([]byte{}, line...), nil
+		}
+	}
+
+	if this.r == 0 && this.w == len(this.buffer) {
+		return nil, fmt.Errorf("message size limite maxPacket[%d]", this.maxPacket)
+	}
+
+	//将未解包的数据移动到buffer前部
+	if this.r > 0 {
+		copy(this.buffer, this.buffer[this.r:this.w])
+		this.w -= this.r
+		this.r = 0
+	}
+	return nil, nil
+}
+
+func (this *lineReceiver) ReceiveAndUnpack(sess kendynet.StreamSession) (interface{}, error) {
+	for {
+		msg, err := this.unpack()
+		if nil != msg || nil != err {
+			return msg, err
+		}
+		n, err := sess.(interface{ Read([]byte) (int, error) }).Read(this.buffer[this.w:])
+		if n > 0 {
+			this.w += n
+		}
+		if nil != err {
+			return nil, err
+		}
+	}
+}
+
+/*
+ *  aio套接字的按行接收器,实现aio.AioReceiver
+ */
+type aioLineReceiver struct {
+	*lineReceiver
+}
+
+func (this *aioLineReceiver) StartReceive(sess kendynet.StreamSession) {
+	sess.(aioSession).Recv(this.buffer[this.w:])
+}
+
+func (this *aioLineReceiver) OnRecvOk(_ kendynet.StreamSession, buff []byte) {
+	this.w += len(buff)
+}
+
+func (this *aioLineReceiver) ReceiveAndUnpack(sess kendynet.StreamSession) (interface{}, error) {
+	msg, err := this.unpack()
+	if nil == msg && nil == err {
+		return nil, sess.(aioSession).Recv(this.buffer[this.w:])
+	}
+	return msg, err
+}
+
+func (this *aioLineReceiver) OnClose() {
+
+}
+
+/*
+ *  websocket的接收器,每个消息即一个json
+ */
+type wsTextReceiver struct {
+	maxPacket uint32
+}
+
+func (this *wsTextReceiver) ReceiveAndUnpack(sess kendynet.StreamSession) (interface{}, error) {
+	_, msg, err := sess.(interface{ Read() (int, []byte, error) }).Read()
+	if nil != err {
+		return nil, err
+	}
+	if len(msg) > int(this.maxPacket) {
+		return nil, fmt.Errorf("message size limite maxPacket[%d],msg payload[%d]", this.maxPacket, len(msg))
+	}
+	return msg, nil
+}
+
+type JSONRPCChannel struct {
+	session kendynet.StreamSession
+	name    string
+	client  *RPCClient
+	server  *RPCServer
+}
+
+/*
+ *  创建JSONRPCChannel并设置session的编码器及接收器,必须在session.Start之前调用
+ *  maxPacket:单个json的最大大小,默认65535
+ */
+func NewJSONRPCChannel(session kendynet.StreamSession, maxPacket ...uint32) *JSONRPCChannel {
+	max := uint32(defaultMaxPacket)
+	if len(maxPacket) > 0 && maxPacket[0] > 0 {
+		max = maxPacket[0]
+	}
+
+	encoder := &jsonTextEncoder{maxPacket: max}
+
+	var receiver kendynet.Receiver
+
+	switch session.(type) {
+	case aioSession:
+		receiver = &aioLineReceiver{newLineReceiver(max)}
+	case interface{ Read() (int, []byte, error) }:
+		encoder.ws = true
+		receiver = &wsTextReceiver{maxPacket: max}
+	case interface{ Read([]byte) (int, error) }:
+		receiver = newLineReceiver(max)
+	default:
+		panic(fmt.Sprintf("unsupported session type:%s", reflect.TypeOf(session).String()))
+	}
+
+	session.SetEncoder(encoder)
+	session.SetReceiver(receiver)
+
+	return &JSONRPCChannel{
+		session: session,
+		name:    session.RemoteAddr().String() + "<->" + session.LocalAddr().String(),
+	}
+}
+
+func (this *JSONRPCChannel) SendRequest(message interface{}) error {
+	return this.session.Send(message)
+}
+
+func (this *JSONRPCChannel) SendResponse(message interface{}) error {
+	return this.session.Send(message)
+}
+
+func (this *JSONRPCChannel) Name() string {
+	return this.name
+}
+
+func (this *JSONRPCChannel) GetSession() kendynet.StreamSession {
+	return this.session
+}
+
+/*
+ *  设置处理rpc响应的RPCClient,必须在Start之前调用
+ */
+func (this *JSONRPCChannel) SetClient(client *RPCClient) {
+	this.client = client
+}
+
+/*
+ *  设置处理rpc请求的RPCServer,必须在Start之前调用
+ */
+func (this *JSONRPCChannel) SetServer(server *RPCServer) {
+	this.server = server
+}
+
+/*
+ *  启动session,收到的json消息被分流到RPCClient/RPCServer,其余事件交给eventCB
+ */
+func (this *JSONRPCChannel) Start(eventCB func(*kendynet.Event)) error {
+	if nil == eventCB {
+		panic("eventCB == nil")
+	}
+
+	return this.session.Start(func(event *kendynet.Event) {
+		if event.EventType == kendynet.EventTypeMessage {
+			if b, ok := event.Data.([]byte); ok {
+				this.onMessage(b)
+				return
+			}
+		}
+		eventCB(event)
+	})
+}
+
+func (this *JSONRPCChannel) sendError(id json.RawMessage, err *jsonrpcError) {
+	if e := this.session.Send(jsonrpcErrorResponse(id, err)); nil != e {
+		kendynet.GetLogger().Errorf(util.FormatFileLine("send jsonrpc error to (%s) error:%s\n", this.name, e.Error()))
+	}
+}
+
+//分发单个消息,请求的响应通过channel发送
+func (this *JSONRPCChannel) dispatch(channel RPCChannel, m *jsonrpcMessage) {
+	if m.isRequest() {
+		if nil != this.server {
+			this.server.OnRPCMessage(channel, m)
+		} else {
+			kendynet.GetLogger().Errorf(util.FormatFileLine("jsonrpc request from(%s) but no RPCServer\n", this.name))
+			if nil != m.ID {
+				channel.SendResponse(jsonrpcErrorResponse(m.ID, &jsonrpcError{Code: JSONRPCMethodNotFound, Message: "no rpc server"}))
+			}
+		}
+	} else {
+		if nil != this.client {
+			this.client.OnRPCMessage(m)
+		} else {
+			kendynet.GetLogger().Errorf(util.FormatFileLine("jsonrpc response from(%s) but no RPCClient\n", this.name))
+		}
+	}
+}
+
+func (this *JSONRPCChannel) onMessage(b []byte) {
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '[' {
+		this.onBatch(b)
+		return
+	}
+
+	m, err := parseJSONRPC(b)
+	if nil != err {
+		if nil != m && m.isResponse() {
+			//无效的响应不回复
+			kendynet.GetLogger().Errorf(util.FormatFileLine("invaild jsonrpc response from(%s):%s\n", this.name, err.Error()))
+			return
+		}
+		var id json.RawMessage
+		if nil != m {
+			id = m.ID
+		}
+		this.sendError(id, err.(*jsonrpcError))
+		return
+	}
+
+	this.dispatch(this, m)
+}
+
+func (this *JSONRPCChannel) onBatch(b []byte) {
+	var elems []json.RawMessage
+	if err := json.Unmarshal(b, &elems); nil != err {
+		this.sendError(nil, &jsonrpcError{Code: JSONRPCParseError, Message: "parse error"})
+		return
+	}
+
+	if len(elems) == 0 {
+		this.sendError(nil, &jsonrpcError{Code: JSONRPCInvalidRequest, Message: "empty batch"})
+		return
+	}
+
+	batch := &jsonBatch{channel: this}
+	var msgs []*jsonrpcMessage
+
+	for _, v := range elems {
+		m, err := parseJSONRPC(v)
+		if nil != err {
+			if nil == m || !m.isResponse() {
+				var id json.RawMessage
+				if nil != m {
+					id = m.ID
+				}
+				batch.pending++
+				batch.responses = append(batch.responses, jsonrpcErrorResponse(id, err.(*jsonrpcError)))
+			}
+		} else {
+			if m.isRequest() && nil != m.ID {
+				batch.pending++
+			}
+			msgs = append(msgs, m)
+		}
+	}
+
+	//响应数量在分发前确定,请求可能在分发过程中同步返回
+	if batch.pending > 0 && batch.pending == len(batch.responses) {
+		batch.flush()
+	}
+
+	for _, m := range msgs {
+		if m.isRequest() {
+			this.dispatch(batch, m)
+		} else {
+			this.dispatch(this, m)
+		}
+	}
+}
+
+/*
+ *  收集批量请求的响应,全部返回后以数组形式发送
+ */
+type jsonBatch struct {
+	sync.Mutex
+	channel   *JSONRPCChannel
+	pending   int
+	dropped   int
+	responses [][]byte
+}
+
+func (this *jsonBatch) SendRequest(message interface{}) error {
+	return this.channel.SendRequest(message)
+}
+
+func (this *jsonBatch) SendResponse(message interface{}) error {
+	b, ok := message.([]byte)
+	if !ok {
+		return fmt.Errorf("invaild obj type:%s", reflect.TypeOf(message).String())
+	}
+
+	this.Lock()
+	this.responses = append(this.responses, b)
+	done := len(this.responses)+this.dropped == this.pending
+	this.Unlock()
+
+	if done {
+		return this.flush()
+	}
+	return nil
+}
+
+func (this *jsonBatch) OnDropResponse(seq uint64) {
+	this.Lock()
+	this.dropped++
+	done := len(this.responses)+this.dropped == this.pending
+	this.Unlock()
+
+	if done {
+		if err := this.flush(); nil != err {
+			kendynet.GetLogger().Errorf(util.FormatFileLine("send jsonrpc batch response to (%s) error:%s\n", this.Name(), err.Error()))
+		}
+	}
+}
+
+func (this *jsonBatch) Name() string {
+	return this.channel.Name()
+}
+
+func (this *jsonBatch) flush() error {
+	this.Lock()
+	responses := this.responses
+	this.Unlock()
+	if len(responses) == 0 {
+		return nil
+	}
+	return this.channel.session.Send(append(append([]byte{'['}, bytes.Join(responses, []byte{','})...), ']'))
+}
@@ -0,0 +1,208 @@
+package rpc
+
+import (
+	"github.com/sniperHW/kendynet/event"
+	"sync/atomic"
+)
+
+/*
+ *  服务端并发控制
+ *
+ *  一个请求从处理函数开始执行到Reply/DropResponse之间视为正在处理。
+ *  正在处理的请求数量超过全局或方法的并发上限时，请求进入等待队列，
+ *  队列已满则直接以ErrServerOverloaded拒绝(不会执行处理函数，客户端可以安全重试)。
+ *  有请求处理完成时按先后顺序调度队列中满足并发上限的请求。
+ *
+ *  默认在调用OnRPCMessage的goroutine上执行处理函数，从等待队列中调度的请求在新的goroutine上执行，
+ *  可以通过SetEventQueue/SetRoutinePool指定处理函数的执行方式。
+ */
+
+var ErrServerOverloaded error = NewStatus(CodeOverloaded, "rpc server overloaded")
+
+//asyn.NewRoutinePool创建的go程池
+type RoutinePool interface {
+	AddTask(fn interface{}, args ...interface{})
+}
+
+type methodLimit struct {
+	limit   int32
+	running int32
+}
+
+type queuedRequest struct {
+	method  RPCMethodHandler
+	replyer *RPCReplyer
+	arg     interface{}
+}
+
+/*
+ *  设置全局并发上限,<=0不限制
+ */
+func (this *RPCServer) SetConcurrencyLimit(limit int) {
+	this.limitMtx.Lock()
+	defer this.limitMtx.Unlock()
+	if limit < 0 {
+		limit = 0
+	}
+	this.limit = int32(limit)
+}
+
+/*
+ *  设置方法的并发上限,<=0不限制
+ */
+func (this *RPCServer) SetMethodConcurrencyLimit(method string, limit int) {
+	this.limitMtx.Lock()
+	defer this.limitMtx.Unlock()
+	if ml, ok := this.methodLimits[method]; ok {
+		if limit > 0 {
+			ml.limit = int32(limit)
+		} else {
+			ml.limit = 0
+		}
+	} else if limit > 0 {
+		this.methodLimits[method] = &methodLimit{limit: int32(limit)}
+	}
+}
+
+/*
+ *  设置等待队列长度,0表示超过并发上限的请求直接被拒绝
+ */
+func (this *RPCServer) SetQueueSize(size int) {
+	this.limitMtx.Lock()
+	defer this.limitMtx.Unlock()
+	if size < 0 {
+		size = 0
+	}
+	this.queueSize = size
+}
+
+/*
+ *  处理函数投递到eventQueue中执行
+ */
+func (this *RPCServer) SetEventQueue(eventQueue *event.EventQueue) {
+	this.limitMtx.Lock()
+	defer this.limitMtx.Unlock()
+	if nil == eventQueue {
+		this.exec = nil
+	} else {
+		this.exec = func(fn func()) error {
+			return eventQueue.PostNoWait(fn)
+		}
+	}
+}
+
+/*
+ *  处理函数交给go程池执行
+ */
+func (this *RPCServer) SetRoutinePool(pool RoutinePool) {
+	this.limitMtx.Lock()
+	defer this.limitMtx.Unlock()
+	if nil == pool {
+		this.exec = nil
+	} else {
+		this.exec = func(fn func()) error {
+			pool.AddTask(fn)
+			return nil
+		}
+	}
+}
+
+/*
+ *  当前等待队列中的请求数量
+ */
+func (this *RPCServer) QueueLength() int {
+	this.limitMtx.Lock()
+	defer this.limitMtx.Unlock()
+	return len(this.queue)
+}
+
+//调用时持有limitMtx
+func (this *RPCServer) limited() bool {
+	return this.limit > 0 || len(this.methodLimits) > 0
+}
+
+//调用时持有limitMtx,可以执行则占用并发数
+func (this *RPCServer) admit(replyer *RPCReplyer) bool {
+	if this.limit > 0 && this.running >= this.limit {
+		return false
+	}
+
+	ml := this.methodLimits[replyer.req.Method]
+	if nil != ml && ml.limit > 0 && ml.running >= ml.limit {
+		return false
+	}
+
+	this.running++
+	if nil != ml {
+		ml.running++
+	}
+	replyer.admitted = true
+	replyer.ml = ml
+	return true
+}
+
+func (this *RPCServer) dispatch(method RPCMethodHandler, replyer *RPCReplyer, arg interface{}) {
+	this.limitMtx.Lock()
+	exec := this.exec
+	if !this.limited() {
+		this.limitMtx.Unlock()
+		this.execute(exec, method, replyer, arg, false)
+	} else if this.admit(replyer) {
+		this.limitMtx.Unlock()
+		this.execute(exec, method, replyer, arg, false)
+	} else if len(this.queue) < this.queueSize {
+		this.queue = append(this.queue, &queuedRequest{method: method, replyer: replyer, arg: arg})
+		this.limitMtx.Unlock()
+	} else {
+		this.limitMtx.Unlock()
+		replyer.Reply(nil, ErrServerOverloaded)
+	}
+}
+
+func (this *RPCServer) execute(exec func(func()) error, method RPCMethodHandler, replyer *RPCReplyer, arg interface{}, async bool) {
+	if nil != exec {
+		if nil != exec(func() { this.callMethod(method, replyer, arg) }) {
+			replyer.Reply(nil, ErrServerOverloaded)
+		}
+	} else if async {
+		go this.callMethod(method, replyer, arg)
+	} else {
+		this.callMethod(method, replyer, arg)
+	}
+}
+
+//请求处理完成(Reply/DropResponse)后调用
+func (this *RPCServer) release(replyer *RPCReplyer) {
+	atomic.AddInt32(&this.pendingCount, -1)
+	this.removePending(replyer)
+
+	if nil != replyer.onDone {
+		defer replyer.onDone()
+	}
+
+	if !replyer.admitted {
+		return
+	}
+
+	this.limitMtx.Lock()
+	this.running--
+	if nil != replyer.ml {
+		replyer.ml.running--
+	}
+
+	var ready []*queuedRequest
+	for i := 0; i < len(this.queue); {
+		if v := this.queue[i]; this.admit(v.replyer) {
+			ready = append(ready, v)
+			this.queue = append(this.queue[:i], this.queue[i+1:]...)
+		} else {
+			i++
+		}
+	}
+	exec := this.exec
+	this.limitMtx.Unlock()
+
+	for _, v := range ready {
+		this.execute(exec, v.method, v.replyer, v.arg, true)
+	}
+}
@@ -0,0 +1,167 @@
+package rpc
+
+import (
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/event"
+	"sync"
+	"time"
+)
+
+var ErrChannelClosed error = NewStatus(CodeChannelClosed, "rpc channel closed")
+
+/*
+ *  对等rpc端点，在一个连接上同时作为RPCClient和RPCServer
+ *
+ *  收到的rpc请求交给内部的RPCServer处理，rpc响应交给内部的RPCClient，
+ *  连接关闭时所有尚未返回的调用立即以ErrChannelClosed失败。
+ */
+type Peer struct {
+	sync.Mutex
+	channel *StreamChannel
+	client  *RPCClient
+	server  *RPCServer
+	closed  bool
+	onClose func(*Peer, string)
+}
+
+/*
+ *  必须在session.Start之前调用,session由Peer.Start启动
+ *  如果提供cbEventQueue,调用的响应回调将投递到cbEventQueue中执行
+ */
+func NewPeer(session kendynet.StreamSession, codec PayloadCodec, cbEventQueue ...*event.EventQueue) *Peer {
+	var q *event.EventQueue
+
+	if len(cbEventQueue) > 0 {
+		q = cbEventQueue[0]
+	}
+
+	p := &Peer{
+		channel: NewStreamChannel(session, codec),
+		client:  NewClient(&StreamRPCCodec{}, &StreamRPCCodec{}, q),
+		server:  NewRPCServer(&StreamRPCCodec{}, &StreamRPCCodec{}),
+	}
+
+	p.channel.SetClient(p.client)
+	p.channel.SetServer(p.server)
+
+	session.SetCloseCallBack(func(_ kendynet.StreamSession, reason string) {
+		p.onChannelClose(reason)
+	})
+
+	return p
+}
+
+/*
+ *  启动会话，非rpc消息及错误事件交给onEvent处理
+ *  onEvent为nil时，出现错误将关闭会话，普通消息被丢弃
+ */
+func (this *Peer) Start(onEvent func(*kendynet.Event)) error {
+	return this.channel.Start(func(ev *kendynet.Event) {
+		if nil != onEvent {
+			onEvent(ev)
+		} else if ev.EventType == kendynet.EventTypeError {
+			ev.Session.Close(ev.Data.(error).Error(), 0)
+		}
+	})
+}
+
+/*
+ *  设置关闭回调,必须在Start之前调用
+ */
+func (this *Peer) SetCloseCallBack(onClose func(*Peer, string)) {
+	this.onClose = onClose
+}
+
+func (this *Peer) Close(reason string, timeout time.Duration) {
+	this.channel.GetSession().Close(reason, timeout)
+}
+
+func (this *Peer) IsClosed() bool {
+	this.Lock()
+	defer this.Unlock()
+	return this.closed
+}
+
+func (this *Peer) onChannelClose(reason string) {
+	this.Lock()
+	if this.closed {
+		this.Unlock()
+		return
+	}
+	this.closed = true
+	this.Unlock()
+
+	this.client.OnChannelClose(this.channel)
+
+	if nil != this.onClose {
+		this.onClose(this, reason)
+	}
+}
+
+func (this *Peer) GetChannel() *StreamChannel {
+	return this.channel
+}
+
+func (this *Peer) GetClient() *RPCClient {
+	return this.client
+}
+
+func (this *Peer) GetServer() *RPCServer {
+	return this.server
+}
+
+/*
+ *  发送普通应用消息
+ */
+func (this *Peer) Send(o interface{}) error {
+	return this.channel.Send(o)
+}
+
+func (this *Peer) RegisterMethod(name string, method RPCMethodHandler) error {
+	return this.server.RegisterMethod(name, method)
+}
+
+func (this *Peer) UnRegisterMethod(name string) {
+	this.server.UnRegisterMethod(name)
+}
+
+func (this *Peer) RegisterService(obj interface{}) error {
+	return this.server.RegisterService(obj)
+}
+
+func (this *Peer) Post(method string, arg interface{}) error {
+	return this.client.Post(this.channel, method, arg)
+}
+
+func (this *Peer) AsynCall(method string, arg interface{}, timeout time.Duration, cb RPCResponseHandler) error {
+	if this.IsClosed() {
+		return ErrChannelClosed
+	}
+
+	err := this.client.AsynCall(this.channel, method, arg, timeout, cb)
+
+	//发送与关闭并发时,调用可能在OnChannelClose之后才被记录
+	if nil == err && this.IsClosed() {
+		this.client.OnChannelClose(this.channel)
+	}
+
+	return err
+}
+
+//同步调用
+func (this *Peer) Call(method string, arg interface{}, timeout time.Duration) (ret interface{}, err error) {
+	respChan := make(chan struct{})
+	f := func(ret_ interface{}, err_ error) {
+		ret = ret_
+		err = err_
+		close(respChan)
+	}
+
+	if err_ := this.AsynCall(method, arg, timeout, f); nil != err_ {
+		return nil, err_
+	}
+
+	<-respChan
+
+	return
+}
@@ -0,0 +1,211 @@
+/*
+ *  protoc插件，根据.proto文件中的service定义生成kendynet rpc的类型化客户端桩代码及服务端接口
+ *
+ *  安装:
+ *      go install github.com/sniperHW/kendynet/rpc/protoc-gen-kendynet
+ *
+ *  使用:
+ *      protoc --go_out=. --kendynet_out=. xxx.proto
+ *  或在go文件中添加:
+ *      //go:generate protoc --go_out=. --kendynet_out=. xxx.proto
+ *
+ *  对于service Foo中的每个方法 rpc Bar(Req) returns (Resp) 生成:
+ *      FooClient.Bar        同步调用(RPCClient.Call)
+ *      FooClient.AsynBar    异步调用(RPCClient.AsynCall)
+ *      FooClient.PostBar    投递(RPCClient.Post)
+ *      FooServer            服务端需要实现的接口
+ *      RegisterFooServer    将FooServer的实现通过RPCServer.RegisterMethod注册,方法名为"Foo.Bar"
+ *
+ *  参数及返回值通过RPCMessageEncoder/RPCMessageDecoder编解码,生成代码只做类型断言。
+ *  流式方法不被支持。
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+const (
+	fmtPackage  = protogen.GoImportPath("fmt")
+	timePackage = protogen.GoImportPath("time")
+	rpcPackage  = protogen.GoImportPath("github.com/sniperHW/kendynet/rpc")
+)
+
+func main() {
+	var flags flag.FlagSet
+	protogen.Options{
+		ParamFunc: flags.Set,
+	}.Run(func(gen *protogen.Plugin) error {
+		for _, f := range gen.Files {
+			if f.Generate {
+				if err := generateFile(gen, f); nil != err {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func generateFile(gen *protogen.Plugin, file *protogen.File) error {
+	if len(file.Services) == 0 {
+		return nil
+	}
+
+	for _, service := range file.Services {
+		for _, method := range service.Methods {
+			if method.Desc.IsStreamingClient() || method.Desc.IsStreamingServer() {
+				return fmt.Errorf("%s.%s: streaming method is not supported", service.GoName, method.GoName)
+			}
+		}
+	}
+
+	filename := file.GeneratedFilenamePrefix + ".kendynet.pb.go"
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+	g.P("// Code generated by protoc-gen-kendynet. DO NOT EDIT.")
+	g.P("// source: ", file.Desc.Path())
+	g.P()
+	g.P("package ", file.GoPackageName)
+	g.P()
+
+	for _, service := range file.Services {
+		genService(g, service)
+	}
+	return nil
+}
+
+func methodName(service *protogen.Service, method *protogen.Method) string {
+	return service.GoName + "." + method.GoName
+}
+
+func genService(g *protogen.GeneratedFile, service *protogen.Service) {
+	clientName := service.GoName + "Client"
+	serverName := service.GoName + "Server"
+
+	//客户端
+	g.P("type ", clientName, " struct {")
+	g.P("client  *", rpcPackage.Ident("RPCClient"))
+	g.P("channel ", rpcPackage.Ident("RPCChannel"))
+	g.P("}")
+	g.P()
+	g.P("func New", clientName, "(client *", rpcPackage.Ident("RPCClient"), ", channel ", rpcPackage.Ident("RPCChannel"), ") *", clientName, " {")
+	g.P("return &", clientName, "{client: client, channel: channel}")
+	g.P("}")
+	g.P()
+
+	for _, method := range service.Methods {
+		genClientMethod(g, service, method, clientName)
+	}
+
+	//服务端
+	for _, method := range service.Methods {
+		replyerName := service.GoName + method.GoName + "Replyer"
+		g.P("type ", replyerName, " struct {")
+		g.P("*", rpcPackage.Ident("RPCReplyer"))
+		g.P("}")
+		g.P()
+		g.P("func (this *", replyerName, ") Reply(ret *", method.Output.GoIdent, ", err error) {")
+		g.P("if nil == ret {")
+		g.P("this.RPCReplyer.Reply(nil, err)")
+		g.P("} else {")
+		g.P("this.RPCReplyer.Reply(ret, err)")
+		g.P("}")
+		g.P("}")
+		g.P()
+	}
+
+	g.P("type ", serverName, " interface {")
+	for _, method := range service.Methods {
+		g.P(method.GoName, "(*", service.GoName+method.GoName+"Replyer", ", *", method.Input.GoIdent, ")")
+	}
+	g.P("}")
+	g.P()
+
+	g.P("func Register", serverName, "(server *", rpcPackage.Ident("RPCServer"), ", impl ", serverName, ") error {")
+	g.P("methods := []struct {")
+	g.P("name    string")
+	g.P("handler ", rpcPackage.Ident("RPCMethodHandler"))
+	g.P("}{")
+	for _, method := range service.Methods {
+		name := methodName(service, method)
+		g.P("{")
+		g.P("name: ", fmt.Sprintf("%q", name), ",")
+		g.P("handler: func(replyer *", rpcPackage.Ident("RPCReplyer"), ", arg interface{}) {")
+		g.P("if nil == arg {")
+		g.P("impl.", method.GoName, "(&", service.GoName+method.GoName+"Replyer", "{replyer}, &", method.Input.GoIdent, "{})")
+		g.P("} else if a, ok := arg.(*", method.Input.GoIdent, "); ok {")
+		g.P("impl.", method.GoName, "(&", service.GoName+method.GoName+"Replyer", "{replyer}, a)")
+		g.P("} else {")
+		g.P("replyer.Reply(nil, ", rpcPackage.Ident("Errorf"), "(", rpcPackage.Ident("CodeInvaildArg"), ", \"method ", name, ": invaild arg type:%T,want:*", method.Input.GoIdent.GoName, "\", arg))")
+		g.P("}")
+		g.P("},")
+		g.P("},")
+	}
+	g.P("}")
+	g.P()
+	g.P("for i, v := range methods {")
+	g.P("if err := server.RegisterMethod(v.name, v.handler); nil != err {")
+	g.P("for _, vv := range methods[:i] {")
+	g.P("server.UnRegisterMethod(vv.name)")
+	g.P("}")
+	g.P("return err")
+	g.P("}")
+	g.P("}")
+	g.P("return nil")
+	g.P("}")
+	g.P()
+}
+
+func genClientMethod(g *protogen.GeneratedFile, service *protogen.Service, method *protogen.Method, clientName string) {
+	name := methodName(service, method)
+	output := method.Output.GoIdent
+
+	//同步调用
+	g.P("func (this *", clientName, ") ", method.GoName, "(arg *", method.Input.GoIdent, ", timeout ", timePackage.Ident("Duration"), ") (*", output, ", error) {")
+	g.P("ret, err := this.client.Call(this.channel, ", fmt.Sprintf("%q", name), ", arg, timeout)")
+	g.P("if nil != err {")
+	g.P("return nil, err")
+	g.P("}")
+	g.P("return ", unexport(service.GoName+method.GoName), "Ret(ret)")
+	g.P("}")
+	g.P()
+
+	//异步调用
+	g.P("func (this *", clientName, ") Asyn", method.GoName, "(arg *", method.Input.GoIdent, ", timeout ", timePackage.Ident("Duration"), ", cb func(*", output, ", error)) error {")
+	g.P("return this.client.AsynCall(this.channel, ", fmt.Sprintf("%q", name), ", arg, timeout, func(ret interface{}, err error) {")
+	g.P("if nil != err {")
+	g.P("cb(nil, err)")
+	g.P("} else {")
+	g.P("cb(", unexport(service.GoName+method.GoName), "Ret(ret))")
+	g.P("}")
+	g.P("})")
+	g.P("}")
+	g.P()
+
+	//投递
+	g.P("func (this *", clientName, ") Post", method.GoName, "(arg *", method.Input.GoIdent, ") error {")
+	g.P("return this.client.Post(this.channel, ", fmt.Sprintf("%q", name), ", arg)")
+	g.P("}")
+	g.P()
+
+	g.P("func ", unexport(service.GoName+method.GoName), "Ret(ret interface{}) (*", output, ", error) {")
+	g.P("if nil == ret {")
+	g.P("return nil, nil")
+	g.P("} else if r, ok := ret.(*", output, "); ok {")
+	g.P("return r, nil")
+	g.P("} else {")
+	g.P("return nil, ", fmtPackage.Ident("Errorf"), "(\"method ", name, ": invaild response type:%T,want:*", output.GoName, "\", ret)")
+	g.P("}")
+	g.P("}")
+	g.P()
+}
+
+func unexport(s string) string {
+	if s == "" {
+		return s
+	}
+	return string(s[0]|0x20) + s[1:]
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/pluginpb"
+	"strings"
+	"testing"
+)
+
+func message(name string) *descriptorpb.DescriptorProto {
+	return &descriptorpb.DescriptorProto{
+		Name: proto.String(name),
+		Field: []*descriptorpb.FieldDescriptorProto{{
+			Name:   proto.String(name),
+			Number: proto.Int32(1),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_REQUIRED.Enum(),
+			Type:   descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+		}},
+	}
+}
+
+func generate(t *testing.T, streaming bool) *pluginpb.CodeGeneratorResponse {
+	options := &descriptorpb.FileOptions{GoPackage: proto.String("github.com/sniperHW/kendynet/example/testproto;testproto")}
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:        proto.String("echo.proto"),
+		Package:     proto.String("testproto"),
+		Syntax:      proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{message("hello"), message("world")},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Echo"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:            proto.String("SayHello"),
+				InputType:       proto.String(".testproto.hello"),
+				OutputType:      proto.String(".testproto.world"),
+				ServerStreaming: proto.Bool(streaming),
+			}},
+		}},
+		Options: options,
+	}
+
+	gen, err := protogen.Options{}.New(&pluginpb.CodeGeneratorRequest{
+		FileToGenerate: []string{"echo.proto"},
+		ProtoFile:      []*descriptorpb.FileDescriptorProto{file},
+	})
+	assert.Nil(t, err)
+
+	for _, f := range gen.Files {
+		if f.Generate {
+			if err = generateFile(gen, f); nil != err {
+				gen.Error(err)
+			}
+		}
+	}
+
+	return gen.Response()
+}
+
+func TestGenerate(t *testing.T) {
+	{
+		resp := generate(t, false)
+		assert.Nil(t, resp.Error)
+		assert.Equal(t, 1, len(resp.File))
+		assert.True(t, strings.HasSuffix(resp.File[0].GetName(), "echo.kendynet.pb.go"))
+		content := resp.File[0].GetContent()
+		assert.True(t, strings.Contains(content, "func (this *EchoClient) SayHello(arg *Hello, timeout time.Duration) (*World, error)"))
+		assert.True(t, strings.Contains(content, "func (this *EchoClient) AsynSayHello(arg *Hello, timeout time.Duration, cb func(*World, error)) error"))
+		assert.True(t, strings.Contains(content, "SayHello(*EchoSayHelloReplyer, *Hello)"))
+		assert.True(t, strings.Contains(content, "func RegisterEchoServer(server *rpc.RPCServer, impl EchoServer) error"))
+		assert.True(t, strings.Contains(content, `"Echo.SayHello"`))
+	}
+
+	{
+		resp := generate(t, true)
+		assert.NotNil(t, resp.Error)
+	}
+}
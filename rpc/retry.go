@@ -0,0 +1,230 @@
+package rpc
+
+import (
+	"github.com/sniperHW/kendynet/event"
+	"github.com/sniperHW/kendynet/timer"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+ *  调用重试策略，通过RPCClient.SetRetryPolicy按方法设置
+ *
+ *  每次尝试使用调用时传入的timeout。非幂等方法只在请求确定没有被对端执行时
+ *  (熔断/无可用通道/过载/服务关闭)重试，避免重复执行。
+ *
+ *  HedgeDelay>0且方法幂等时启用对冲：一次尝试在HedgeDelay内没有返回，
+ *  不等待其结果直接发出下一次尝试，以最先成功的结果为准，总尝试次数仍受MaxAttempts限制。
+ */
+type RetryPolicy struct {
+	MaxAttempts    int           //最大尝试次数(包括第一次),<=1不重试
+	Backoff        time.Duration //第一次重试前的等待时间,之后每次翻倍
+	MaxBackoff     time.Duration //等待时间上限,0不限制
+	RetryableCodes []Code        //可重试的错误码,为空使用DefaultRetryableCodes
+	Idempotent     bool          //方法是否幂等
+	HedgeDelay     time.Duration //对冲延时,0不对冲
+}
+
+var DefaultRetryableCodes = []Code{CodeTimeout, CodeChannelClosed, CodeOverloaded, CodeUnavailable, CodeCircuitOpen, CodeShuttingDown}
+
+//请求没有被对端执行就失败的错误码
+func notExecuted(code Code) bool {
+	switch code {
+	case CodeOverloaded, CodeUnavailable, CodeCircuitOpen, CodeShuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+func (this *RetryPolicy) retryable(err error) bool {
+	code := CodeOf(err)
+	codes := this.RetryableCodes
+	if len(codes) == 0 {
+		codes = DefaultRetryableCodes
+	}
+	for _, v := range codes {
+		if v == code {
+			return this.Idempotent || notExecuted(code)
+		}
+	}
+	return false
+}
+
+//第n次重试前的等待时间,在[d/2,d]之间随机以免大量调用同时重试
+func (this *RetryPolicy) backoff(n int) time.Duration {
+	d := this.Backoff
+	for i := 1; i < n && d > 0; i++ {
+		d *= 2
+		if this.MaxBackoff > 0 && d >= this.MaxBackoff {
+			break
+		}
+	}
+	if this.MaxBackoff > 0 && d > this.MaxBackoff {
+		d = this.MaxBackoff
+	}
+	if d > 1 {
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+	return d
+}
+
+type retryCall struct {
+	sync.Mutex
+	policy       *RetryPolicy
+	attempt      func(RPCResponseHandler) error
+	cb           RPCResponseHandler
+	cbEventQueue *event.EventQueue
+	attempts     int
+	inflight     int
+	done         bool
+	next         *timer.Timer
+	gen          int
+	timerMgr     *timer.TimerMgr
+	client       *RPCClient
+}
+
+func newRetryCall(policy *RetryPolicy, attempt func(RPCResponseHandler) error, cb RPCResponseHandler, client *RPCClient) *retryCall {
+	return &retryCall{
+		policy:       policy,
+		attempt:      attempt,
+		cb:           cb,
+		cbEventQueue: client.cbEventQueue,
+		timerMgr:     client.getTimerMgr(),
+		client:       client,
+	}
+}
+
+//发起第一次尝试,第一次尝试同步失败且不能重试时返回错误,此时不会回调
+func (this *retryCall) start() error {
+	if !this.client.addRetry(this) {
+		return ErrClientClosed
+	}
+	this.Lock()
+	if err := this.launch(); nil != err {
+		if this.done {
+			//尝试期间客户端关闭,已经回调
+			this.Unlock()
+			return nil
+		} else if this.policy.retryable(err) && this.attempts < this.policy.MaxAttempts {
+			this.arm(this.policy.backoff(this.attempts))
+			this.Unlock()
+			return nil
+		} else {
+			this.finish()
+			this.Unlock()
+			return err
+		}
+	}
+	this.Unlock()
+	return nil
+}
+
+//调用时持有锁,结束重试
+func (this *retryCall) finish() {
+	this.done = true
+	this.disarm()
+	this.client.removeRetry(this)
+}
+
+//RPCClient关闭时调用,取消等待中的重试,尚未返回的尝试的结果被忽略
+func (this *retryCall) close(err error) {
+	this.Lock()
+	if this.done {
+		this.Unlock()
+		return
+	}
+	this.finish()
+	this.Unlock()
+	if nil != this.cbEventQueue {
+		this.cbEventQueue.PostNoWait(this.cb, nil, err)
+	} else {
+		this.cb(nil, err)
+	}
+}
+
+//调用时持有锁,返回时重新持有锁
+func (this *retryCall) launch() error {
+	this.attempts++
+	this.inflight++
+	if this.policy.Idempotent && this.policy.HedgeDelay > 0 && this.attempts < this.policy.MaxAttempts {
+		this.arm(this.policy.HedgeDelay)
+	}
+	this.Unlock()
+	err := this.attempt(this.onResult)
+	this.Lock()
+	if nil != err {
+		this.inflight--
+	}
+	return err
+}
+
+//设置下一次尝试的定时器,替换之前的定时器
+func (this *retryCall) arm(d time.Duration) {
+	this.disarm()
+	this.gen++
+	this.next = this.timerMgr.Once(d, this.onTimer, this.gen)
+}
+
+func (this *retryCall) disarm() {
+	if nil != this.next {
+		this.next.Cancel()
+		this.next = nil
+	}
+}
+
+func (this *retryCall) onTimer(_ *timer.Timer, ctx interface{}) {
+	this.Lock()
+	if this.done || ctx.(int) != this.gen || this.attempts >= this.policy.MaxAttempts {
+		this.Unlock()
+		return
+	}
+	this.next = nil
+	if err := this.launch(); nil != err {
+		this.fail(err, true)
+	} else {
+		this.Unlock()
+	}
+}
+
+func (this *retryCall) onResult(ret interface{}, err error) {
+	this.Lock()
+	if this.done {
+		this.Unlock()
+		return
+	}
+	this.inflight--
+	if nil == err {
+		this.finish()
+		this.Unlock()
+		this.cb(ret, nil)
+	} else {
+		this.fail(err, false)
+	}
+}
+
+//调用时持有锁,返回前释放
+func (this *retryCall) fail(err error, onTimer bool) {
+	if this.done {
+		this.Unlock()
+		return
+	}
+	retryable := this.policy.retryable(err)
+	if retryable && this.attempts < this.policy.MaxAttempts {
+		this.arm(this.policy.backoff(this.attempts))
+		this.Unlock()
+	} else if retryable && this.inflight > 0 {
+		//尝试次数已用完,等待尚未返回的对冲请求
+		this.Unlock()
+	} else {
+		this.finish()
+		this.Unlock()
+		if onTimer && nil != this.cbEventQueue {
+			//在定时器中失败,保证回调与正常响应在同一个队列中执行
+			this.cbEventQueue.PostNoWait(this.cb, nil, err)
+		} else {
+			this.cb(nil, err)
+		}
+	}
+}
@@ -7,8 +7,9 @@ package rpc
  */
 
 const (
-	RPC_REQUEST  = 1
-	RPC_RESPONSE = 2
+	RPC_REQUEST       = 1
+	RPC_RESPONSE      = 2
+	RPC_BATCH_REQUEST = 3
 )
 
 type RPCMessage interface {
@@ -17,10 +18,11 @@ type RPCMessage interface {
 }
 
 type RPCRequest struct {
-	Seq      uint64
-	Method   string
-	Arg      interface{}
-	NeedResp bool
+	Seq       uint64
+	Method    string
+	Arg       interface{}
+	NeedResp  bool
+	RequestID string //调用方提供的请求标识,用于服务端去重,可以为空
 }
 
 type RPCResponse struct {
@@ -29,6 +31,13 @@ type RPCResponse struct {
 	Ret interface{}
 }
 
+/*
+ *  批量请求,在一个消息中发送多个请求,每个请求单独响应
+ */
+type RPCBatchRequest struct {
+	Requests []*RPCRequest
+}
+
 func (this *RPCRequest) Type() byte {
 	return RPC_REQUEST
 }
@@ -37,6 +46,10 @@ func (this *RPCResponse) Type() byte {
 	return RPC_RESPONSE
 }
 
+func (this *RPCBatchRequest) Type() byte {
+	return RPC_BATCH_REQUEST
+}
+
 func (this *RPCRequest) GetSeq() uint64 {
 	return this.Seq
 }
@@ -45,6 +58,10 @@ func (this *RPCResponse) GetSeq() uint64 {
 	return this.Seq
 }
 
+func (this *RPCBatchRequest) GetSeq() uint64 {
+	return 0
+}
+
 type RPCMessageEncoder interface {
 	Encode(RPCMessage) (interface{}, error)
 }
@@ -62,3 +79,11 @@ type RPCChannel interface {
 	SendResponse(interface{}) error //发送RPC回应
 	Name() string
 }
+
+/*
+ *  编码器/通道可选实现的接口
+ *  需要响应的请求最终不会发送响应(DropResponse或响应编码失败)时,通过OnDropResponse通知服务端的编码器及通道
+ */
+type ResponseDropper interface {
+	OnDropResponse(seq uint64)
+}
@@ -3,17 +3,26 @@ package rpc
 //go test -covermode=count -v -run=.
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/clock"
 	"github.com/sniperHW/kendynet/event"
 	codec "github.com/sniperHW/kendynet/example/codec"
 	"github.com/sniperHW/kendynet/example/pb"
 	"github.com/sniperHW/kendynet/example/testproto"
+	"github.com/sniperHW/kendynet/socket"
 	connector "github.com/sniperHW/kendynet/socket/connector/tcp"
 	listener "github.com/sniperHW/kendynet/socket/listener/tcp"
+	"github.com/sniperHW/kendynet/timer"
 	"github.com/stretchr/testify/assert"
+	"net"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -69,7 +78,10 @@ func (this *TestEncoder) Encode(message RPCMessage) (interface{}, error) {
 		resp := message.(*RPCResponse)
 		response := &testproto.RPCResponse{Seq: proto.Uint64(resp.Seq)}
 		if resp.Err != nil {
-			response.Err = proto.String(resp.Err.Error())
+			s := StatusOf(resp.Err)
+			response.Err = proto.String(s.Message)
+			response.Code = proto.Int32(int32(s.Code))
+			response.Details = s.Details
 		}
 		if resp.Ret != nil {
 			buff, err := pb.Encode(resp.Ret, 1000)
@@ -108,7 +120,11 @@ func (this *TestDecoder) Decode(o interface{}) (RPCMessage, error) {
 		resp := o.(*testproto.RPCResponse)
 		response := &RPCResponse{Seq: resp.GetSeq()}
 		if resp.Err != nil {
-			response.Err = fmt.Errorf(resp.GetErr())
+			code := Code(resp.GetCode())
+			if code == CodeOK {
+				code = CodeUnknown
+			}
+			response.Err = NewStatus(code, resp.GetErr(), resp.GetDetails())
 		}
 		if len(resp.Ret) > 0 {
 			var err error
@@ -302,3 +318,1475 @@ func TestRPC(t *testing.T) {
 	}
 
 }
+
+//不经过网络,直接在进程内投递rpc消息的通道
+type localCodec struct {
+}
+
+func (this *localCodec) Encode(message RPCMessage) (interface{}, error) {
+	return message, nil
+}
+
+func (this *localCodec) Decode(o interface{}) (RPCMessage, error) {
+	if msg, ok := o.(RPCMessage); ok {
+		return msg, nil
+	} else {
+		return nil, fmt.Errorf("invaild obj type:%s", reflect.TypeOf(o).String())
+	}
+}
+
+type localChannel struct {
+	server *RPCServer
+	client *RPCClient
+}
+
+func (this *localChannel) SendRequest(message interface{}) error {
+	go this.server.OnRPCMessage(this, message)
+	return nil
+}
+
+func (this *localChannel) SendResponse(message interface{}) error {
+	go this.client.OnRPCMessage(message)
+	return nil
+}
+
+func (this *localChannel) Name() string {
+	return "local"
+}
+
+func newLocalChannel(server *RPCServer) *localChannel {
+	return &localChannel{
+		server: server,
+		client: NewClient(&localCodec{}, &localCodec{}),
+	}
+}
+
+type Arith struct {
+}
+
+type ArithArg struct {
+	A int
+	B int
+}
+
+func (this *Arith) Add(arg *ArithArg, reply *int) error {
+	*reply = arg.A + arg.B
+	return nil
+}
+
+func (this *Arith) Div(arg ArithArg, reply *int) error {
+	if arg.B == 0 {
+		return fmt.Errorf("divide by zero")
+	}
+	*reply = arg.A / arg.B
+	return nil
+}
+
+//不满足签名的方法不会被注册
+func (this *Arith) Name() string {
+	return "arith"
+}
+
+func TestRegisterService(t *testing.T) {
+	server := NewRPCServer(&localCodec{}, &localCodec{})
+
+	assert.Nil(t, server.RegisterService(&Arith{}))
+	assert.NotNil(t, server.RegisterService(&Arith{}))
+	assert.NotNil(t, server.RegisterService(&struct{}{}))
+	assert.Nil(t, server.RegisterServiceWithName("Math", &Arith{}))
+
+	channel := newLocalChannel(server)
+
+	{
+		r, err := channel.client.Call(channel, "Arith.Add", &ArithArg{A: 1, B: 2}, time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, *r.(*int))
+	}
+
+	{
+		r, err := channel.client.Call(channel, "Math.Div", &ArithArg{A: 6, B: 2}, time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, *r.(*int))
+	}
+
+	{
+		_, err := channel.client.Call(channel, "Arith.Div", ArithArg{A: 6, B: 0}, time.Second)
+		assert.Equal(t, "divide by zero", err.Error())
+	}
+
+	{
+		_, err := channel.client.Call(channel, "Arith.Add", "hello", time.Second)
+		assert.Equal(t, "method Arith.Add: invaild arg type:string,want:*rpc.ArithArg", err.Error())
+	}
+
+	{
+		_, err := channel.client.Call(channel, "Arith.Name", nil, time.Second)
+		assert.Equal(t, "invaild method:Arith.Name", err.Error())
+	}
+
+	server.UnRegisterService("Math", &Arith{})
+
+	{
+		_, err := channel.client.Call(channel, "Math.Add", &ArithArg{A: 1, B: 2}, time.Second)
+		assert.Equal(t, "invaild method:Math.Add", err.Error())
+	}
+}
+
+func TestStatus(t *testing.T) {
+	assert.Nil(t, StatusOf(nil))
+	assert.Equal(t, CodeOK, CodeOf(nil))
+	assert.Equal(t, CodeUnknown, CodeOf(fmt.Errorf("business error")))
+	assert.True(t, IsCode(ErrCallTimeout, CodeTimeout))
+	assert.True(t, IsCode(fmt.Errorf("wrap:%w", Errorf(CodeUser+1, "user error")), CodeUser+1))
+	assert.Equal(t, "Overloaded", CodeOverloaded.String())
+	assert.Equal(t, "Code(1001)", (CodeUser + 1).String())
+
+	{
+		//通过编解码器后错误码保持不变
+		encoder := &TestEncoder{}
+		decoder := &TestDecoder{}
+		msg, err := encoder.Encode(&RPCResponse{Seq: 1, Err: NewStatus(CodeUser, "user error", []byte("details"))})
+		assert.Nil(t, err)
+		resp, err := decoder.Decode(msg)
+		assert.Nil(t, err)
+		s := StatusOf(resp.(*RPCResponse).Err)
+		assert.Equal(t, CodeUser, s.Code)
+		assert.Equal(t, "user error", s.Message)
+		assert.Equal(t, []byte("details"), s.Details)
+
+		msg, err = encoder.Encode(&RPCResponse{Seq: 1, Err: fmt.Errorf("business error")})
+		assert.Nil(t, err)
+		resp, err = decoder.Decode(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, CodeUnknown, CodeOf(resp.(*RPCResponse).Err))
+	}
+
+	server := NewRPCServer(&localCodec{}, &localCodec{})
+	server.RegisterMethod("panic", func(replyer *RPCReplyer, arg interface{}) {
+		panic("panic")
+	})
+	server.RegisterService(&Arith{})
+
+	channel := newLocalChannel(server)
+
+	{
+		_, err := channel.client.Call(channel, "world", nil, time.Second)
+		assert.True(t, IsCode(err, CodeMissingMethod))
+	}
+
+	{
+		_, err := channel.client.Call(channel, "panic", nil, time.Second)
+		assert.True(t, IsCode(err, CodePanic))
+	}
+
+	{
+		_, err := channel.client.Call(channel, "Arith.Add", "hello", time.Second)
+		assert.True(t, IsCode(err, CodeInvaildArg))
+	}
+}
+
+//测试用PayloadCodec,只支持string,*ArithArg和*int,*string解码后为string
+type testPayloadCodec struct {
+}
+
+func (this *testPayloadCodec) Marshal(o interface{}) ([]byte, error) {
+	switch o.(type) {
+	case string:
+		return append([]byte{'s'}, []byte(o.(string))...), nil
+	case *string:
+		return append([]byte{'s'}, []byte(*o.(*string))...), nil
+	case *ArithArg:
+		return []byte(fmt.Sprintf("a%d,%d", o.(*ArithArg).A, o.(*ArithArg).B)), nil
+	case *int:
+		return []byte(fmt.Sprintf("i%d", *o.(*int))), nil
+	default:
+		return nil, fmt.Errorf("invaild obj type:%s", reflect.TypeOf(o).String())
+	}
+}
+
+func (this *testPayloadCodec) Unmarshal(b []byte) (interface{}, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty payload")
+	}
+	switch b[0] {
+	case 's':
+		return string(b[1:]), nil
+	case 'a':
+		arg := &ArithArg{}
+		_, err := fmt.Sscanf(string(b[1:]), "%d,%d", &arg.A, &arg.B)
+		return arg, err
+	case 'i':
+		i := 0
+		_, err := fmt.Sscanf(string(b[1:]), "%d", &i)
+		return &i, err
+	default:
+		return nil, fmt.Errorf("invaild payload type:%c", b[0])
+	}
+}
+
+//返回一对已连接的tcp连接
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	return <-accepted, conn
+}
+
+func TestStreamChannel(t *testing.T) {
+	server := NewRPCServer(&StreamRPCCodec{}, &StreamRPCCodec{})
+	server.RegisterService(&Arith{})
+
+	serverConn, clientConn := tcpPair(t)
+
+	appMsg := make(chan interface{}, 1)
+
+	serverChannel := NewStreamChannel(socket.NewStreamSocket(serverConn), &testPayloadCodec{})
+	serverChannel.SetServer(server)
+	serverChannel.Start(func(event *kendynet.Event) {
+		if event.EventType == kendynet.EventTypeError {
+			event.Session.Close(event.Data.(error).Error(), 0)
+		} else {
+			appMsg <- event.Data
+		}
+	})
+
+	client := NewClient(&StreamRPCCodec{}, &StreamRPCCodec{})
+	clientChannel := NewStreamChannel(socket.NewStreamSocket(clientConn), &testPayloadCodec{})
+	clientChannel.SetClient(client)
+	clientChannel.Start(func(event *kendynet.Event) {
+		if event.EventType == kendynet.EventTypeError {
+			event.Session.Close(event.Data.(error).Error(), 0)
+		}
+	})
+
+	{
+		r, err := client.Call(clientChannel, "Arith.Add", &ArithArg{A: 1, B: 2}, time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, *r.(*int))
+	}
+
+	{
+		_, err := client.Call(clientChannel, "Arith.Div", &ArithArg{A: 1, B: 0}, time.Second)
+		assert.Equal(t, "divide by zero", err.Error())
+		assert.True(t, IsCode(err, CodeUnknown))
+	}
+
+	{
+		_, err := client.Call(clientChannel, "Arith.Mul", nil, time.Second)
+		assert.True(t, IsCode(err, CodeMissingMethod))
+	}
+
+	//普通消息与rpc消息共用一个session
+	assert.Nil(t, clientChannel.Send("hello"))
+	assert.Equal(t, "hello", <-appMsg)
+
+	clientChannel.GetSession().Close("test", 0)
+}
+
+func TestFrameCodec(t *testing.T) {
+	c := &frameCodec{codec: &testPayloadCodec{}, maxPacket: defaultMaxPacket}
+
+	decode := func(o interface{}) interface{} {
+		msg, err := c.EnCode(o)
+		assert.Nil(t, err)
+		r, err := c.decode(msg.Bytes()[frameHeaderSize:])
+		assert.Nil(t, err)
+		return r
+	}
+
+	{
+		req := decode(&RPCRequest{Seq: 1, Method: "hello", NeedResp: true, Arg: "world"}).(*RPCRequest)
+		assert.Equal(t, uint64(1), req.Seq)
+		assert.Equal(t, "hello", req.Method)
+		assert.Equal(t, true, req.NeedResp)
+		assert.Equal(t, "world", req.Arg)
+	}
+
+	{
+		req := decode(&RPCRequest{Seq: 2, Method: "hello"}).(*RPCRequest)
+		assert.Equal(t, false, req.NeedResp)
+		assert.Nil(t, req.Arg)
+		assert.Equal(t, "", req.RequestID)
+	}
+
+	{
+		req := decode(&RPCRequest{Seq: 2, Method: "hello", NeedResp: true, RequestID: "id", Arg: "world"}).(*RPCRequest)
+		assert.Equal(t, true, req.NeedResp)
+		assert.Equal(t, "id", req.RequestID)
+		assert.Equal(t, "hello", req.Method)
+		assert.Equal(t, "world", req.Arg)
+	}
+
+	{
+		resp := decode(&RPCResponse{Seq: 3, Err: NewStatus(CodeUser, "error", []byte("details"))}).(*RPCResponse)
+		assert.Equal(t, uint64(3), resp.Seq)
+		assert.Equal(t, CodeUser, CodeOf(resp.Err))
+		assert.Equal(t, "error", resp.Err.Error())
+		assert.Equal(t, []byte("details"), StatusOf(resp.Err).Details)
+		assert.Nil(t, resp.Ret)
+	}
+
+	{
+		resp := decode(&RPCResponse{Seq: 4, Ret: ""}).(*RPCResponse)
+		assert.Nil(t, resp.Err)
+		assert.Equal(t, "", resp.Ret)
+	}
+
+	{
+		batch := decode(&RPCBatchRequest{Requests: []*RPCRequest{
+			&RPCRequest{Seq: 5, Method: "hello", NeedResp: true, Arg: "world"},
+			&RPCRequest{Seq: 6, Method: "post"},
+		}}).(*RPCBatchRequest)
+		assert.Equal(t, 2, len(batch.Requests))
+		assert.Equal(t, uint64(5), batch.Requests[0].Seq)
+		assert.Equal(t, "world", batch.Requests[0].Arg)
+		assert.Equal(t, "post", batch.Requests[1].Method)
+		assert.Equal(t, false, batch.Requests[1].NeedResp)
+		assert.Nil(t, batch.Requests[1].Arg)
+	}
+
+	{
+		_, err := c.EnCode(1.0)
+		assert.NotNil(t, err)
+	}
+}
+
+type Echo struct {
+}
+
+func (this *Echo) Hello(arg string, reply *string) error {
+	*reply = "hello " + arg
+	return nil
+}
+
+func TestPeer(t *testing.T) {
+	conn1, conn2 := tcpPair(t)
+
+	peer1 := NewPeer(socket.NewStreamSocket(conn1), &testPayloadCodec{})
+	peer2 := NewPeer(socket.NewStreamSocket(conn2), &testPayloadCodec{})
+
+	assert.Nil(t, peer1.RegisterService(&Echo{}))
+	assert.Nil(t, peer2.RegisterService(&Echo{}))
+	//反向调用对端的Echo.Hello,处理函数在接收goroutine上执行,不能使用同步调用
+	assert.Nil(t, peer2.RegisterMethod("relay", func(replyer *RPCReplyer, arg interface{}) {
+		peer2.AsynCall("Echo.Hello", arg, time.Second, func(ret interface{}, err error) {
+			replyer.Reply(ret, err)
+		})
+	}))
+	assert.Nil(t, peer2.RegisterMethod("block", func(_ *RPCReplyer, _ interface{}) {
+		//不返回响应
+	}))
+
+	closed := make(chan struct{})
+	peer1.SetCloseCallBack(func(_ *Peer, reason string) {
+		close(closed)
+	})
+
+	peer1.Start(nil)
+	peer2.Start(nil)
+
+	{
+		r, err := peer1.Call("Echo.Hello", "peer1", time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello peer1", r)
+	}
+
+	{
+		r, err := peer2.Call("Echo.Hello", "peer2", time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello peer2", r)
+	}
+
+	{
+		//peer1 -> peer2 -> peer1
+		r, err := peer1.Call("relay", "relay", time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello relay", r)
+	}
+
+	{
+		//连接断开后未返回的调用立即失败
+		ch := make(chan error)
+		assert.Nil(t, peer1.AsynCall("block", nil, 10*time.Second, func(_ interface{}, err error) {
+			ch <- err
+		}))
+		peer2.Close("close", 0)
+		select {
+		case err := <-ch:
+			assert.Equal(t, ErrChannelClosed, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("pending call not failed after channel close")
+		}
+	}
+
+	<-closed
+
+	assert.True(t, peer1.IsClosed())
+
+	_, err := peer1.Call("Echo.Hello", "peer1", time.Second)
+	assert.Equal(t, ErrChannelClosed, err)
+}
+
+//丢弃所有消息的通道
+type blackholeChannel struct {
+	name string
+}
+
+func (this *blackholeChannel) SendRequest(message interface{}) error {
+	return nil
+}
+
+func (this *blackholeChannel) SendResponse(message interface{}) error {
+	return nil
+}
+
+func (this *blackholeChannel) Name() string {
+	return this.name
+}
+
+func TestOnChannelClose(t *testing.T) {
+	client := NewClient(&localCodec{}, &localCodec{})
+	channel1 := &blackholeChannel{name: "channel1"}
+	channel2 := &blackholeChannel{name: "channel2"}
+
+	errs := make(chan error, 3)
+	cb := func(_ interface{}, err error) {
+		errs <- err
+	}
+
+	assert.Nil(t, client.AsynCall(channel1, "hello", nil, 10*time.Second, cb))
+	assert.Nil(t, client.AsynCall(channel1, "hello", nil, 10*time.Second, cb))
+	assert.Nil(t, client.AsynCall(channel2, "hello", nil, 100*time.Millisecond, cb))
+	assert.Equal(t, int32(3), client.PendingCount())
+
+	beg := time.Now()
+	client.OnChannelClose(channel1)
+	assert.Equal(t, ErrChannelClosed, <-errs)
+	assert.Equal(t, ErrChannelClosed, <-errs)
+	assert.True(t, time.Now().Sub(beg) < time.Second)
+	assert.Equal(t, int32(1), client.PendingCount())
+
+	//其它通道上的调用不受影响
+	assert.Equal(t, ErrCallTimeout, <-errs)
+	assert.Equal(t, int32(0), client.PendingCount())
+
+	//超时后关闭不会重复回调
+	client.OnChannelClose(channel2)
+	select {
+	case <-errs:
+		t.Fatal("callback called twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type namedLocalChannel struct {
+	*localChannel
+	name string
+}
+
+func (this *namedLocalChannel) Name() string {
+	return this.name
+}
+
+func TestBalancer(t *testing.T) {
+	client := NewClient(&localCodec{}, &localCodec{})
+
+	channels := []*namedLocalChannel{}
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("server%d", i)
+		server := NewRPCServer(&localCodec{}, &localCodec{})
+		server.RegisterMethod("who", func(replyer *RPCReplyer, arg interface{}) {
+			replyer.Reply(name, nil)
+		})
+		channels = append(channels, &namedLocalChannel{
+			localChannel: &localChannel{server: server, client: client},
+			name:         name,
+		})
+	}
+
+	{
+		b := NewBalancer(client, RoundRobin)
+		_, err := b.Call("who", nil, time.Second)
+		assert.Equal(t, ErrNoAvailableChannel, err)
+
+		for _, v := range channels {
+			b.Add(v)
+		}
+
+		count := map[string]int{}
+		for i := 0; i < 6; i++ {
+			r, err := b.Call("who", nil, time.Second)
+			assert.Nil(t, err)
+			count[r.(string)]++
+		}
+		assert.Equal(t, map[string]int{"server0": 2, "server1": 2, "server2": 2}, count)
+
+		b.Remove(channels[1])
+		assert.Equal(t, 2, len(b.Channels()))
+		for i := 0; i < 4; i++ {
+			r, _ := b.Call("who", nil, time.Second)
+			assert.NotEqual(t, "server1", r.(string))
+		}
+	}
+
+	//连续失败的通道被摘除
+	{
+		b := NewBalancer(client, RoundRobin)
+		b.SetHealthCheck(1, time.Minute)
+		blackhole := &blackholeChannel{name: "blackhole"}
+		b.Add(blackhole)
+		b.Add(channels[0])
+
+		for i := 0; i < 2; i++ {
+			if _, err := b.Call("who", nil, 50*time.Millisecond); nil != err {
+				assert.Equal(t, ErrCallTimeout, err)
+			}
+		}
+		assert.False(t, b.IsHealthy(blackhole))
+		assert.True(t, b.IsHealthy(channels[0]))
+
+		for i := 0; i < 4; i++ {
+			r, err := b.Call("who", nil, time.Second)
+			assert.Nil(t, err)
+			assert.Equal(t, "server0", r.(string))
+		}
+	}
+
+	{
+		b := NewBalancer(client, LeastPending)
+		blackhole := &blackholeChannel{name: "blackhole"}
+		b.Add(blackhole)
+		b.Add(channels[2])
+		assert.Nil(t, b.AsynCall("who", nil, 100*time.Millisecond, func(interface{}, error) {}))
+		c, _ := b.Pick()
+		assert.Equal(t, RPCChannel(channels[2]), c)
+	}
+
+	{
+		b := NewBalancer(client, RandomWeighted)
+		b.Add(channels[0], 1)
+		b.Add(channels[1], 3)
+		count := map[RPCChannel]int{}
+		for i := 0; i < 4000; i++ {
+			c, _ := b.Pick()
+			count[c]++
+		}
+		assert.True(t, count[channels[1]] > 2*count[channels[0]])
+	}
+
+	{
+		b := NewBalancer(client, ConsistentHash)
+		for _, v := range channels {
+			b.Add(v)
+		}
+
+		keys := map[string]RPCChannel{}
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%d", i)
+			c, _ := b.Pick(key)
+			keys[key] = c
+			r, err := b.CallWithKey(key, "who", nil, time.Second)
+			assert.Nil(t, err)
+			assert.Equal(t, c.Name(), r.(string))
+		}
+
+		//移除通道只影响原本映射到该通道的key
+		b.Remove(channels[0])
+		for k, v := range keys {
+			c, _ := b.Pick(k)
+			if v != RPCChannel(channels[0]) {
+				assert.Equal(t, v, c)
+			} else {
+				assert.NotEqual(t, v, c)
+			}
+		}
+	}
+}
+
+type countingChannel struct {
+	RPCChannel
+	count int32
+}
+
+func (this *countingChannel) SendRequest(message interface{}) error {
+	atomic.AddInt32(&this.count, 1)
+	return this.RPCChannel.SendRequest(message)
+}
+
+func TestRetry(t *testing.T) {
+	server := NewRPCServer(&localCodec{}, &localCodec{})
+
+	var flaky int32
+	server.RegisterMethod("flaky", func(replyer *RPCReplyer, arg interface{}) {
+		if atomic.AddInt32(&flaky, 1) < 3 {
+			replyer.Reply(nil, NewStatus(CodeOverloaded, "overloaded"))
+		} else {
+			replyer.Reply("ok", nil)
+		}
+	})
+
+	var slow int32
+	server.RegisterMethod("slow", func(replyer *RPCReplyer, arg interface{}) {
+		if atomic.AddInt32(&slow, 1) == 1 {
+			go func() {
+				time.Sleep(500 * time.Millisecond)
+				replyer.Reply("slow", nil)
+			}()
+		} else {
+			replyer.Reply("fast", nil)
+		}
+	})
+
+	local := newLocalChannel(server)
+	client := local.client
+	channel := &countingChannel{RPCChannel: local}
+
+	//过载的请求没有被执行,非幂等方法也可以重试
+	{
+		client.SetRetryPolicy("flaky", &RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond})
+		r, err := client.Call(channel, "flaky", nil, time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, "ok", r.(string))
+		assert.Equal(t, int32(3), atomic.LoadInt32(&channel.count))
+	}
+
+	//超时的请求可能已经执行,只有幂等方法重试
+	{
+		blackhole := &countingChannel{RPCChannel: &blackholeChannel{name: "blackhole"}}
+		client.SetRetryPolicy("hello", &RetryPolicy{MaxAttempts: 3})
+		_, err := client.Call(blackhole, "hello", nil, 20*time.Millisecond)
+		assert.Equal(t, ErrCallTimeout, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&blackhole.count))
+
+		client.SetRetryPolicy("hello", &RetryPolicy{MaxAttempts: 3, Idempotent: true})
+		_, err = client.Call(blackhole, "hello", nil, 20*time.Millisecond)
+		assert.Equal(t, ErrCallTimeout, err)
+		assert.Equal(t, int32(4), atomic.LoadInt32(&blackhole.count))
+		client.SetRetryPolicy("hello", nil)
+	}
+
+	//对冲
+	{
+		client.SetRetryPolicy("slow", &RetryPolicy{MaxAttempts: 2, Idempotent: true, HedgeDelay: 50 * time.Millisecond})
+		beg := time.Now()
+		r, err := client.Call(channel, "slow", nil, time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, "fast", r.(string))
+		assert.True(t, time.Now().Sub(beg) < 400*time.Millisecond)
+	}
+
+	//熔断
+	{
+		client.SetCircuitBreaker(2, 100*time.Millisecond)
+		blackhole := &countingChannel{RPCChannel: &blackholeChannel{name: "blackhole"}}
+		for i := 0; i < 2; i++ {
+			_, err := client.Call(blackhole, "hello", nil, 20*time.Millisecond)
+			assert.Equal(t, ErrCallTimeout, err)
+		}
+		assert.Equal(t, BreakerOpen, client.GetCircuitBreaker(blackhole).State())
+
+		_, err := client.Call(blackhole, "hello", nil, 20*time.Millisecond)
+		assert.Equal(t, ErrCircuitOpen, err)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&blackhole.count))
+
+		//半开状态只放行一个探测调用
+		time.Sleep(150 * time.Millisecond)
+		assert.Equal(t, BreakerHalfOpen, client.GetCircuitBreaker(blackhole).State())
+		assert.Nil(t, client.AsynCall(blackhole, "hello", nil, 20*time.Millisecond, func(interface{}, error) {}))
+		assert.Equal(t, ErrCircuitOpen, client.AsynCall(blackhole, "hello", nil, 20*time.Millisecond, func(interface{}, error) {}))
+
+		//其它通道不受影响
+		r, err := client.Call(channel, "flaky", nil, time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, "ok", r.(string))
+		assert.Equal(t, BreakerClosed, client.GetCircuitBreaker(channel).State())
+		client.SetCircuitBreaker(0, 0)
+	}
+}
+
+func TestServerLimit(t *testing.T) {
+	server := NewRPCServer(&localCodec{}, &localCodec{})
+	replyers := make(chan *RPCReplyer, 10)
+	server.RegisterMethod("hold", func(replyer *RPCReplyer, arg interface{}) {
+		replyers <- replyer
+	})
+	server.RegisterMethod("echo", func(replyer *RPCReplyer, arg interface{}) {
+		replyer.Reply(arg, nil)
+	})
+
+	channel := newLocalChannel(server)
+	client := channel.client
+
+	server.SetConcurrencyLimit(2)
+	server.SetQueueSize(1)
+
+	errs := make(chan error, 10)
+	cb := func(_ interface{}, err error) {
+		errs <- err
+	}
+
+	assert.Nil(t, client.AsynCall(channel, "hold", nil, time.Second, cb))
+	assert.Nil(t, client.AsynCall(channel, "hold", nil, time.Second, cb))
+	r1 := <-replyers
+	r2 := <-replyers
+
+	assert.Nil(t, client.AsynCall(channel, "hold", nil, time.Second, cb))
+	for server.QueueLength() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	//队列已满,直接拒绝
+	_, err := client.Call(channel, "echo", 1, time.Second)
+	assert.Equal(t, CodeOverloaded, CodeOf(err))
+	assert.Equal(t, int32(3), server.PendingCount())
+
+	//处理完成后调度队列中的请求
+	r1.Reply(nil, nil)
+	assert.Nil(t, <-errs)
+	r3 := <-replyers
+	assert.Equal(t, 0, server.QueueLength())
+
+	r2.Reply(nil, nil)
+	r3.Reply(nil, nil)
+	assert.Nil(t, <-errs)
+	assert.Nil(t, <-errs)
+	assert.Equal(t, int32(0), server.PendingCount())
+
+	//方法并发上限不影响其它方法
+	server.SetConcurrencyLimit(0)
+	server.SetQueueSize(0)
+	server.SetMethodConcurrencyLimit("hold", 1)
+	assert.Nil(t, client.AsynCall(channel, "hold", nil, time.Second, cb))
+	r1 = <-replyers
+	_, err = client.Call(channel, "hold", nil, time.Second)
+	assert.Equal(t, ErrServerOverloaded.Error(), err.Error())
+	r, err := client.Call(channel, "echo", 1, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, r.(int))
+	r1.Reply(nil, nil)
+	assert.Nil(t, <-errs)
+
+	//在eventQueue中执行处理函数
+	server.SetMethodConcurrencyLimit("hold", 0)
+	queue := event.NewEventQueue()
+	go queue.Run()
+	defer queue.Close()
+	server.SetEventQueue(queue)
+	done := make(chan struct{})
+	queue.PostNoWait(func() {
+		<-done
+	})
+	assert.Nil(t, client.AsynCall(channel, "echo", 2, time.Second, cb))
+	select {
+	case <-errs:
+		t.Fatal("handler should run on eventQueue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(done)
+	assert.Nil(t, <-errs)
+	server.SetEventQueue(nil)
+}
+
+func TestServerShutdown(t *testing.T) {
+	server := NewRPCServer(&localCodec{}, &localCodec{})
+	replyers := make(chan *RPCReplyer, 10)
+	server.RegisterMethod("hold", func(replyer *RPCReplyer, arg interface{}) {
+		replyers <- replyer
+	})
+
+	channel := newLocalChannel(server)
+	client := channel.client
+
+	errs := make(chan error, 10)
+	cb := func(_ interface{}, err error) {
+		errs <- err
+	}
+
+	assert.Nil(t, client.AsynCall(channel, "hold", nil, time.Second, cb))
+	assert.Nil(t, client.AsynCall(channel, "hold", nil, time.Second, cb))
+	r1 := <-replyers
+	r2 := <-replyers
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- server.Shutdown(ctx)
+	}()
+
+	for !server.IsShuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+
+	//拒绝新的请求
+	_, err := client.Call(channel, "hold", nil, time.Second)
+	assert.Equal(t, CodeShuttingDown, CodeOf(err))
+
+	r1.Reply(nil, nil)
+	assert.Nil(t, <-errs)
+
+	err = <-done
+	assert.NotNil(t, err)
+	assert.Equal(t, context.DeadlineExceeded, err.(*ShutdownError).Err)
+	assert.Equal(t, 1, len(err.(*ShutdownError).Abandoned))
+	assert.Equal(t, "hold", err.(*ShutdownError).Abandoned[0].Method)
+	assert.Equal(t, r2.req.Seq, err.(*ShutdownError).Abandoned[0].Seq)
+
+	//超时放弃的请求仍可以返回响应
+	r2.Reply(nil, nil)
+	assert.Nil(t, <-errs)
+	assert.Equal(t, int32(0), server.PendingCount())
+	assert.Nil(t, server.Shutdown(context.Background()))
+}
+
+func TestJSONRPC(t *testing.T) {
+	codec := NewJSONRPCCodec()
+	server := NewRPCServer(codec, codec)
+	server.RegisterService(&Arith{})
+	server.RegisterService(&Echo{})
+	notified := make(chan json.RawMessage, 1)
+	server.RegisterMethod("notify", func(replyer *RPCReplyer, arg interface{}) {
+		notified <- arg.(json.RawMessage)
+		replyer.Reply(nil, nil)
+	})
+	server.RegisterMethod("drop", func(replyer *RPCReplyer, arg interface{}) {
+		replyer.DropResponse()
+	})
+
+	serverConn, clientConn := tcpPair(t)
+	serverChannel := NewJSONRPCChannel(socket.NewStreamSocket(serverConn))
+	serverChannel.SetServer(server)
+	serverChannel.Start(func(event *kendynet.Event) {
+		if event.EventType == kendynet.EventTypeError {
+			event.Session.Close(event.Data.(error).Error(), 0)
+		}
+	})
+
+	//通过JSONRPCChannel调用
+	{
+		conn, peerConn := tcpPair(t)
+		peer := NewJSONRPCChannel(socket.NewStreamSocket(peerConn))
+		peer.SetServer(server)
+		peer.Start(func(event *kendynet.Event) {})
+
+		client := NewClient(NewJSONRPCCodec(), NewJSONRPCCodec())
+		channel := NewJSONRPCChannel(socket.NewStreamSocket(conn))
+		channel.SetClient(client)
+		channel.Start(func(event *kendynet.Event) {})
+
+		r, err := client.Call(channel, "Arith.Add", &ArithArg{A: 1, B: 2}, time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, "3", string(r.(json.RawMessage)))
+
+		r, err = client.Call(channel, "Echo.Hello", "world", time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, `"hello world"`, string(r.(json.RawMessage)))
+
+		_, err = client.Call(channel, "Arith.Div", &ArithArg{A: 1, B: 0}, time.Second)
+		assert.Equal(t, "divide by zero", err.Error())
+
+		_, err = client.Call(channel, "Arith.Mul", nil, time.Second)
+		assert.True(t, IsCode(err, CodeMissingMethod))
+
+		assert.Nil(t, client.Post(channel, "notify", []int{1, 2}))
+		assert.Equal(t, "[1,2]", string(<-notified))
+
+		channel.GetSession().Close("test", 0)
+	}
+
+	//按行读写原始json
+	reader := bufio.NewReader(clientConn)
+	call := func(req string) string {
+		_, err := clientConn.Write([]byte(req + "\n"))
+		assert.Nil(t, err)
+		clientConn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := reader.ReadString('\n')
+		assert.Nil(t, err)
+		return strings.TrimSpace(line)
+	}
+
+	assert.Equal(t, `{"jsonrpc":"2.0","result":3,"id":"a"}`, call(`{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2},"id":"a"}`))
+	assert.Equal(t, `{"jsonrpc":"2.0","result":"hello kendynet","id":7}`, call(`{"jsonrpc":"2.0","method":"Echo.Hello","params":["kendynet"],"id":7}`))
+	assert.Equal(t, `{"jsonrpc":"2.0","error":{"code":-32601,"message":"invaild method:Foo"},"id":1}`, call(`{"jsonrpc":"2.0","method":"Foo","id":1}`))
+	assert.Equal(t, `{"jsonrpc":"2.0","error":{"code":-32602,"message":"params must be object or array"},"id":2}`, call(`{"jsonrpc":"2.0","method":"Arith.Add","params":1,"id":2}`))
+	assert.Equal(t, `{"jsonrpc":"2.0","error":{"code":-32700,"message":"parse error"},"id":null}`, call(`{"jsonrpc":"2.0","method"`))
+	assert.Equal(t, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"empty batch"},"id":null}`, call(`[]`))
+
+	//批量请求,通知没有响应
+	var batch []map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(call(`[`+
+		`{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2},"id":1},`+
+		`{"jsonrpc":"2.0","method":"notify","params":[3]},`+
+		`{"jsonrpc":"1.0","method":"Arith.Add","id":2},`+
+		`{"jsonrpc":"2.0","method":"Echo.Hello","params":["batch"],"id":"3"}`+
+		`]`)), &batch))
+	assert.Equal(t, "[3]", string(<-notified))
+	assert.Equal(t, 3, len(batch))
+	results := map[string]interface{}{}
+	for _, v := range batch {
+		if e, ok := v["error"]; ok {
+			results[fmt.Sprint(v["id"])] = e.(map[string]interface{})["code"]
+		} else {
+			results[fmt.Sprint(v["id"])] = v["result"]
+		}
+	}
+	assert.Equal(t, map[string]interface{}{"1": float64(3), "2": float64(JSONRPCInvalidRequest), "3": "hello batch"}, results)
+
+	//批量中DropResponse的请求不阻塞其它响应
+	assert.Equal(t, `[{"jsonrpc":"2.0","result":"hello a","id":"a"}]`, call(`[`+
+		`{"jsonrpc":"2.0","method":"drop","id":"d"},`+
+		`{"jsonrpc":"2.0","method":"Echo.Hello","params":["a"],"id":"a"}`+
+		`]`))
+	//全部DropResponse时不发送响应
+	_, err := clientConn.Write([]byte(`[{"jsonrpc":"2.0","method":"drop","id":"e"}]` + "\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"jsonrpc":"2.0","result":"hello b","id":"b"}`, call(`{"jsonrpc":"2.0","method":"Echo.Hello","params":["b"],"id":"b"}`))
+	call(`{"jsonrpc":"2.0","method":"drop","id":"f"}` + "\n" + `{"jsonrpc":"2.0","method":"Echo.Hello","params":["c"],"id":"c"}`)
+	//DropResponse释放id映射
+	codec.Lock()
+	assert.Equal(t, 0, len(codec.ids))
+	codec.Unlock()
+
+	clientConn.Close()
+}
+
+func TestClientClose(t *testing.T) {
+	client := NewClient(&localCodec{}, &localCodec{})
+	client.SetTimerMgr(timer.NewTimerMgr(1))
+	channel := &blackholeChannel{name: "blackhole"}
+
+	errs := make(chan error, 2)
+	cb := func(_ interface{}, err error) {
+		errs <- err
+	}
+
+	assert.Nil(t, client.AsynCall(channel, "hello", nil, 10*time.Second, cb))
+	assert.Nil(t, client.AsynCall(channel, "hello", nil, 10*time.Second, cb))
+	assert.Equal(t, int32(2), client.PendingCount())
+
+	beg := time.Now()
+	client.Close()
+	assert.Equal(t, ErrClientClosed, <-errs)
+	assert.Equal(t, ErrClientClosed, <-errs)
+	assert.True(t, time.Now().Sub(beg) < time.Second)
+	assert.Equal(t, int32(0), client.PendingCount())
+	assert.True(t, client.IsClosed())
+
+	assert.Equal(t, ErrClientClosed, client.AsynCall(channel, "hello", nil, time.Second, cb))
+	assert.Equal(t, ErrClientClosed, client.Post(channel, "hello", nil))
+
+	//每个客户端有独立的序号空间及TimerMgr
+	client1 := NewClient(&localCodec{}, &localCodec{})
+	client2 := NewClient(&localCodec{}, &localCodec{})
+	client1.Post(channel, "hello", nil)
+	client2.Post(channel, "hello", nil)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&client1.sequence))
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&client2.sequence))
+	assert.True(t, client1.getTimerMgr() != client2.getTimerMgr())
+	client1.Close()
+	client2.Close()
+
+	//等待重试的调用在Close时失败,重试定时器被取消
+	c := clock.NewFake()
+	client = NewClient(&localCodec{}, &localCodec{})
+	client.SetClock(c)
+	client.SetRetryPolicy("hello", &RetryPolicy{MaxAttempts: 3, Backoff: time.Minute, Idempotent: true})
+	assert.Nil(t, client.AsynCall(channel, "hello", nil, time.Second, cb))
+	assert.Equal(t, 1, c.Pending())
+	c.Advance(time.Second)
+	//第一次尝试超时,等待重试
+	assert.Equal(t, 1, c.Pending())
+	client.Close()
+	assert.Equal(t, ErrClientClosed, <-errs)
+	assert.Equal(t, 0, c.Pending())
+	c.Advance(time.Hour)
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, 0, len(client.retries))
+}
+
+func TestBatch(t *testing.T) {
+	server := NewRPCServer(&localCodec{}, &localCodec{})
+	replyers := make(chan *RPCReplyer, 10)
+	posted := make(chan interface{}, 10)
+	server.RegisterMethod("hold", func(replyer *RPCReplyer, arg interface{}) {
+		replyers <- replyer
+	})
+	server.RegisterMethod("echo", func(replyer *RPCReplyer, arg interface{}) {
+		replyer.Reply(arg, nil)
+	})
+	server.RegisterMethod("post", func(replyer *RPCReplyer, arg interface{}) {
+		posted <- arg
+		replyer.Reply(nil, nil)
+	})
+
+	channel := newLocalChannel(server)
+	client := channel.client
+
+	results := make(chan interface{}, 10)
+	cb := func(ret interface{}, err error) {
+		if nil != err {
+			results <- err
+		} else {
+			results <- ret
+		}
+	}
+
+	{
+		//默认并发处理,echo不等待hold完成
+		batch := client.NewBatch(channel)
+		batch.Call("hold", nil, time.Second, cb)
+		batch.Call("echo", 1, time.Second, cb)
+		batch.Post("post", 2)
+		batch.Call("missing", nil, time.Second, cb)
+		assert.Equal(t, 4, batch.Len())
+		assert.Nil(t, batch.Flush())
+		assert.Equal(t, 0, batch.Len())
+		assert.Equal(t, 2, <-posted)
+
+		r := <-replyers
+		got := []interface{}{<-results, <-results}
+		assert.Contains(t, got, 1)
+		r.Reply("hold", nil)
+		assert.Equal(t, "hold", <-results)
+		for _, v := range got {
+			if err, ok := v.(error); ok {
+				assert.Equal(t, CodeMissingMethod, CodeOf(err))
+			}
+		}
+	}
+
+	{
+		//按顺序处理,hold完成前不处理echo
+		server.SetBatchMode(BatchInOrder)
+		batch := client.NewBatch(channel)
+		batch.Call("hold", nil, time.Second, cb)
+		batch.Call("echo", 1, time.Second, cb)
+		assert.Nil(t, batch.Flush())
+		r := <-replyers
+		select {
+		case <-results:
+			t.Fatal("echo should wait for hold")
+		case <-time.After(50 * time.Millisecond):
+		}
+		r.Reply("hold", nil)
+		got := []interface{}{<-results, <-results}
+		assert.Contains(t, got, "hold")
+		assert.Contains(t, got, 1)
+	}
+
+	{
+		//同步完成的请求不会递归
+		c := make(chan interface{}, 1000)
+		batch := client.NewBatch(channel)
+		for i := 0; i < 1000; i++ {
+			batch.Call("echo", i, time.Second, func(ret interface{}, err error) {
+				c <- ret
+			})
+		}
+		assert.Nil(t, batch.Flush())
+		for i := 0; i < 1000; i++ {
+			<-c
+		}
+		assert.Equal(t, int32(0), server.PendingCount())
+	}
+
+	{
+		//超时按调用分别计算
+		server.SetBatchMode(BatchConcurrent)
+		batch := client.NewBatch(channel)
+		batch.Call("hold", nil, 10*time.Millisecond, cb)
+		batch.Call("echo", 1, time.Second, cb)
+		assert.Nil(t, batch.Flush())
+		got := []interface{}{<-results, <-results}
+		assert.Contains(t, got, 1)
+		assert.Contains(t, got, ErrCallTimeout)
+		(<-replyers).DropResponse()
+	}
+
+	{
+		//json编码为数组
+		b, err := NewJSONRPCCodec().Encode(&RPCBatchRequest{Requests: []*RPCRequest{
+			&RPCRequest{Seq: 1, Method: "echo", NeedResp: true, Arg: 1},
+			&RPCRequest{Seq: 2, Method: "post"},
+		}})
+		assert.Nil(t, err)
+		assert.Equal(t, `[{"jsonrpc":"2.0","method":"echo","params":[1],"id":1},{"jsonrpc":"2.0","method":"post"}]`, string(b.([]byte)))
+	}
+
+	{
+		//整个批量只计为熔断器的一次调用
+		client.SetCircuitBreaker(2, 100*time.Millisecond)
+		blackhole := &blackholeChannel{name: "blackhole"}
+		flush := func() {
+			batch := client.NewBatch(blackhole)
+			batch.Call("hello", nil, 10*time.Millisecond, cb)
+			batch.Call("hello", nil, 10*time.Millisecond, cb)
+			assert.Nil(t, batch.Flush())
+			assert.Equal(t, ErrCallTimeout, <-results)
+			assert.Equal(t, ErrCallTimeout, <-results)
+		}
+		flush()
+		assert.Equal(t, BreakerClosed, client.GetCircuitBreaker(blackhole).State())
+		flush()
+		assert.Equal(t, BreakerOpen, client.GetCircuitBreaker(blackhole).State())
+
+		//半开状态放行的批量失败后重新打开
+		time.Sleep(150 * time.Millisecond)
+		flush()
+		assert.Equal(t, BreakerOpen, client.GetCircuitBreaker(blackhole).State())
+		client.SetCircuitBreaker(0, 0)
+	}
+
+	client.Close()
+	batch := client.NewBatch(channel)
+	batch.Call("echo", 1, time.Second, cb)
+	assert.Equal(t, ErrClientClosed, batch.Flush())
+
+	testBatchStream(t)
+}
+
+//通过StreamChannel/Peer发送的批量请求交给RPCServer处理
+func testBatchStream(t *testing.T) {
+	flush := func(client *RPCClient, channel RPCChannel) {
+		results := make(chan interface{}, 2)
+		cb := func(ret interface{}, err error) {
+			if nil != err {
+				results <- err
+			} else {
+				results <- ret
+			}
+		}
+		batch := client.NewBatch(channel)
+		batch.Call("Echo.Hello", "a", time.Second, cb)
+		batch.Call("Echo.Hello", "b", time.Second, cb)
+		assert.Nil(t, batch.Flush())
+		got := []interface{}{<-results, <-results}
+		assert.Contains(t, got, "hello a")
+		assert.Contains(t, got, "hello b")
+	}
+
+	{
+		server := NewRPCServer(&StreamRPCCodec{}, &StreamRPCCodec{})
+		server.RegisterService(&Echo{})
+
+		serverConn, clientConn := tcpPair(t)
+		appMsg := make(chan interface{}, 1)
+
+		serverChannel := NewStreamChannel(socket.NewStreamSocket(serverConn), &testPayloadCodec{})
+		serverChannel.SetServer(server)
+		serverChannel.Start(func(event *kendynet.Event) {
+			if event.EventType == kendynet.EventTypeError {
+				event.Session.Close(event.Data.(error).Error(), 0)
+			} else {
+				appMsg <- event.Data
+			}
+		})
+
+		client := NewClient(&StreamRPCCodec{}, &StreamRPCCodec{})
+		clientChannel := NewStreamChannel(socket.NewStreamSocket(clientConn), &testPayloadCodec{})
+		clientChannel.SetClient(client)
+		clientChannel.Start(func(event *kendynet.Event) {
+			if event.EventType == kendynet.EventTypeError {
+				event.Session.Close(event.Data.(error).Error(), 0)
+			}
+		})
+
+		flush(client, clientChannel)
+		assert.Equal(t, 0, len(appMsg))
+		clientChannel.GetSession().Close("test", 0)
+	}
+
+	{
+		conn1, conn2 := tcpPair(t)
+		peer1 := NewPeer(socket.NewStreamSocket(conn1), &testPayloadCodec{})
+		peer2 := NewPeer(socket.NewStreamSocket(conn2), &testPayloadCodec{})
+		assert.Nil(t, peer2.RegisterService(&Echo{}))
+		peer1.Start(nil)
+		peer2.Start(nil)
+
+		flush(peer1.GetClient(), peer1.GetChannel())
+		peer1.Close("test", 0)
+	}
+}
+
+func TestBuiltinMethods(t *testing.T) {
+	server := NewRPCServer(&localCodec{}, &localCodec{})
+	replyers := make(chan *RPCReplyer, 10)
+	server.RegisterMethod("hold", func(replyer *RPCReplyer, arg interface{}) {
+		replyers <- replyer
+	})
+	server.RegisterMethod("echo", func(replyer *RPCReplyer, arg interface{}) {
+		if nil == arg {
+			replyer.Reply(nil, fmt.Errorf("nil arg"))
+		} else {
+			replyer.Reply(arg, nil)
+		}
+	})
+	assert.Nil(t, server.RegisterService(&Arith{}))
+	assert.NotNil(t, server.RegisterMethod(BuiltinHealth, func(replyer *RPCReplyer, arg interface{}) {}))
+	assert.NotNil(t, server.RegisterMethod("rpc.foo", func(replyer *RPCReplyer, arg interface{}) {}))
+
+	channel := newLocalChannel(server)
+	client := channel.client
+
+	r, err := client.Call(channel, BuiltinListMethods, nil, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Arith.Add", "Arith.Div", "echo", "hold"}, r)
+
+	r, err = client.Call(channel, BuiltinHealth, nil, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, HealthServing, r)
+
+	//内置方法不受并发上限限制
+	server.SetConcurrencyLimit(1)
+	assert.Nil(t, client.AsynCall(channel, "hold", nil, time.Second, func(_ interface{}, _ error) {}))
+	hold := <-replyers
+	_, err = client.Call(channel, "echo", 1, time.Second)
+	assert.Equal(t, CodeOverloaded, CodeOf(err))
+	server.SetConcurrencyLimit(0)
+
+	_, err = client.Call(channel, "echo", 1, time.Second)
+	assert.Nil(t, err)
+	_, err = client.Call(channel, "echo", nil, time.Second)
+	assert.NotNil(t, err)
+
+	r, err = client.Call(channel, BuiltinStats, nil, time.Second)
+	assert.Nil(t, err)
+	stats := r.(*ServerStats)
+	assert.Equal(t, int32(2), stats.Pending) //hold及rpc.stats本身
+	assert.Equal(t, int32(1), stats.Methods["hold"].Pending)
+	assert.Equal(t, uint64(0), stats.Methods["hold"].Calls)
+	assert.Equal(t, uint64(3), stats.Methods["echo"].Calls)
+	assert.Equal(t, uint64(2), stats.Methods["echo"].Errors)
+	assert.Equal(t, uint64(0), stats.Methods["Arith.Add"].Calls)
+	_, ok := stats.Methods[BuiltinStats]
+	assert.False(t, ok)
+
+	hold.Reply(nil, nil)
+	stats = server.Stats()
+	assert.Equal(t, int32(0), stats.Methods["hold"].Pending)
+	assert.Equal(t, uint64(1), stats.Methods["hold"].Calls)
+
+	server.SetHealthCheck(func() error {
+		return fmt.Errorf("db down")
+	})
+	_, err = client.Call(channel, BuiltinHealth, nil, time.Second)
+	assert.Equal(t, CodeUnavailable, CodeOf(err))
+	assert.Equal(t, "db down", err.Error())
+
+	server.SetHealthCheck(nil)
+	assert.Nil(t, server.Shutdown(context.Background()))
+	_, err = client.Call(channel, BuiltinHealth, nil, time.Second)
+	assert.Equal(t, CodeShuttingDown, CodeOf(err))
+}
+
+func TestDedup(t *testing.T) {
+	server := NewRPCServer(&localCodec{}, &localCodec{})
+	var count int32
+	replyers := make(chan *RPCReplyer, 10)
+	server.RegisterMethod("incr", func(replyer *RPCReplyer, arg interface{}) {
+		replyer.Reply(atomic.AddInt32(&count, 1), nil)
+	})
+	server.RegisterMethod("hold", func(replyer *RPCReplyer, arg interface{}) {
+		replyers <- replyer
+	})
+
+	channel := newLocalChannel(server)
+	client := channel.client
+
+	//未启用去重
+	client.CallWithRequestID(channel, "a", "incr", nil, time.Second)
+	client.CallWithRequestID(channel, "a", "incr", nil, time.Second)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+
+	server.SetDedup(time.Second, 2)
+
+	r, err := client.CallWithRequestID(channel, "a", "incr", nil, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), r)
+	r, err = client.CallWithRequestID(channel, "a", "incr", nil, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), r)
+
+	//不同的方法或没有RequestID不去重
+	client.CallWithRequestID(channel, "a", "hold", nil, 10*time.Millisecond)
+	(<-replyers).DropResponse()
+	r, _ = client.Call(channel, "incr", nil, time.Second)
+	assert.Equal(t, int32(4), r)
+
+	//处理中的重复请求等待第一次请求的结果
+	results := make(chan interface{}, 2)
+	cb := func(ret interface{}, err error) {
+		results <- ret
+	}
+	assert.Nil(t, client.AsynCallWithRequestID(channel, "b", "hold", nil, time.Second, cb))
+	hold := <-replyers
+	assert.Nil(t, client.AsynCallWithRequestID(channel, "b", "hold", nil, time.Second, cb))
+	for server.PendingCount() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	hold.Reply("b", nil)
+	assert.Equal(t, "b", <-results)
+	assert.Equal(t, "b", <-results)
+	assert.Equal(t, 0, len(replyers))
+
+	//没有被执行的请求不缓存
+	server.SetConcurrencyLimit(1)
+	assert.Nil(t, client.AsynCall(channel, "hold", nil, time.Second, cb))
+	hold = <-replyers
+	_, err = client.CallWithRequestID(channel, "c", "incr", nil, time.Second)
+	assert.Equal(t, CodeOverloaded, CodeOf(err))
+	hold.Reply(nil, nil)
+	<-results
+	server.SetConcurrencyLimit(0)
+	r, err = client.CallWithRequestID(channel, "c", "incr", nil, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(5), r)
+
+	//已完成的条目数量不超过maxEntries
+	client.CallWithRequestID(channel, "d", "incr", nil, time.Second)
+	client.CallWithRequestID(channel, "e", "incr", nil, time.Second)
+	assert.Equal(t, 2, server.DedupLength())
+	r, _ = client.CallWithRequestID(channel, "a", "incr", nil, time.Second)
+	assert.Equal(t, int32(8), r)
+
+	//超过window后重新执行
+	server.SetDedup(20*time.Millisecond, 0)
+	r, _ = client.CallWithRequestID(channel, "f", "incr", nil, time.Second)
+	assert.Equal(t, int32(9), r)
+	r, _ = client.CallWithRequestID(channel, "f", "incr", nil, time.Second)
+	assert.Equal(t, int32(9), r)
+	time.Sleep(30 * time.Millisecond)
+	r, _ = client.CallWithRequestID(channel, "f", "incr", nil, time.Second)
+	assert.Equal(t, int32(10), r)
+
+	//处理中的条目计入maxEntries,没有可以淘汰的条目时拒绝新的请求
+	server.SetDedup(time.Second, 2)
+	assert.Nil(t, client.AsynCallWithRequestID(channel, "h1", "hold", nil, time.Second, cb))
+	h1 := <-replyers
+	assert.Nil(t, client.AsynCallWithRequestID(channel, "h2", "hold", nil, time.Second, cb))
+	h2 := <-replyers
+	_, err = client.CallWithRequestID(channel, "h3", "hold", nil, time.Second)
+	assert.Equal(t, CodeResourceExhausted, CodeOf(err))
+	assert.Equal(t, 0, len(replyers))
+	assert.Equal(t, 2, server.DedupLength())
+	h1.Reply("h1", nil)
+	assert.Equal(t, "h1", <-results)
+	//淘汰已完成的h1
+	assert.Nil(t, client.AsynCallWithRequestID(channel, "h3", "hold", nil, time.Second, cb))
+	h3 := <-replyers
+	assert.Equal(t, 2, server.DedupLength())
+	h2.Reply("h2", nil)
+	h3.Reply("h3", nil)
+	<-results
+	<-results
+
+	//等待的重复请求不超过maxWaiters
+	server.SetDedup(time.Second, 0, 1)
+	assert.Nil(t, client.AsynCallWithRequestID(channel, "w", "hold", nil, time.Second, cb))
+	hold = <-replyers
+	assert.Nil(t, client.AsynCallWithRequestID(channel, "w", "hold", nil, time.Second, cb))
+	for server.PendingCount() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = client.CallWithRequestID(channel, "w", "hold", nil, time.Second)
+	assert.Equal(t, CodeResourceExhausted, CodeOf(err))
+	hold.Reply("w", nil)
+	assert.Equal(t, "w", <-results)
+	assert.Equal(t, "w", <-results)
+	assert.Equal(t, 0, len(replyers))
+
+	b, err := NewJSONRPCCodec().Encode(&RPCRequest{Seq: 1, Method: "incr", NeedResp: true, RequestID: "g"})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"jsonrpc":"2.0","method":"incr","id":1,"requestId":"g"}`, string(b.([]byte)))
+	req, err := NewJSONRPCCodec().Decode(b)
+	assert.Nil(t, err)
+	assert.Equal(t, "g", req.(*RPCRequest).RequestID)
+}
+
+func TestClock(t *testing.T) {
+	c := clock.NewFake()
+	client := NewClient(&localCodec{}, &localCodec{})
+	client.SetClock(c)
+
+	errs := make(chan error, 10)
+	cb := func(_ interface{}, err error) {
+		errs <- err
+	}
+
+	//超时回调在Advance中执行
+	{
+		blackhole := &blackholeChannel{name: "blackhole"}
+		assert.Nil(t, client.AsynCall(blackhole, "hello", nil, 10*time.Second, cb))
+		c.Advance(10*time.Second - time.Millisecond)
+		assert.Equal(t, 0, len(errs))
+		c.Advance(time.Millisecond)
+		assert.Equal(t, 1, len(errs))
+		assert.Equal(t, ErrCallTimeout, <-errs)
+		assert.Equal(t, int32(0), client.PendingCount())
+	}
+
+	//重试间隔
+	{
+		blackhole := &countingChannel{RPCChannel: &blackholeChannel{name: "blackhole"}}
+		client.SetRetryPolicy("hello", &RetryPolicy{MaxAttempts: 2, Idempotent: true, Backoff: time.Second})
+		assert.Nil(t, client.AsynCall(blackhole, "hello", nil, 100*time.Millisecond, cb))
+		c.Advance(100 * time.Millisecond)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&blackhole.count))
+		c.Advance(time.Second)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&blackhole.count))
+		c.Advance(100 * time.Millisecond)
+		assert.Equal(t, ErrCallTimeout, <-errs)
+		client.SetRetryPolicy("hello", nil)
+	}
+
+	//熔断
+	{
+		client.SetCircuitBreaker(1, time.Minute)
+		blackhole := &blackholeChannel{name: "blackhole"}
+		assert.Nil(t, client.AsynCall(blackhole, "hello", nil, time.Second, cb))
+		c.Advance(time.Second)
+		assert.Equal(t, ErrCallTimeout, <-errs)
+		assert.Equal(t, BreakerOpen, client.GetCircuitBreaker(blackhole).State())
+		c.Advance(time.Minute - time.Millisecond)
+		assert.Equal(t, BreakerOpen, client.GetCircuitBreaker(blackhole).State())
+		c.Advance(time.Millisecond)
+		assert.Equal(t, BreakerHalfOpen, client.GetCircuitBreaker(blackhole).State())
+		client.SetCircuitBreaker(0, 0)
+	}
+
+	//服务端统计
+	{
+		server := NewRPCServer(&localCodec{}, &localCodec{})
+		server.SetClock(c)
+		var replyer *RPCReplyer
+		called := make(chan struct{})
+		server.RegisterMethod("hello", func(r *RPCReplyer, arg interface{}) {
+			replyer = r
+			close(called)
+		})
+		local := newLocalChannel(server)
+		local.client.SetClock(c)
+		done := make(chan interface{})
+		assert.Nil(t, local.client.AsynCall(local, "hello", nil, time.Hour, func(r interface{}, err error) {
+			done <- r
+		}))
+		<-called
+		c.Advance(time.Second)
+		replyer.Reply("world", nil)
+		assert.Equal(t, "world", <-done)
+		stats := server.Stats().Methods["hello"]
+		assert.Equal(t, time.Second, stats.MaxTime)
+		assert.Equal(t, c.Now(), stats.LastCallEnd)
+	}
+}
@@ -3,35 +3,53 @@ package rpc
 import (
 	"fmt"
 	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/clock"
 	"github.com/sniperHW/kendynet/util"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type RPCReplyer struct {
-	encoder RPCMessageEncoder
-	channel RPCChannel
-	req     *RPCRequest
-	fired   int32 //防止重复Reply
-	s       *RPCServer
+	encoder  RPCMessageEncoder
+	channel  RPCChannel
+	req      *RPCRequest
+	fired    int32 //防止重复Reply
+	s        *RPCServer
+	admitted bool //是否占用了并发数
+	ml       *methodLimit
+	onDone   func()
+	stats    *methodStats
+	failed   bool
+	dedup    *dedupEntry
 }
 
 func (this *RPCReplyer) Reply(ret interface{}, err error) {
 	if atomic.CompareAndSwapInt32(&this.fired, 0, 1) {
+		this.failed = nil != err
 		if this.req.NeedResp {
 			response := &RPCResponse{Seq: this.req.Seq, Ret: ret, Err: err}
 			this.reply(response)
 		}
+		if nil != this.dedup {
+			this.dedup.cache.end(this.dedup, ret, err, false)
+		}
 		if nil != this.s {
-			atomic.AddInt32(&this.s.pendingCount, -1)
+			this.s.release(this)
 		}
 	}
 }
 
 func (this *RPCReplyer) DropResponse() {
 	if atomic.CompareAndSwapInt32(&this.fired, 0, 1) {
+		if this.req.NeedResp {
+			this.dropped()
+		}
+		if nil != this.dedup {
+			this.dedup.cache.end(this.dedup, nil, nil, true)
+		}
 		if nil != this.s {
-			atomic.AddInt32(&this.s.pendingCount, -1)
+			this.s.release(this)
 		}
 	}
 }
@@ -40,6 +58,7 @@ func (this *RPCReplyer) reply(response RPCMessage) {
 	msg, err := this.encoder.Encode(response)
 	if nil != err {
 		kendynet.GetLogger().Errorf(util.FormatFileLine("Encode rpc response error:%s\n", err.Error()))
+		this.dropped()
 		return
 	}
 	err = this.channel.SendResponse(msg)
@@ -48,6 +67,16 @@ func (this *RPCReplyer) reply(response RPCMessage) {
 	}
 }
 
+//请求不会再有响应
+func (this *RPCReplyer) dropped() {
+	if d, ok := this.encoder.(ResponseDropper); ok {
+		d.OnDropResponse(this.req.Seq)
+	}
+	if d, ok := this.channel.(ResponseDropper); ok {
+		d.OnDropResponse(this.req.Seq)
+	}
+}
+
 func (this *RPCReplyer) GetChannel() RPCChannel {
 	return this.channel
 }
@@ -62,12 +91,45 @@ type RPCServer struct {
 	lastSeq         uint64
 	onMissingMethod func(string, *RPCReplyer)
 	pendingCount    int32
+	stats           map[string]*methodStats
+	healthCheck     func() error
+	dedup           *dedupCache
+	clock           clock.Clock
+
+	limitMtx     sync.Mutex
+	limit        int32 //全局并发上限
+	running      int32
+	methodLimits map[string]*methodLimit
+	queueSize    int
+	queue        []*queuedRequest
+	exec         func(func()) error
+
+	pendingMtx   sync.Mutex
+	pending      map[*RPCReplyer]time.Time //尚未完成的请求
+	shuttingDown int32
+	drained      chan struct{}
+
+	batchMode int32
 }
 
 func (this *RPCServer) PendingCount() int32 {
 	return atomic.LoadInt32(&this.pendingCount)
 }
 
+/*
+ *  设置请求耗时统计及去重缓存有效期使用的时钟,必须在处理请求之前设置
+ */
+func (this *RPCServer) SetClock(c clock.Clock) {
+	this.Lock()
+	defer this.Unlock()
+	this.clock = clock.Get(c)
+	if nil != this.dedup {
+		this.dedup.Lock()
+		this.dedup.clock = this.clock
+		this.dedup.Unlock()
+	}
+}
+
 func (this *RPCServer) SetOnMissingMethod(onMissingMethod func(string, *RPCReplyer)) {
 	this.onMissingMethod = onMissingMethod
 }
@@ -99,6 +161,10 @@ func (this *RPCServer) RegisterMethod(name string, method RPCMethodHandler) erro
 		panic("method == nil")
 	}
 
+	if isReserved(name) {
+		return fmt.Errorf("reserved method:%s", name)
+	}
+
 	defer this.Unlock()
 	this.Lock()
 
@@ -107,6 +173,7 @@ func (this *RPCServer) RegisterMethod(name string, method RPCMethodHandler) erro
 		return fmt.Errorf("duplicate method:%s", name)
 	}
 	this.methods[name] = method
+	this.stats[name] = &methodStats{}
 	return nil
 }
 
@@ -114,12 +181,13 @@ func (this *RPCServer) UnRegisterMethod(name string) {
 	defer this.Unlock()
 	this.Lock()
 	delete(this.methods, name)
+	delete(this.stats, name)
 }
 
 func (this *RPCServer) callMethod(method RPCMethodHandler, replyer *RPCReplyer, arg interface{}) {
 	if _, err := util.ProtectCall(method, replyer, arg); nil != err {
 		kendynet.GetLogger().Errorln(err.Error())
-		replyer.reply(&RPCResponse{Seq: replyer.req.Seq, Err: err})
+		replyer.Reply(nil, NewStatus(CodePanic, err.Error()))
 	}
 }
 
@@ -135,28 +203,10 @@ func (this *RPCServer) OnRPCMessage(channel RPCChannel, message interface{}) {
 
 	switch msg.(type) {
 	case *RPCRequest:
-		{
-			req := msg.(*RPCRequest)
-			this.RLock()
-			method, ok := this.methods[req.Method]
-			this.RUnlock()
-			if !ok {
-				err = fmt.Errorf("invaild method:%s", req.Method)
-				kendynet.GetLogger().Errorf(util.FormatFileLine("rpc request from(%s) invaild method %s\n", channel.Name(), req.Method))
-			}
-
-			replyer := &RPCReplyer{encoder: this.encoder, channel: channel, req: req, s: this}
-			atomic.AddInt32(&this.pendingCount, 1)
-			if nil != err {
-				if nil != this.onMissingMethod {
-					this.onMissingMethod(req.Method, replyer)
-				} else {
-					replyer.reply(&RPCResponse{Seq: req.Seq, Err: err})
-				}
-			} else {
-				this.callMethod(method, replyer, req.Arg)
-			}
-		}
+		this.onRequest(channel, msg.(*RPCRequest), nil)
+		break
+	case *RPCBatchRequest:
+		this.onBatchRequest(channel, msg.(*RPCBatchRequest))
 		break
 	default:
 		panic("RPCServer.OnRPCMessage() invaild msg type")
@@ -165,6 +215,46 @@ func (this *RPCServer) OnRPCMessage(channel RPCChannel, message interface{}) {
 
 }
 
+/*
+ *  onDone非nil时在请求完成(Reply/DropResponse或被直接拒绝)后调用
+ */
+func (this *RPCServer) onRequest(channel RPCChannel, req *RPCRequest, onDone func()) {
+	var err error
+	builtin, isBuiltin := this.getBuiltin(req.Method)
+	this.RLock()
+	method, ok := this.methods[req.Method]
+	stats := this.stats[req.Method]
+	dedup := this.dedup
+	this.RUnlock()
+	if !ok && !isBuiltin {
+		err = Errorf(CodeMissingMethod, "invaild method:%s", req.Method)
+		kendynet.GetLogger().Errorf(util.FormatFileLine("rpc request from(%s) invaild method %s\n", channel.Name(), req.Method))
+	}
+
+	replyer := &RPCReplyer{encoder: this.encoder, channel: channel, req: req, s: this, onDone: onDone, stats: stats}
+	if !this.addPending(replyer) {
+		if req.NeedResp {
+			this.DirectReplyError(channel, req, ErrServerShuttingDown)
+		}
+		if nil != onDone {
+			onDone()
+		}
+		return
+	}
+
+	if nil != err {
+		if nil != this.onMissingMethod {
+			this.onMissingMethod(req.Method, replyer)
+		} else {
+			replyer.Reply(nil, err)
+		}
+	} else if isBuiltin {
+		this.callMethod(builtin, replyer, req.Arg)
+	} else if nil == dedup || req.RequestID == "" || dedup.begin(replyer) {
+		this.dispatch(method, replyer, req.Arg)
+	}
+}
+
 func NewRPCServer(decoder RPCMessageDecoder, encoder RPCMessageEncoder) *RPCServer {
 	if nil == decoder {
 		panic("decoder == nil")
@@ -175,9 +265,13 @@ func NewRPCServer(decoder RPCMessageDecoder, encoder RPCMessageEncoder) *RPCServ
 	}
 
 	return &RPCServer{
-		decoder: decoder,
-		encoder: encoder,
-		methods: map[string]RPCMethodHandler{},
+		decoder:      decoder,
+		encoder:      encoder,
+		methods:      map[string]RPCMethodHandler{},
+		stats:        map[string]*methodStats{},
+		methodLimits: map[string]*methodLimit{},
+		pending:      map[*RPCReplyer]time.Time{},
+		clock:        clock.Real,
 	}
 
 }
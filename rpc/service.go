@@ -0,0 +1,198 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"reflect"
+)
+
+/*
+ *  基于反射的服务注册
+ *
+ *  RegisterService(obj)会扫描obj所有满足以下签名的导出方法:
+ *
+ *      func (t *T) MethodName(arg ArgType, reply *ReplyType) error
+ *
+ *  并以"Service.Method"为名注册到RPCServer,其中Service默认为obj的类型名。
+ *  请求到达时先校验参数类型，类型不匹配直接返回错误，不会调用处理函数。
+ *  方法返回nil时将reply作为结果返回,否则只返回error。
+ */
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+var typeOfRawMessage = reflect.TypeOf(json.RawMessage{})
+
+type serviceMethod struct {
+	name      string
+	method    reflect.Method
+	rcvr      reflect.Value
+	argType   reflect.Type
+	replyType reflect.Type
+}
+
+func (this *serviceMethod) call(replyer *RPCReplyer, arg interface{}) {
+	argv, err := this.checkArg(arg)
+	if nil != err {
+		replyer.Reply(nil, err)
+		return
+	}
+
+	replyv := reflect.New(this.replyType.Elem())
+
+	out := this.method.Func.Call([]reflect.Value{this.rcvr, argv, replyv})
+	if errInter := out[0].Interface(); nil != errInter {
+		replyer.Reply(nil, errInter.(error))
+	} else {
+		replyer.Reply(replyv.Interface(), nil)
+	}
+}
+
+func (this *serviceMethod) checkArg(arg interface{}) (reflect.Value, error) {
+	if nil == arg {
+		if this.argType.Kind() == reflect.Ptr {
+			return reflect.New(this.argType.Elem()), nil
+		} else {
+			return reflect.Zero(this.argType), nil
+		}
+	}
+
+	//JSONRPCCodec解码得到的参数
+	if params, ok := arg.(json.RawMessage); ok && this.argType != typeOfRawMessage {
+		argv := reflect.New(this.argType)
+		if err := unmarshalParams(params, argv.Interface()); nil != err {
+			return reflect.Value{}, Errorf(CodeInvaildArg, "method %s: invaild arg:%s", this.name, err.Error())
+		}
+		return argv.Elem(), nil
+	}
+
+	argv := reflect.ValueOf(arg)
+	if argv.Type().AssignableTo(this.argType) {
+		return argv, nil
+	}
+
+	//允许值类型参数接收同类型指针
+	if argv.Kind() == reflect.Ptr && !argv.IsNil() && argv.Elem().Type().AssignableTo(this.argType) {
+		return argv.Elem(), nil
+	}
+
+	return reflect.Value{}, Errorf(CodeInvaildArg, "method %s: invaild arg type:%s,want:%s", this.name, argv.Type().String(), this.argType.String())
+}
+
+func isExportedOrBuiltinType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return token.IsExported(t.Name()) || t.PkgPath() == ""
+}
+
+func suitableMethods(serviceName string, rcvr reflect.Value) []*serviceMethod {
+	methods := []*serviceMethod{}
+	typ := rcvr.Type()
+	for i := 0; i < typ.NumMethod(); i++ {
+		method := typ.Method(i)
+		mtype := method.Type
+		if method.PkgPath != "" {
+			continue
+		}
+
+		//receiver, arg, reply
+		if mtype.NumIn() != 3 || mtype.NumOut() != 1 {
+			continue
+		}
+
+		argType := mtype.In(1)
+		if !isExportedOrBuiltinType(argType) {
+			continue
+		}
+
+		replyType := mtype.In(2)
+		if replyType.Kind() != reflect.Ptr || !isExportedOrBuiltinType(replyType) {
+			continue
+		}
+
+		if mtype.Out(0) != typeOfError {
+			continue
+		}
+
+		methods = append(methods, &serviceMethod{
+			name:      serviceName + "." + method.Name,
+			method:    method,
+			rcvr:      rcvr,
+			argType:   argType,
+			replyType: replyType,
+		})
+	}
+	return methods
+}
+
+/*
+ *  以obj的类型名作为服务名注册服务
+ */
+func (this *RPCServer) RegisterService(obj interface{}) error {
+	return this.RegisterServiceWithName("", obj)
+}
+
+/*
+ *  以name作为服务名注册服务,name为空时使用obj的类型名
+ *  如果有任意一个方法名冲突,所有方法都不会被注册
+ */
+func (this *RPCServer) RegisterServiceWithName(name string, obj interface{}) error {
+	if nil == obj {
+		return fmt.Errorf("RegisterService: obj == nil")
+	}
+
+	rcvr := reflect.ValueOf(obj)
+
+	if name == "" {
+		name = reflect.Indirect(rcvr).Type().Name()
+	}
+
+	if name == "" {
+		return fmt.Errorf("RegisterService: no service name for type %s", rcvr.Type().String())
+	}
+
+	methods := suitableMethods(name, rcvr)
+
+	if len(methods) == 0 {
+		return fmt.Errorf("RegisterService: type %s has no exported methods of suitable type", rcvr.Type().String())
+	}
+
+	defer this.Unlock()
+	this.Lock()
+
+	for _, v := range methods {
+		if isReserved(v.name) {
+			return fmt.Errorf("reserved method:%s", v.name)
+		}
+		if _, ok := this.methods[v.name]; ok {
+			return fmt.Errorf("duplicate method:%s", v.name)
+		}
+	}
+
+	for _, v := range methods {
+		this.methods[v.name] = v.call
+		this.stats[v.name] = &methodStats{}
+	}
+
+	return nil
+}
+
+/*
+ *  注销通过RegisterService注册的服务
+ */
+func (this *RPCServer) UnRegisterService(name string, obj interface{}) {
+	rcvr := reflect.ValueOf(obj)
+	if name == "" {
+		name = reflect.Indirect(rcvr).Type().Name()
+	}
+
+	methods := suitableMethods(name, rcvr)
+
+	defer this.Unlock()
+	this.Lock()
+
+	for _, v := range methods {
+		delete(this.methods, v.name)
+		delete(this.stats, v.name)
+	}
+}
@@ -0,0 +1,122 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var ErrServerShuttingDown error = NewStatus(CodeShuttingDown, "rpc server shutting down")
+
+/*
+ *  Shutdown超时后仍未完成的请求
+ */
+type AbandonedRequest struct {
+	Channel string
+	Method  string
+	Seq     uint64
+	Elapsed time.Duration //已处理的时间
+}
+
+type ShutdownError struct {
+	Err       error //ctx.Err()
+	Abandoned []AbandonedRequest
+}
+
+func (this *ShutdownError) Error() string {
+	return fmt.Sprintf("rpc server shutdown:%s,%d requests abandoned", this.Err.Error(), len(this.Abandoned))
+}
+
+func (this *RPCServer) IsShuttingDown() bool {
+	return atomic.LoadInt32(&this.shuttingDown) == 1
+}
+
+//Shutdown之后返回false
+func (this *RPCServer) addPending(replyer *RPCReplyer) bool {
+	this.pendingMtx.Lock()
+	defer this.pendingMtx.Unlock()
+	if this.IsShuttingDown() {
+		return false
+	}
+	this.pending[replyer] = this.clock.Now()
+	atomic.AddInt32(&this.pendingCount, 1)
+	if nil != replyer.stats {
+		replyer.stats.begin()
+	}
+	return true
+}
+
+func (this *RPCServer) removePending(replyer *RPCReplyer) {
+	this.pendingMtx.Lock()
+	start := this.pending[replyer]
+	delete(this.pending, replyer)
+	if len(this.pending) == 0 && nil != this.drained {
+		close(this.drained)
+		this.drained = nil
+	}
+	this.pendingMtx.Unlock()
+	if nil != replyer.stats {
+		now := this.clock.Now()
+		replyer.stats.end(now, now.Sub(start), replyer.failed)
+	}
+}
+
+/*
+ *  停止接受新的请求并等待正在处理的请求完成
+ *
+ *  Shutdown之后到达的请求以ErrServerShuttingDown拒绝，等待队列中尚未开始处理的请求同样被拒绝。
+ *  所有请求完成返回nil，ctx到期时返回*ShutdownError，其中包含尚未完成的请求，
+ *  这些请求之后调用Reply仍然会正常发送响应。
+ */
+func (this *RPCServer) Shutdown(ctx context.Context) error {
+	this.pendingMtx.Lock()
+	atomic.StoreInt32(&this.shuttingDown, 1)
+	this.pendingMtx.Unlock()
+
+	this.limitMtx.Lock()
+	queue := this.queue
+	this.queue = nil
+	this.limitMtx.Unlock()
+
+	for _, v := range queue {
+		v.replyer.Reply(nil, ErrServerShuttingDown)
+	}
+
+	this.pendingMtx.Lock()
+	if len(this.pending) == 0 {
+		this.pendingMtx.Unlock()
+		return nil
+	}
+	if nil == this.drained {
+		this.drained = make(chan struct{})
+	}
+	drained := this.drained
+	this.pendingMtx.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	err := &ShutdownError{Err: ctx.Err()}
+	now := this.clock.Now()
+	this.pendingMtx.Lock()
+	for replyer, start := range this.pending {
+		err.Abandoned = append(err.Abandoned, AbandonedRequest{
+			Channel: replyer.channel.Name(),
+			Method:  replyer.req.Method,
+			Seq:     replyer.req.Seq,
+			Elapsed: now.Sub(start),
+		})
+	}
+	this.pendingMtx.Unlock()
+
+	if len(err.Abandoned) == 0 {
+		//ctx到期的同时请求全部完成
+		return nil
+	} else {
+		return err
+	}
+}
@@ -0,0 +1,112 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+ *  结构化的rpc错误
+ *
+ *  RPCResponse.Err可以是任意error,但只有*Status能在编解码后保留错误码。
+ *  编码器应当通过StatusOf(resp.Err)取得Code/Message/Details分别编码,
+ *  解码器使用NewStatus还原,这样客户端就能通过CodeOf/IsCode区分错误类型。
+ *
+ *  业务自定义错误码请从CodeUser开始。
+ */
+
+type Code int32
+
+const (
+	CodeOK                Code = 0
+	CodeUnknown           Code = 1  //未分类错误,没有错误码的普通error都归为此类
+	CodeMissingMethod     Code = 2  //方法未注册
+	CodePanic             Code = 3  //处理函数panic
+	CodeTimeout           Code = 4  //调用超时
+	CodeCancelled         Code = 5  //调用被取消
+	CodeOverloaded        Code = 6  //服务过载
+	CodeInvaildArg        Code = 7  //参数类型错误
+	CodeChannelClosed     Code = 8  //rpc通道已关闭
+	CodeUnavailable       Code = 9  //没有可用的rpc通道
+	CodeCircuitOpen       Code = 10 //通道熔断中
+	CodeShuttingDown      Code = 11 //服务正在关闭
+	CodeResourceExhausted Code = 12 //资源耗尽(例如去重缓存已满)
+	CodeUser              Code = 1000
+)
+
+var codeNames = map[Code]string{
+	CodeOK:                "OK",
+	CodeUnknown:           "Unknown",
+	CodeMissingMethod:     "MissingMethod",
+	CodePanic:             "Panic",
+	CodeTimeout:           "Timeout",
+	CodeCancelled:         "Cancelled",
+	CodeOverloaded:        "Overloaded",
+	CodeInvaildArg:        "InvaildArg",
+	CodeChannelClosed:     "ChannelClosed",
+	CodeUnavailable:       "Unavailable",
+	CodeCircuitOpen:       "CircuitOpen",
+	CodeShuttingDown:      "ShuttingDown",
+	CodeResourceExhausted: "ResourceExhausted",
+}
+
+func (this Code) String() string {
+	if name, ok := codeNames[this]; ok {
+		return name
+	} else {
+		return fmt.Sprintf("Code(%d)", int32(this))
+	}
+}
+
+type Status struct {
+	Code    Code
+	Message string
+	Details []byte
+}
+
+func (this *Status) Error() string {
+	return this.Message
+}
+
+func NewStatus(code Code, message string, details ...[]byte) *Status {
+	s := &Status{
+		Code:    code,
+		Message: message,
+	}
+	if len(details) > 0 {
+		s.Details = details[0]
+	}
+	return s
+}
+
+func Errorf(code Code, format string, args ...interface{}) error {
+	return NewStatus(code, fmt.Sprintf(format, args...))
+}
+
+/*
+ *  从err中提取*Status,err为nil返回nil,不是*Status的err返回CodeUnknown
+ */
+func StatusOf(err error) *Status {
+	if nil == err {
+		return nil
+	}
+
+	var s *Status
+	if errors.As(err, &s) {
+		return s
+	} else {
+		return NewStatus(CodeUnknown, err.Error())
+	}
+}
+
+func CodeOf(err error) Code {
+	if nil == err {
+		return CodeOK
+	} else {
+		return StatusOf(err).Code
+	}
+}
+
+func IsCode(err error, code Code) bool {
+	return CodeOf(err) == code
+}
@@ -0,0 +1,529 @@
+package rpc
+
+/*
+ *  基于kendynet.StreamSession(tcp,websocket,aio)的内置RPCChannel
+ *
+ *  帧格式(大端):
+ *      |payload长度 uint32|帧类型 byte|payload|
+ *
+ *  frameApp      普通应用消息,payload由PayloadCodec编解码
+ *  frameRequest  |seq uint64|flags byte|method长度 uint16|method|[reqID长度 uint16|reqID|]hasArg byte|arg|
+ *                flags:bit0 needResp,bit1 包含reqID
+ *  frameResponse |seq uint64|hasErr byte|code int32|err长度 uint32|err|details长度 uint32|details|hasRet byte|ret|
+ *  frameBatch    |count uint32|count个(|请求长度 uint32|与frameRequest相同的payload|)|
+ *
+ *  对于websocket,每个帧作为一个二进制消息发送。
+ *
+ *  同一个session上的rpc帧与应用消息由StreamChannel分流:rpc请求交给RPCServer,
+ *  rpc响应交给RPCClient,其余消息交给Start传入的回调。
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/message"
+	"github.com/sniperHW/kendynet/util"
+	"reflect"
+)
+
+const (
+	frameApp      = byte(0)
+	frameRequest  = byte(RPC_REQUEST)
+	frameResponse = byte(RPC_RESPONSE)
+	frameBatch    = byte(RPC_BATCH_REQUEST)
+
+	frameHeaderSize  = 4
+	defaultMaxPacket = 65535
+
+	requestNeedResp = byte(1)
+	requestHasID    = byte(2)
+)
+
+/*
+ *  应用消息以及rpc参数/返回值的编解码器
+ *  注意:传给Unmarshal的[]byte引用的是接收缓冲,Unmarshal返回后不能再持有
+ */
+type PayloadCodec interface {
+	Marshal(interface{}) ([]byte, error)
+	Unmarshal([]byte) (interface{}, error)
+}
+
+/*
+ *  StreamChannel上的rpc消息由session的编码器/接收器直接处理,
+ *  与StreamChannel配合的RPCClient/RPCServer使用StreamRPCCodec作为编解码器即可
+ */
+type StreamRPCCodec struct {
+}
+
+func (this *StreamRPCCodec) Encode(message RPCMessage) (interface{}, error) {
+	return message, nil
+}
+
+func (this *StreamRPCCodec) Decode(o interface{}) (RPCMessage, error) {
+	if msg, ok := o.(RPCMessage); ok {
+		return msg, nil
+	} else {
+		return nil, fmt.Errorf("invaild obj type:%s", reflect.TypeOf(o).String())
+	}
+}
+
+type frameCodec struct {
+	codec     PayloadCodec
+	maxPacket uint32
+	ws        bool
+}
+
+func (this *frameCodec) appendPayload(buff *kendynet.ByteBuffer, o interface{}) error {
+	if nil == o {
+		buff.AppendByte(0)
+	} else {
+		b, err := this.codec.Marshal(o)
+		if nil != err {
+			return err
+		}
+		buff.AppendByte(1)
+		buff.AppendBytes(b)
+	}
+	return nil
+}
+
+func (this *frameCodec) appendRequest(buff *kendynet.ByteBuffer, req *RPCRequest) error {
+	var flags byte
+	if req.NeedResp {
+		flags |= requestNeedResp
+	}
+	if req.RequestID != "" {
+		flags |= requestHasID
+	}
+	buff.AppendUint64(req.Seq)
+	buff.AppendByte(flags)
+	buff.AppendUint16(uint16(len(req.Method)))
+	buff.AppendString(req.Method)
+	if req.RequestID != "" {
+		buff.AppendUint16(uint16(len(req.RequestID)))
+		buff.AppendString(req.RequestID)
+	}
+	return this.appendPayload(buff, req.Arg)
+}
+
+func (this *frameCodec) EnCode(o interface{}) (kendynet.Message, error) {
+	buff := kendynet.NewByteBuffer()
+	//预留长度
+	buff.AppendUint32(0)
+	switch o.(type) {
+	case *RPCRequest:
+		buff.AppendByte(frameRequest)
+		if err := this.appendRequest(buff, o.(*RPCRequest)); nil != err {
+			return nil, err
+		}
+	case *RPCBatchRequest:
+		batch := o.(*RPCBatchRequest)
+		buff.AppendByte(frameBatch)
+		buff.AppendUint32(uint32(len(batch.Requests)))
+		for _, v := range batch.Requests {
+			//预留请求长度
+			pos := buff.Len()
+			buff.AppendUint32(0)
+			if err := this.appendRequest(buff, v); nil != err {
+				return nil, err
+			}
+			buff.PutUint32(pos, uint32(buff.Len()-pos-4))
+		}
+	case *RPCResponse:
+		resp := o.(*RPCResponse)
+		buff.AppendByte(frameResponse)
+		buff.AppendUint64(resp.Seq)
+		if nil == resp.Err {
+			buff.AppendByte(0)
+		} else {
+			s := StatusOf(resp.Err)
+			buff.AppendByte(1)
+			buff.AppendInt32(int32(s.Code))
+			buff.AppendUint32(uint32(len(s.Message)))
+			buff.AppendString(s.Message)
+			buff.AppendUint32(uint32(len(s.Details)))
+			buff.AppendBytes(s.Details)
+		}
+		if err := this.appendPayload(buff, resp.Ret); nil != err {
+			return nil, err
+		}
+	default:
+		b, err := this.codec.Marshal(o)
+		if nil != err {
+			return nil, err
+		}
+		buff.AppendByte(frameApp)
+		buff.AppendBytes(b)
+	}
+
+	size := buff.Len() - frameHeaderSize
+	if size > uint64(this.maxPacket) {
+		return nil, fmt.Errorf("message size limite maxPacket[%d],msg payload[%d]", this.maxPacket, size)
+	}
+	buff.PutUint32(0, uint32(size))
+
+	if this.ws {
+		return message.NewWSMessage(message.WSBinaryMessage, buff.Bytes()), nil
+	} else {
+		return buff, nil
+	}
+}
+
+func (this *frameCodec) getPayload(reader *kendynet.BufferReader, size uint64) (interface{}, error) {
+	hasPayload, err := reader.GetByte()
+	if nil != err || hasPayload == 0 {
+		return nil, err
+	}
+	b, err := reader.GetBytes(size)
+	if nil != err {
+		return nil, err
+	}
+	return this.codec.Unmarshal(b)
+}
+
+func (this *frameCodec) decodeRequest(body []byte) (*RPCRequest, error) {
+	reader := kendynet.NewReader(kendynet.NewByteBuffer(body, len(body)))
+	req := &RPCRequest{}
+	var err error
+	var b byte
+	var l uint16
+	if req.Seq, err = reader.GetUint64(); nil != err {
+		return nil, err
+	}
+	if b, err = reader.GetByte(); nil != err {
+		return nil, err
+	}
+	req.NeedResp = b&requestNeedResp != 0
+	if l, err = reader.GetUint16(); nil != err {
+		return nil, err
+	}
+	if req.Method, err = reader.GetString(uint64(l)); nil != err {
+		return nil, err
+	}
+	//seq 8 + flags 1 + method长度 2 + method + hasArg 1
+	consumed := uint64(l) + 12
+	if b&requestHasID != 0 {
+		if l, err = reader.GetUint16(); nil != err {
+			return nil, err
+		}
+		if req.RequestID, err = reader.GetString(uint64(l)); nil != err {
+			return nil, err
+		}
+		consumed += uint64(l) + 2
+	}
+	if req.Arg, err = this.getPayload(reader, uint64(len(body))-consumed); nil != err {
+		return nil, err
+	}
+	return req, nil
+}
+
+//frame不包含长度头
+func (this *frameCodec) decode(frame []byte) (interface{}, error) {
+	if len(frame) == 0 {
+		return nil, fmt.Errorf("empty frame")
+	}
+
+	body := frame[1:]
+
+	switch frame[0] {
+	case frameApp:
+		return this.codec.Unmarshal(body)
+	case frameRequest:
+		return this.decodeRequest(body)
+	case frameBatch:
+		reader := kendynet.NewReader(kendynet.NewByteBuffer(body, len(body)))
+		count, err := reader.GetUint32()
+		if nil != err {
+			return nil, err
+		}
+		batch := &RPCBatchRequest{}
+		for i := uint32(0); i < count; i++ {
+			var l uint32
+			var b []byte
+			var req *RPCRequest
+			if l, err = reader.GetUint32(); nil != err {
+				return nil, err
+			}
+			if b, err = reader.GetBytes(uint64(l)); nil != err {
+				return nil, err
+			}
+			if req, err = this.decodeRequest(b); nil != err {
+				return nil, err
+			}
+			batch.Requests = append(batch.Requests, req)
+		}
+		return batch, nil
+	case frameResponse:
+		reader := kendynet.NewReader(kendynet.NewByteBuffer(body, len(body)))
+		resp := &RPCResponse{}
+		var err error
+		var b byte
+		var code int32
+		var msg string
+		var details []byte
+		var l uint32
+		var dl uint32
+		if resp.Seq, err = reader.GetUint64(); nil != err {
+			return nil, err
+		}
+		if b, err = reader.GetByte(); nil != err {
+			return nil, err
+		}
+		consumed := uint64(9)
+		if b != 0 {
+			if code, err = reader.GetInt32(); nil != err {
+				return nil, err
+			}
+			if l, err = reader.GetUint32(); nil != err {
+				return nil, err
+			}
+			if msg, err = reader.GetString(uint64(l)); nil != err {
+				return nil, err
+			}
+			if dl, err = reader.GetUint32(); nil != err {
+				return nil, err
+			}
+			if dl > 0 {
+				if details, err = reader.GetBytes(uint64(dl)); nil != err {
+					return nil, err
+				}
+				//frame引用的是接收缓冲,需要拷贝
+				details = append([]byte{}, details...)
+			}
+			resp.Err = NewStatus(Code(code), msg, details)
+			consumed += uint64(l) + uint64(dl) + 12
+		}
+		if resp.Ret, err = this.getPayload(reader, uint64(len(body))-consumed-1); nil != err {
+			return nil, err
+		}
+		return resp, nil
+	default:
+		return nil, fmt.Errorf("invaild frame type:%d", frame[0])
+	}
+}
+
+/*
+ *  tcp/unix域套接字的接收器
+ */
+type streamFrameReceiver struct {
+	codec  *frameCodec
+	buffer []byte
+	r      int
+	w      int
+}
+
+func newStreamFrameReceiver(codec *frameCodec) *streamFrameReceiver {
+	return &streamFrameReceiver{
+		codec:  codec,
+		buffer: make([]byte, int(codec.maxPacket)+frameHeaderSize),
+	}
+}
+
+func (this *streamFrameReceiver) unpack() (interface{}, error) {
+	for this.w-this.r >= frameHeaderSize {
+		size := binary.BigEndian.Uint32(this.buffer[this.r:])
+		if size > this.codec.maxPacket {
+			return nil, fmt.Errorf("message size limite maxPacket[%d],msg payload[%d]", this.codec.maxPacket, size)
+		}
+		if this.w-this.r < frameHeaderSize+int(size) {
+			break
+		}
+		frame := this.buffer[this.r+frameHeaderSize : this.r+frameHeaderSize+int(size)]
+		this.r += frameHeaderSize + int(size)
+		return this.codec.decode(frame)
+	}
+
+	//将未解包的数据移动到buffer前部
+	if this.r > 0 {
+		copy(this.buffer, this.buffer[this.r:this.w])
+		this.w -= this.r
+		this.r = 0
+	}
+	return nil, nil
+}
+
+func (this *streamFrameReceiver) ReceiveAndUnpack(sess kendynet.StreamSession) (interface{}, error) {
+	for {
+		msg, err := this.unpack()
+		if nil != msg || nil != err {
+			return msg, err
+		}
+		n, err := sess.(interface{ Read([]byte) (int, error) }).Read(this.buffer[this.w:])
+		if n > 0 {
+			this.w += n
+		}
+		if nil != err {
+			return nil, err
+		}
+	}
+}
+
+/*
+ *  aio套接字的接收器,实现aio.AioReceiver
+ */
+type aioFrameReceiver struct {
+	*streamFrameReceiver
+}
+
+type aioSession interface {
+	Recv([]byte) error
+}
+
+func (this *aioFrameReceiver) StartReceive(sess kendynet.StreamSession) {
+	sess.(aioSession).Recv(this.buffer[this.w:])
+}
+
+func (this *aioFrameReceiver) OnRecvOk(_ kendynet.StreamSession, buff []byte) {
+	this.w += len(buff)
+}
+
+func (this *aioFrameReceiver) ReceiveAndUnpack(sess kendynet.StreamSession) (interface{}, error) {
+	msg, err := this.unpack()
+	if nil == msg && nil == err {
+		return nil, sess.(aioSession).Recv(this.buffer[this.w:])
+	}
+	return msg, err
+}
+
+func (this *aioFrameReceiver) OnClose() {
+
+}
+
+/*
+ *  websocket的接收器,每个消息即一个完整的帧
+ */
+type wsFrameReceiver struct {
+	codec *frameCodec
+}
+
+func (this *wsFrameReceiver) ReceiveAndUnpack(sess kendynet.StreamSession) (interface{}, error) {
+	_, msg, err := sess.(interface{ Read() (int, []byte, error) }).Read()
+	if nil != err {
+		return nil, err
+	}
+	if len(msg) < frameHeaderSize {
+		return nil, fmt.Errorf("invaild frame size:%d", len(msg))
+	}
+	size := binary.BigEndian.Uint32(msg)
+	if size > this.codec.maxPacket || int(size) != len(msg)-frameHeaderSize {
+		return nil, fmt.Errorf("invaild frame size:%d", size)
+	}
+	return this.codec.decode(msg[frameHeaderSize:])
+}
+
+type StreamChannel struct {
+	session kendynet.StreamSession
+	name    string
+	client  *RPCClient
+	server  *RPCServer
+}
+
+/*
+ *  创建StreamChannel并设置session的编码器及接收器,必须在session.Start之前调用
+ *  maxPacket:单个帧的最大大小,默认65535
+ */
+func NewStreamChannel(session kendynet.StreamSession, codec PayloadCodec, maxPacket ...uint32) *StreamChannel {
+	if nil == codec {
+		panic("codec == nil")
+	}
+
+	c := &frameCodec{
+		codec:     codec,
+		maxPacket: defaultMaxPacket,
+	}
+
+	if len(maxPacket) > 0 && maxPacket[0] > 0 {
+		c.maxPacket = maxPacket[0]
+	}
+
+	var receiver kendynet.Receiver
+
+	switch session.(type) {
+	case aioSession:
+		receiver = &aioFrameReceiver{newStreamFrameReceiver(c)}
+	case interface{ Read() (int, []byte, error) }:
+		c.ws = true
+		receiver = &wsFrameReceiver{codec: c}
+	case interface{ Read([]byte) (int, error) }:
+		receiver = newStreamFrameReceiver(c)
+	default:
+		panic(fmt.Sprintf("unsupported session type:%s", reflect.TypeOf(session).String()))
+	}
+
+	session.SetEncoder(c)
+	session.SetReceiver(receiver)
+
+	return &StreamChannel{
+		session: session,
+		name:    session.RemoteAddr().String() + "<->" + session.LocalAddr().String(),
+	}
+}
+
+func (this *StreamChannel) SendRequest(message interface{}) error {
+	return this.session.Send(message)
+}
+
+func (this *StreamChannel) SendResponse(message interface{}) error {
+	return this.session.Send(message)
+}
+
+func (this *StreamChannel) Name() string {
+	return this.name
+}
+
+func (this *StreamChannel) GetSession() kendynet.StreamSession {
+	return this.session
+}
+
+/*
+ *  发送普通应用消息
+ */
+func (this *StreamChannel) Send(o interface{}) error {
+	return this.session.Send(o)
+}
+
+/*
+ *  设置处理rpc响应的RPCClient,必须在Start之前调用
+ */
+func (this *StreamChannel) SetClient(client *RPCClient) {
+	this.client = client
+}
+
+/*
+ *  设置处理rpc请求的RPCServer,必须在Start之前调用
+ */
+func (this *StreamChannel) SetServer(server *RPCServer) {
+	this.server = server
+}
+
+/*
+ *  启动session,rpc消息被分流到RPCClient/RPCServer,其余事件交给eventCB
+ */
+func (this *StreamChannel) Start(eventCB func(*kendynet.Event)) error {
+	if nil == eventCB {
+		panic("eventCB == nil")
+	}
+
+	return this.session.Start(func(event *kendynet.Event) {
+		if event.EventType == kendynet.EventTypeMessage {
+			switch event.Data.(type) {
+			case *RPCRequest, *RPCBatchRequest:
+				if nil != this.server {
+					this.server.OnRPCMessage(this, event.Data)
+				} else {
+					kendynet.GetLogger().Errorf(util.FormatFileLine("rpc request from(%s) but no RPCServer\n", this.name))
+				}
+				return
+			case *RPCResponse:
+				if nil != this.client {
+					this.client.OnRPCMessage(event.Data)
+				} else {
+					kendynet.GetLogger().Errorf(util.FormatFileLine("rpc response from(%s) but no RPCClient\n", this.name))
+				}
+				return
+			}
+		}
+		eventCB(event)
+	})
+}
@@ -2,6 +2,7 @@ package socket
 
 import (
 	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/clock"
 	"github.com/sniperHW/kendynet/util"
 	"io"
 	"net"
@@ -42,6 +43,39 @@ type SocketBase struct {
 	closeReason   string
 	sendCloseChan chan struct{}
 	imp           SocketImpl
+	clock         clock.Clock //nil使用系统时钟
+}
+
+//使deadline立即到期
+var aLongTimeAgo = time.Unix(1, 0)
+
+/*
+ *  在timeout时间内执行fn,超时后fn中阻塞的读写以超时错误返回
+ *
+ *  c为nil时直接使用连接的deadline,否则由c的定时器在超时后将deadline设置为过去的时间
+ */
+func withDeadline(c clock.Clock, timeout time.Duration, setDeadline func(time.Time) error, fn func()) {
+	if nil == c {
+		setDeadline(time.Now().Add(timeout))
+		fn()
+		setDeadline(time.Time{})
+	} else {
+		var mtx sync.Mutex
+		done := false
+		t := c.AfterFunc(timeout, func() {
+			mtx.Lock()
+			if !done {
+				setDeadline(aLongTimeAgo)
+			}
+			mtx.Unlock()
+		})
+		fn()
+		t.Stop()
+		mtx.Lock()
+		done = true
+		mtx.Unlock()
+		setDeadline(time.Time{})
+	}
 }
 
 func (this *SocketBase) IsClosed() bool {
@@ -139,6 +173,25 @@ func (this *SocketBase) SetSendTimeout(timeout time.Duration) {
 	this.sendTimeout.Store(timeout)
 }
 
+/*
+ *  设置读写超时使用的时钟,必须在Start之前设置。
+ *  测试中使用clock.Fake时,推进时钟超过超时时间后阻塞的读写立即以超时错误返回
+ */
+func (this *SocketBase) SetClock(c clock.Clock) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if (this.flag & started) > 0 {
+		return
+	}
+	this.clock = c
+}
+
+func (this *SocketBase) getClock() clock.Clock {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.clock
+}
+
 func (this *SocketBase) SetCloseCallBack(cb func(kendynet.StreamSession, string)) {
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
@@ -195,6 +248,7 @@ func (this *SocketBase) SendMessage(msg kendynet.Message) error {
 func (this *SocketBase) recvThreadFunc() {
 
 	conn := this.imp.getNetConn()
+	c := this.getClock()
 
 	for !this.IsClosed() {
 
@@ -207,9 +261,9 @@ func (this *SocketBase) recvThreadFunc() {
 		recvTimeout := this.getRecvTimeout()
 
 		if recvTimeout > 0 {
-			conn.SetReadDeadline(time.Now().Add(recvTimeout))
-			p, err = this.receiver.ReceiveAndUnpack(this.imp)
-			conn.SetReadDeadline(time.Time{})
+			withDeadline(c, recvTimeout, conn.SetReadDeadline, func() {
+				p, err = this.receiver.ReceiveAndUnpack(this.imp)
+			})
 		} else {
 			p, err = this.receiver.ReceiveAndUnpack(this.imp)
 		}
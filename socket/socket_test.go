@@ -5,6 +5,7 @@ import (
 	"errors"
 	gorilla "github.com/gorilla/websocket"
 	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/clock"
 	"github.com/sniperHW/kendynet/message"
 	"github.com/stretchr/testify/assert"
 	"net"
@@ -354,3 +355,56 @@ func TestStreamSocket(t *testing.T) {
 	}*/
 
 }
+
+func TestSocketClock(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	peer := <-accepted
+	defer peer.Close()
+
+	c := clock.NewFake()
+	session := NewStreamSocket(conn)
+	session.(*StreamSocket).SetClock(c)
+	session.SetRecvTimeout(time.Second)
+	session.SetSendTimeout(time.Second)
+	session.SetEncoder(&encoder{})
+
+	errs := make(chan error, 10)
+	session.Start(func(event *kendynet.Event) {
+		if event.EventType == kendynet.EventTypeError {
+			errs <- event.Data.(error)
+		}
+	})
+
+	c.BlockUntil(1)
+	c.Advance(time.Second - time.Millisecond)
+	select {
+	case err := <-errs:
+		t.Fatal("unexpected error", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Advance(time.Millisecond)
+	assert.Equal(t, kendynet.ErrRecvTimeout, <-errs)
+
+	//对端不读取,发送的数据超过缓冲区后阻塞
+	session.Send(kendynet.NewByteBuffer(make([]byte, 64*1024*1024)))
+	time.Sleep(200 * time.Millisecond)
+	c.Advance(time.Second)
+	for {
+		if err := <-errs; err == kendynet.ErrSendTimeout {
+			break
+		} else {
+			assert.Equal(t, kendynet.ErrRecvTimeout, err)
+		}
+	}
+
+	session.Close("close", 0)
+}
@@ -184,6 +184,7 @@ func (this *StreamSocket) sendThreadFunc() {
 	writer := bufio.NewWriterSize(this.conn, kendynet.SendBufferSize)
 
 	timeout := this.getSendTimeout()
+	c := this.getClock()
 
 	for {
 		closed, localList := this.sendQue.Get()
@@ -215,9 +216,9 @@ func (this *StreamSocket) sendThreadFunc() {
 
 				if writer.Available() == 0 || i == (size-1) {
 					if timeout > 0 {
-						this.conn.SetWriteDeadline(time.Now().Add(timeout))
-						err = writer.Flush()
-						this.conn.SetWriteDeadline(time.Time{})
+						withDeadline(c, timeout, this.conn.SetWriteDeadline, func() {
+							err = writer.Flush()
+						})
 					} else {
 						err = writer.Flush()
 					}
@@ -70,6 +70,7 @@ func (this *WebSocket) sendThreadFunc() {
 	}()
 
 	timeout := this.getSendTimeout()
+	c := this.getClock()
 	for {
 		closed, localList := this.sendQue.Get()
 		size := len(localList)
@@ -82,9 +83,9 @@ func (this *WebSocket) sendThreadFunc() {
 			msg := localList[i].(*message.WSMessage)
 			if msg.Type() == message.WSBinaryMessage || msg.Type() == message.WSTextMessage {
 				if timeout > 0 {
-					this.conn.SetWriteDeadline(time.Now().Add(timeout))
-					err = this.conn.WriteMessage(msg.Type(), msg.Bytes())
-					this.conn.SetWriteDeadline(time.Time{})
+					withDeadline(c, timeout, this.conn.SetWriteDeadline, func() {
+						err = this.conn.WriteMessage(msg.Type(), msg.Bytes())
+					})
 				} else {
 					err = this.conn.WriteMessage(msg.Type(), msg.Bytes())
 				}
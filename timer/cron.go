@@ -0,0 +1,365 @@
+package timer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ *  cron表达式
+ *
+ *  秒 分 时 日 月 周
+ *  也可以省略秒(5个字段),此时秒为0。
+ *
+ *  字段取值:
+ *      秒      0-59
+ *      分      0-59
+ *      时      0-23
+ *      日      1-31
+ *      月      1-12或JAN-DEC
+ *      周      0-7或SUN-SAT(0和7都表示周日)
+ *  每个字段可以是*、?(只用于日/周,与*相同)、数值、范围a-b以及用逗号分隔的列表,
+ *  在*、a或a-b之后加/n表示步长。
+ *  日和周都不是*时满足其中一个即可,否则两者都需要满足。
+ *
+ *  预定义表达式:@yearly(@annually) @monthly @weekly @daily(@midnight) @hourly
+ *
+ *  时区:表达式前加"CRON_TZ=时区 "或"TZ=时区 ",例如"CRON_TZ=Asia/Shanghai 0 30 8 * * *",
+ *  没有指定时按ParseCron传入的loc,默认time.Local。
+ *
+ *  夏令时:按当地时间匹配。时钟拨快跳过的时间(不存在的当地时间)顺延到跳过之后执行,
+ *  时钟拨回重复的当地时间只执行一次。
+ */
+
+type CronSchedule struct {
+	second uint64
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	loc    *time.Location
+	spec   string
+}
+
+type cronField struct {
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	cronSecond = cronField{0, 59, nil}
+	cronMinute = cronField{0, 59, nil}
+	cronHour   = cronField{0, 23, nil}
+	cronDom    = cronField{1, 31, nil}
+	cronMonth  = cronField{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDow = cronField{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+
+	cronDescriptors = map[string]string{
+		"@yearly":   "0 0 0 1 1 *",
+		"@annually": "0 0 0 1 1 *",
+		"@monthly":  "0 0 0 1 * *",
+		"@weekly":   "0 0 0 * * 0",
+		"@daily":    "0 0 0 * * *",
+		"@midnight": "0 0 0 * * *",
+		"@hourly":   "0 0 * * * *",
+	}
+)
+
+//字段为*时的标记位
+const cronStar = uint64(1) << 63
+
+func ParseCron(spec string, loc ...*time.Location) (*CronSchedule, error) {
+	s := &CronSchedule{spec: spec, loc: time.Local}
+	if len(loc) > 0 && nil != loc[0] {
+		s.loc = loc[0]
+	}
+
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") {
+		i := strings.IndexAny(spec, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("invaild cron spec:%s", s.spec)
+		}
+		l, err := time.LoadLocation(spec[strings.Index(spec, "=")+1 : i])
+		if nil != err {
+			return nil, fmt.Errorf("invaild cron spec:%s,%s", s.spec, err.Error())
+		}
+		s.loc = l
+		spec = strings.TrimSpace(spec[i:])
+	}
+
+	if strings.HasPrefix(spec, "@") {
+		if v, ok := cronDescriptors[strings.ToLower(spec)]; ok {
+			spec = v
+		} else {
+			return nil, fmt.Errorf("invaild cron spec:%s", s.spec)
+		}
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) == 5 {
+		fields = append([]string{"0"}, fields...)
+	} else if len(fields) != 6 {
+		return nil, fmt.Errorf("invaild cron spec:%s,expected 5 or 6 fields", s.spec)
+	}
+
+	var err error
+	for i, v := range []struct {
+		bits  *uint64
+		field cronField
+	}{
+		{&s.second, cronSecond},
+		{&s.minute, cronMinute},
+		{&s.hour, cronHour},
+		{&s.dom, cronDom},
+		{&s.month, cronMonth},
+		{&s.dow, cronDow},
+	} {
+		if *v.bits, err = v.field.parse(fields[i]); nil != err {
+			return nil, fmt.Errorf("invaild cron spec:%s,%s", s.spec, err.Error())
+		}
+	}
+
+	//7也表示周日
+	if s.dow&(1<<7) != 0 {
+		s.dow = (s.dow | 1) &^ (1 << 7)
+	}
+
+	return s, nil
+}
+
+func (this cronField) value(s string) (int, error) {
+	if v, ok := this.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if nil != err {
+		return 0, fmt.Errorf("invaild value:%s", s)
+	}
+	if v < this.min || v > this.max {
+		return 0, fmt.Errorf("value %d out of range [%d,%d]", v, this.min, this.max)
+	}
+	return v, nil
+}
+
+func (this cronField) parse(expr string) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(expr, ",") {
+		var err error
+		begin, end, step := this.min, this.max, 1
+		star := false
+
+		rangeExpr := item
+		if i := strings.Index(item, "/"); i >= 0 {
+			if step, err = strconv.Atoi(item[i+1:]); nil != err || step <= 0 {
+				return 0, fmt.Errorf("invaild step:%s", item)
+			}
+			rangeExpr = item[:i]
+		}
+
+		switch {
+		case rangeExpr == "*" || rangeExpr == "?":
+			star = step == 1
+		case strings.Contains(rangeExpr, "-"):
+			i := strings.Index(rangeExpr, "-")
+			if begin, err = this.value(rangeExpr[:i]); nil != err {
+				return 0, err
+			}
+			if end, err = this.value(rangeExpr[i+1:]); nil != err {
+				return 0, err
+			}
+			if begin > end {
+				return 0, fmt.Errorf("invaild range:%s", item)
+			}
+		default:
+			if begin, err = this.value(rangeExpr); nil != err {
+				return 0, err
+			}
+			if !strings.Contains(item, "/") {
+				end = begin
+			}
+		}
+
+		for i := begin; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+		if star {
+			bits |= cronStar
+		}
+	}
+	return bits, nil
+}
+
+func (this *CronSchedule) String() string {
+	return this.spec
+}
+
+func (this *CronSchedule) Location() *time.Location {
+	return this.loc
+}
+
+func (this *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := this.dom&(1<<uint(t.Day())) != 0
+	dowMatch := this.dow&(1<<uint(t.Weekday())) != 0
+	if this.dom&cronStar != 0 || this.dow&cronStar != 0 {
+		return domMatch && dowMatch
+	} else {
+		return domMatch || dowMatch
+	}
+}
+
+/*
+ *  在当地时间(以UTC表示,不受夏令时影响)中查找不早于w的匹配时间
+ */
+func (this *CronSchedule) nextWall(w time.Time) (time.Time, bool) {
+	//2月29日等最长需要8年才出现一次
+	yearLimit := w.Year() + 9
+
+WRAP:
+	if w.Year() > yearLimit {
+		return time.Time{}, false
+	}
+
+	for this.month&(1<<uint(w.Month())) == 0 {
+		w = time.Date(w.Year(), w.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		if w.Month() == time.January {
+			goto WRAP
+		}
+	}
+
+	for !this.dayMatches(w) {
+		w = time.Date(w.Year(), w.Month(), w.Day()+1, 0, 0, 0, 0, time.UTC)
+		if w.Day() == 1 {
+			goto WRAP
+		}
+	}
+
+	for this.hour&(1<<uint(w.Hour())) == 0 {
+		w = w.Truncate(time.Hour).Add(time.Hour)
+		if w.Hour() == 0 {
+			goto WRAP
+		}
+	}
+
+	for this.minute&(1<<uint(w.Minute())) == 0 {
+		w = w.Truncate(time.Minute).Add(time.Minute)
+		if w.Minute() == 0 {
+			goto WRAP
+		}
+	}
+
+	for this.second&(1<<uint(w.Second())) == 0 {
+		w = w.Add(time.Second)
+		if w.Second() == 0 {
+			goto WRAP
+		}
+	}
+
+	return w, true
+}
+
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+/*
+ *  返回t之后第一个匹配的时间,不会再匹配时返回零值
+ */
+func (this *CronSchedule) Next(t time.Time) time.Time {
+	w := wallClock(t.In(this.loc)).Add(time.Second)
+	for {
+		var ok bool
+		if w, ok = this.nextWall(w); !ok {
+			return time.Time{}
+		}
+		//重复的当地时间time.Date只取其中一个
+		next := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), 0, this.loc)
+		if d := w.Sub(wallClock(next)); d != 0 {
+			//不存在的当地时间,time.Date可能按跳过之前或之后的时区计算,取较晚的一个(跳过之后)
+			if alt := next.Add(d); alt.After(next) {
+				next = alt
+			}
+		}
+		if next.After(t) {
+			return next
+		}
+		w = w.Add(time.Second)
+	}
+}
+
+func (this *Timer) nextCron() (time.Duration, bool) {
+	now := this.p.clock.Now()
+	from := now
+	if this.cronNext.After(from) {
+		//定时器可能提前少许触发,从上次的触发时间开始计算避免重复执行
+		from = this.cronNext
+	}
+	next := this.cron.Next(from)
+	if next.IsZero() {
+		return 0, false
+	}
+	this.cronNext = next
+	return next.Sub(now), true
+}
+
+func (this *p) newCronTimer(s *CronSchedule, fn func(*Timer, interface{}), ctx interface{}, eventQue []EventQueue) (*Timer, error) {
+	if nil == fn {
+		return nil, fmt.Errorf("callback == nil")
+	}
+	t := &Timer{
+		repeat:   true,
+		callback: fn,
+		p:        this,
+		ctx:      ctx,
+		cron:     s,
+	}
+	if len(eventQue) > 0 {
+		t.eventQue = eventQue[0]
+	}
+	d, ok := t.nextCron()
+	if !ok {
+		return nil, fmt.Errorf("cron spec %s never fires", s.spec)
+	}
+	t.duration = d
+	this.addTimer(t, 0)
+	return t, nil
+}
+
+/*
+ *  按cron表达式重复执行的定时器,ResetDuration对其无效
+ */
+func (this *TimerMgr) Cron(spec string, callback func(*Timer, interface{}), ctx interface{}, eventQue ...EventQueue) (*Timer, error) {
+	s, err := ParseCron(spec)
+	if nil != err {
+		return nil, err
+	}
+	return this.ScheduleCron(s, callback, ctx, eventQue...)
+}
+
+func (this *TimerMgr) ScheduleCron(s *CronSchedule, callback func(*Timer, interface{}), ctx interface{}, eventQue ...EventQueue) (*Timer, error) {
+	return this.nextSlot().newCronTimer(s, callback, ctx, eventQue)
+}
+
+/*
+ *  在when执行一次,when已经过去时尽快执行
+ */
+func (this *TimerMgr) At(when time.Time, callback func(*Timer, interface{}), ctx interface{}, eventQue ...EventQueue) *Timer {
+	return this.Once(this.clock.Until(when), callback, ctx, eventQue...)
+}
+
+func Cron(spec string, callback func(*Timer, interface{}), ctx interface{}, eventQue ...EventQueue) (*Timer, error) {
+	return globalMgr.Cron(spec, callback, ctx, eventQue...)
+}
+
+func At(when time.Time, callback func(*Timer, interface{}), ctx interface{}, eventQue ...EventQueue) *Timer {
+	return globalMgr.At(when, callback, ctx, eventQue...)
+}
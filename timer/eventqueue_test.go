@@ -0,0 +1,143 @@
+package timer_test
+
+//event包依赖timer,需要event.EventQueue的测试放在外部测试包中
+import (
+	"fmt"
+	"github.com/sniperHW/kendynet/event"
+	"github.com/sniperHW/kendynet/timer"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimerPostToEventQueue(t *testing.T) {
+
+	queue := event.NewEventQueue()
+
+	go queue.Run()
+
+	die := make(chan struct{})
+	i := 0
+	timer_ := timer.Repeat(100*time.Millisecond, func(timer_ *timer.Timer, ctx interface{}) {
+		queue.PostNoWait(func() {
+			i++
+			fmt.Println("Repeat timer", i)
+			if i == 10 {
+				timer_.Cancel()
+				close(die)
+			}
+		})
+	}, nil)
+
+	<-die
+
+	assert.Equal(t, i, 10)
+
+	assert.Equal(t, timer_.Cancel(), false)
+
+	queue.Close()
+}
+
+func TestTimerEventQueue(t *testing.T) {
+	for _, mgr := range []*timer.TimerMgr{timer.NewTimerMgr(1), timer.NewWheelTimerMgr(1, time.Millisecond)} {
+		{
+			//回调已投递尚未执行时取消
+			queue := event.NewEventQueue()
+			fired := make(chan struct{}, 1)
+			timer_ := mgr.Once(time.Millisecond, func(_ *timer.Timer, ctx interface{}) {
+				fired <- struct{}{}
+			}, nil, queue)
+			time.Sleep(20 * time.Millisecond)
+			assert.Equal(t, 1, queue.Len())
+			assert.Equal(t, true, timer_.Cancel())
+			assert.Equal(t, false, timer_.ResetFireTime(time.Millisecond))
+
+			mgr.OnceWithIndex(time.Millisecond, func(_ *timer.Timer, ctx interface{}) {
+				fired <- struct{}{}
+			}, 1, uint64(1), queue)
+			time.Sleep(20 * time.Millisecond)
+			ok, ctx := mgr.CancelByIndex(uint64(1))
+			assert.Equal(t, true, ok)
+			assert.Equal(t, 1, ctx)
+
+			go queue.Run()
+			done := make(chan struct{})
+			queue.PostNoWait(func() {
+				close(done)
+			})
+			<-done
+			assert.Equal(t, 0, len(fired))
+
+			//回调在queue中执行
+			timer_ = mgr.Once(time.Millisecond, func(_ *timer.Timer, ctx interface{}) {
+				fired <- struct{}{}
+			}, nil, queue)
+			<-fired
+			assert.Equal(t, false, timer_.Cancel())
+
+			//在queue中取消重复定时器,回调不会再执行
+			var count int32
+			mgr.Repeat(time.Millisecond, func(repeat *timer.Timer, ctx interface{}) {
+				if atomic.AddInt32(&count, 1) == 3 {
+					queue.PostNoWait(func() {
+						time.Sleep(10 * time.Millisecond)
+						assert.Equal(t, true, repeat.Cancel())
+						fired <- struct{}{}
+					})
+				}
+			}, nil, queue)
+			<-fired
+			time.Sleep(20 * time.Millisecond)
+			assert.True(t, atomic.LoadInt32(&count) <= 4)
+			c := atomic.LoadInt32(&count)
+			time.Sleep(20 * time.Millisecond)
+			assert.Equal(t, c, atomic.LoadInt32(&count))
+
+			//queue关闭后定时器终止
+			queue.Close()
+			mgr.OnceWithIndex(time.Millisecond, func(_ *timer.Timer, ctx interface{}) {
+				fired <- struct{}{}
+			}, nil, uint64(2), queue)
+			time.Sleep(20 * time.Millisecond)
+			assert.Nil(t, mgr.GetTimerByIndex(uint64(2)))
+			assert.Equal(t, 0, len(fired))
+		}
+		mgr.Stop()
+	}
+}
+
+func TestTimerPauseEventQueue(t *testing.T) {
+	//投递到eventQue后暂停,回调不会执行
+	queue := event.NewEventQueue()
+	go queue.Run()
+	defer queue.Close()
+
+	var fired int32
+	mgr := timer.NewTimerMgr(1)
+	pq := pauseQueue{queue, make(chan struct{})}
+	timer_ := mgr.Once(10*time.Millisecond, func(_ *timer.Timer, ctx interface{}) {
+		atomic.AddInt32(&fired, 1)
+	}, nil, pq)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, timer_.Pause())
+	close(pq.release)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&fired))
+	assert.True(t, timer_.Resume())
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fired))
+}
+
+//回调投递后等待release才执行
+type pauseQueue struct {
+	q       *event.EventQueue
+	release chan struct{}
+}
+
+func (this pauseQueue) PostNoWait(fn interface{}, args ...interface{}) error {
+	return this.q.PostNoWait(func() {
+		<-this.release
+		fn.(func())()
+	})
+}
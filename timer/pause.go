@@ -0,0 +1,304 @@
+package timer
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ *  暂停/恢复
+ *
+ *  TimerMgr的Pause/Resume及Snapshot需要登记所有定时器,创建TimerMgr之后调用EnableTracking启用。
+ *  没有启用时不带索引的定时器不登记,创建及终止都不需要加锁,此时调用TimerMgr的Pause/Snapshot会panic。
+ *  Timer自身的Pause/Resume不受影响。
+ *
+ *  暂停的定时器保留剩余时间,恢复后按剩余时间继续计时(cron定时器恢复后按表达式重新计算触发时间)。
+ *  定时器自身的暂停与TimerMgr的暂停相互独立,两者都恢复之后定时器才继续计时。
+ *  TimerMgr暂停期间创建的定时器处于暂停状态,剩余时间为创建时指定的时间。
+ *
+ *  回调执行中暂停重复定时器,回调返回后进入暂停,剩余时间为下一次的间隔。
+ *  到期后回调已投递到eventQue尚未执行时暂停,回调不会被执行,恢复后立即到期并重新投递。
+ */
+
+const (
+	pauseByTimer int32 = 1
+	pauseByMgr   int32 = 2
+)
+
+type TimerInfo struct {
+	Timer     *Timer
+	Index     uint64
+	Repeat    bool
+	Cron      string
+	Paused    bool
+	NextFire  time.Time //暂停中的定时器为零值
+	Remaining time.Duration
+	Ctx       interface{}
+}
+
+//调用时持有锁,返回false表示定时器已经终止或一次性定时器的回调正在执行
+func (this *p) doPause(t *Timer) bool {
+	for {
+		switch atomic.LoadInt32(&t.status) {
+		case waitting:
+			remain := atomic.LoadInt64(&t.deadline) - this.clock.Now().UnixNano()
+			if remain < 0 {
+				remain = 0
+			}
+			atomic.StoreInt64(&t.remain, remain)
+			if atomic.CompareAndSwapInt32(&t.status, waitting, paused) {
+				this.s.unschedule(t)
+				return true
+			}
+		case posted:
+			atomic.StoreInt64(&t.remain, 0)
+			if atomic.CompareAndSwapInt32(&t.status, posted, paused) {
+				return true
+			}
+		case firing:
+			if !t.repeat {
+				return false
+			}
+			if atomic.CompareAndSwapInt32(&t.status, firing, firingPaused) {
+				return true
+			}
+		default:
+			return false
+		}
+	}
+}
+
+//调用时持有锁
+func (this *p) doResume(t *Timer) {
+	if atomic.CompareAndSwapInt32(&t.status, firingPaused, firing) {
+		return
+	}
+
+	if atomic.LoadInt32(&t.status) != paused {
+		return
+	}
+
+	d := time.Duration(atomic.LoadInt64(&t.remain))
+	if nil != t.cron {
+		var ok bool
+		if d, ok = t.nextCron(); !ok {
+			atomic.StoreInt32(&t.status, removed)
+			this.unregisterLocked(t)
+			return
+		}
+	}
+
+	if atomic.CompareAndSwapInt32(&t.status, paused, waitting) {
+		this.s.schedule(t, d)
+		if atomic.LoadInt32(&t.status) == removed {
+			this.s.unschedule(t)
+		}
+	}
+}
+
+func (this *p) pause(t *Timer, by int32) bool {
+	this.Lock()
+	defer this.Unlock()
+	if atomic.LoadInt32(&t.status) == removed || t.pausedBy&by != 0 {
+		return false
+	}
+	if t.pausedBy == 0 && !this.doPause(t) {
+		return false
+	}
+	t.pausedBy |= by
+	return true
+}
+
+func (this *p) resume(t *Timer, by int32) bool {
+	this.Lock()
+	defer this.Unlock()
+	if atomic.LoadInt32(&t.status) == removed || t.pausedBy&by == 0 {
+		return false
+	}
+	t.pausedBy &^= by
+	if t.pausedBy == 0 {
+		this.doResume(t)
+	}
+	return true
+}
+
+//调用时持有锁,遍历登记的定时器
+func (this *p) forEach(fn func(*Timer)) {
+	for t := range this.timers {
+		fn(t)
+	}
+	for _, t := range this.index2Timer {
+		if !t.tracked {
+			fn(t)
+		}
+	}
+}
+
+func (this *p) pauseAll() {
+	this.Lock()
+	defer this.Unlock()
+	if this.paused {
+		return
+	}
+	this.paused = true
+	this.updateFlags()
+	this.forEach(func(t *Timer) {
+		if t.pausedBy != 0 || this.doPause(t) {
+			t.pausedBy |= pauseByMgr
+		}
+	})
+}
+
+func (this *p) resumeAll() {
+	this.Lock()
+	defer this.Unlock()
+	if !this.paused {
+		return
+	}
+	this.paused = false
+	this.updateFlags()
+	this.forEach(func(t *Timer) {
+		if t.pausedBy&pauseByMgr != 0 {
+			t.pausedBy &^= pauseByMgr
+			if t.pausedBy == 0 {
+				this.doResume(t)
+			}
+		}
+	})
+}
+
+func (this *p) snapshot(infos []TimerInfo) []TimerInfo {
+	this.Lock()
+	defer this.Unlock()
+	this.forEach(func(t *Timer) {
+		info := TimerInfo{
+			Timer:     t,
+			Index:     t.index,
+			Repeat:    t.repeat,
+			Paused:    t.pausedBy != 0,
+			Remaining: t.Remaining(),
+			Ctx:       t.ctx,
+		}
+		if nil != t.cron {
+			info.Cron = t.cron.String()
+		}
+		if !info.Paused {
+			info.NextFire = t.NextFireTime()
+		}
+		infos = append(infos, info)
+	})
+	return infos
+}
+
+/*
+ *  暂停定时器,已经暂停或已经终止返回false
+ */
+func (this *Timer) Pause() bool {
+	return this.p.pause(this, pauseByTimer)
+}
+
+/*
+ *  恢复Pause暂停的定时器,TimerMgr仍处于暂停时要等TimerMgr恢复之后才继续计时
+ */
+func (this *Timer) Resume() bool {
+	return this.p.resume(this, pauseByTimer)
+}
+
+/*
+ *  定时器自身或TimerMgr是否处于暂停
+ */
+func (this *Timer) IsPaused() bool {
+	this.p.Lock()
+	defer this.p.Unlock()
+	return this.pausedBy != 0
+}
+
+/*
+ *  距离下次触发的时间,暂停中返回剩余时间,已经到期(回调尚未返回)或已经终止返回0
+ */
+func (this *Timer) Remaining() time.Duration {
+	switch atomic.LoadInt32(&this.status) {
+	case waitting:
+		d := time.Duration(atomic.LoadInt64(&this.deadline) - this.p.clock.Now().UnixNano())
+		if d < 0 {
+			d = 0
+		}
+		return d
+	case paused:
+		return time.Duration(atomic.LoadInt64(&this.remain))
+	default:
+		return 0
+	}
+}
+
+/*
+ *  下次触发的时间,暂停中、已经到期(回调尚未返回)或已经终止返回零值
+ */
+func (this *Timer) NextFireTime() time.Time {
+	if atomic.LoadInt32(&this.status) == waitting {
+		return time.Unix(0, atomic.LoadInt64(&this.deadline))
+	} else {
+		return time.Time{}
+	}
+}
+
+/*
+ *  登记所有定时器,启用之后才能调用TimerMgr的Pause/Snapshot。
+ *  必须在创建不带索引的定时器之前调用,否则panic
+ */
+func (this *TimerMgr) EnableTracking() {
+	if atomic.LoadInt32(&this.used) == 1 {
+		panic("EnableTracking after timers created")
+	}
+	atomic.StoreInt32(&this.tracking, 1)
+	for _, v := range this.slots {
+		v.Lock()
+		v.tracking = true
+		v.updateFlags()
+		v.Unlock()
+	}
+}
+
+func (this *TimerMgr) checkTracking() {
+	if atomic.LoadInt32(&this.tracking) == 0 {
+		panic("timer tracking disabled, call EnableTracking first")
+	}
+}
+
+/*
+ *  暂停所有定时器,暂停期间创建的定时器在Resume之后开始计时。没有启用tracking时panic
+ */
+func (this *TimerMgr) Pause() {
+	this.checkTracking()
+	for _, v := range this.slots {
+		v.pauseAll()
+	}
+}
+
+func (this *TimerMgr) Resume() {
+	for _, v := range this.slots {
+		v.resumeAll()
+	}
+}
+
+func (this *TimerMgr) IsPaused() bool {
+	this.slots[0].Lock()
+	defer this.slots[0].Unlock()
+	return this.slots[0].paused
+}
+
+/*
+ *  尚未终止的定时器,按剩余时间排序。没有启用tracking时panic
+ */
+func (this *TimerMgr) Snapshot() []TimerInfo {
+	this.checkTracking()
+	var infos []TimerInfo
+	for _, v := range this.slots {
+		infos = v.snapshot(infos)
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].Remaining < infos[j].Remaining
+	})
+	return infos
+}
@@ -3,7 +3,7 @@ package timer
 import (
 	"fmt"
 	"github.com/sniperHW/kendynet"
-	//"github.com/sniperHW/kendynet/event"
+	"github.com/sniperHW/kendynet/clock"
 	"github.com/sniperHW/kendynet/util"
 	"runtime"
 	"sync"
@@ -16,13 +16,23 @@ var (
 )
 
 const (
-	waitting int32 = 0
-	firing   int32 = 1
-	removed  int32 = 2
+	waitting     int32 = 0
+	firing       int32 = 1
+	removed      int32 = 2
+	posted       int32 = 3 //已到期,回调已投递到eventQue尚未执行
+	paused       int32 = 4
+	firingPaused int32 = 5 //回调执行中被暂停,回调返回后进入paused
 )
 
+/*
+ *  定时器回调的投递队列,*event.EventQueue实现了该接口
+ */
+type EventQueue interface {
+	PostNoWait(fn interface{}, args ...interface{}) error
+}
+
 type Timer struct {
-	//eventQue *event.EventQueue
+	eventQue EventQueue
 	duration time.Duration
 	repeat   bool //是否重复定时器
 	status   int32
@@ -30,20 +40,80 @@ type Timer struct {
 	p        *p
 	ctx      interface{}
 	index    uint64
-	t        atomic.Value
+	t        atomic.Value //goScheduler使用的clock.Timer
+	w        wheelNode    //timingWheel使用
+	cron     *CronSchedule
+	cronNext time.Time //cron定时器下次触发的时间
+	deadline int64     //到期时间(UnixNano)
+	remain   int64     //暂停时剩余的时间
+	pausedBy int32     //暂停的原因,由p的锁保护
+	tracked  bool      //是否在p.timers中,创建后不再改变
+}
+
+/*
+ *  定时器的调度实现,到期时调用Timer.fire
+ *  schedule/reschedule记录定时器的到期时间(Timer.deadline)
+ */
+type scheduler interface {
+	schedule(t *Timer, d time.Duration)
+	unschedule(t *Timer) bool                  //返回false表示定时器已经到期
+	reschedule(t *Timer, d time.Duration) bool //与time.Timer.Reset相同,无论返回值如何都会重新调度
+	stop()
+}
+
+//每个定时器使用一个clock.Timer
+type goScheduler struct {
+	clock clock.Clock
+}
+
+func (this goScheduler) schedule(t *Timer, d time.Duration) {
+	atomic.StoreInt64(&t.deadline, this.clock.Now().Add(d).UnixNano())
+	t.t.Store(this.clock.AfterFunc(d, t.fire))
+}
+
+func (this goScheduler) unschedule(t *Timer) bool {
+	return t.t.Load().(clock.Timer).Stop()
+}
+
+func (this goScheduler) reschedule(t *Timer, d time.Duration) bool {
+	atomic.StoreInt64(&t.deadline, this.clock.Now().Add(d).UnixNano())
+	return t.t.Load().(clock.Timer).Reset(d)
+}
+
+func (this goScheduler) stop() {
 }
 
 type p struct {
 	sync.Mutex
 	index2Timer map[uint64]*Timer
+	timers      map[*Timer]struct{} //启用tracking时尚未终止的定时器
+	s           scheduler
+	clock       clock.Clock
+	paused      bool
+	tracking    bool
+	flags       int32 //tracking或paused,无需加锁的快速路径检查
 }
 
 func (this *Timer) GetCTX() interface{} {
 	return this.ctx
 }
 
+//到期
+func (this *Timer) fire() {
+	if nil == this.eventQue {
+		this.call()
+	} else if atomic.CompareAndSwapInt32(&this.status, waitting, posted) {
+		if nil != this.eventQue.PostNoWait(this.call) {
+			//队列已关闭,定时器终止
+			if atomic.CompareAndSwapInt32(&this.status, posted, removed) {
+				this.p.unregister(this)
+			}
+		}
+	}
+}
+
 func (this *Timer) call() {
-	if atomic.CompareAndSwapInt32(&this.status, waitting, firing) {
+	if atomic.CompareAndSwapInt32(&this.status, waitting, firing) || atomic.CompareAndSwapInt32(&this.status, posted, firing) {
 		if _, err := util.ProtectCall(this.callback, this, this.ctx); nil != err {
 			logger := kendynet.GetLogger()
 			if nil != logger {
@@ -57,29 +127,44 @@ func (this *Timer) call() {
 			this.p.resetTicker(this)
 		} else {
 			atomic.StoreInt32(&this.status, removed)
-			if this.index != 0 {
-				this.p.Lock()
-				delete(this.p.index2Timer, this.index)
-				this.p.Unlock()
-			}
+			this.p.unregister(this)
 		}
 	}
 }
 
-func newp() *p {
+func newp(s scheduler, c clock.Clock) *p {
 	mgr := &p{
 		index2Timer: map[uint64]*Timer{},
+		timers:      map[*Timer]struct{}{},
+		s:           s,
+		clock:       c,
 	}
 	return mgr
 }
 
+func (this *p) unregister(t *Timer) {
+	if t.index != 0 || t.tracked {
+		this.Lock()
+		this.unregisterLocked(t)
+		this.Unlock()
+	}
+}
+
+//调用时持有锁
+func (this *p) unregisterLocked(t *Timer) {
+	delete(this.timers, t)
+	if t.index != 0 && this.index2Timer[t.index] == t {
+		delete(this.index2Timer, t.index)
+	}
+}
+
 /*
  *  timeout:    超时时间
  *  repeat:     是否重复定时器
  *  eventQue:   如果非nil,callback会被投递到eventQue，否则在定时器主循环中执行
  */
 
-func (this *p) newTimer(timeout time.Duration, repeat bool, fn func(*Timer, interface{}), ctx interface{}, index uint64) *Timer {
+func (this *p) newTimer(timeout time.Duration, repeat bool, fn func(*Timer, interface{}), ctx interface{}, index uint64, eventQue []EventQueue) *Timer {
 	if nil != fn {
 		t := &Timer{
 			duration: timeout,
@@ -89,6 +174,9 @@ func (this *p) newTimer(timeout time.Duration, repeat bool, fn func(*Timer, inte
 			ctx:      ctx,
 			index:    index,
 		}
+		if len(eventQue) > 0 {
+			t.eventQue = eventQue[0]
+		}
 		if this.addTimer(t, index) {
 			return t
 		} else {
@@ -99,22 +187,42 @@ func (this *p) newTimer(timeout time.Duration, repeat bool, fn func(*Timer, inte
 	}
 }
 
+//调用时持有锁
+func (this *p) updateFlags() {
+	var flags int32
+	if this.tracking || this.paused {
+		flags = 1
+	}
+	atomic.StoreInt32(&this.flags, flags)
+}
+
 func (this *p) addTimer(t *Timer, index uint64) bool {
+	if index == 0 && atomic.LoadInt32(&this.flags) == 0 {
+		//不需要登记的定时器不加锁
+		this.s.schedule(t, t.duration)
+		return true
+	}
+
+	this.Lock()
+	defer this.Unlock()
 	if index > 0 {
-		this.Lock()
-		defer this.Unlock()
 		if _, ok := this.index2Timer[index]; ok {
 			return false
 		} else {
 			this.index2Timer[index] = t
-			t.t.Store(time.AfterFunc(t.duration, func() {
-				t.call()
-			}))
 		}
+	}
+	if this.tracking {
+		t.tracked = true
+		this.timers[t] = struct{}{}
+	}
+	if this.paused {
+		//TimerMgr暂停期间创建的定时器在Resume之后开始计时
+		t.pausedBy = pauseByMgr
+		t.status = paused
+		t.remain = int64(t.duration)
 	} else {
-		t.t.Store(time.AfterFunc(t.duration, func() {
-			t.call()
-		}))
+		this.s.schedule(t, t.duration)
 	}
 	return true
 }
@@ -130,14 +238,32 @@ func (this *p) GetTimerByIndex(index uint64) *Timer {
 }
 
 func (this *p) resetTicker(t *Timer) {
+	duration := time.Duration(atomic.LoadInt64((*int64)(&t.duration)))
+	if nil != t.cron {
+		var ok bool
+		if duration, ok = t.nextCron(); !ok {
+			atomic.StoreInt32(&t.status, removed)
+			this.unregister(t)
+			return
+		}
+	}
+
+	//先记录到期时间再切换到waitting,否则切换之后Remaining会按上一次的到期时间计算
+	atomic.StoreInt64(&t.deadline, this.clock.Now().Add(duration).UnixNano())
+
+	//与pause/resume互斥,否则在切换到waitting与调度之间暂停并恢复会导致定时器被调度两次
+	this.Lock()
+	defer this.Unlock()
 	if atomic.CompareAndSwapInt32(&t.status, firing, waitting) {
-		duration := time.Duration(atomic.LoadInt64((*int64)(&t.duration)))
-		t.t.Store(time.AfterFunc(duration, func() {
-			t.call()
-		}))
+		this.s.schedule(t, duration)
 		if atomic.LoadInt32(&t.status) == removed {
-			t.t.Load().(*time.Timer).Stop()
+			this.s.unschedule(t)
 		}
+	} else if atomic.CompareAndSwapInt32(&t.status, firingPaused, paused) {
+		atomic.StoreInt64(&t.remain, int64(duration))
+	} else {
+		//回调执行中被Cancel
+		this.unregisterLocked(t)
 	}
 }
 
@@ -145,35 +271,43 @@ func (this *p) resetFireTime(t *Timer, timeout time.Duration) bool {
 	if t.repeat || atomic.LoadInt32(&t.status) != waitting {
 		return false
 	}
-	return t.t.Load().(*time.Timer).Reset(timeout)
+	return this.s.reschedule(t, timeout)
 }
 
 func (this *p) resetDuration(t *Timer, duration time.Duration) bool {
-	if !t.repeat {
+	if !t.repeat || nil != t.cron {
 		return false
 	} else {
 		atomic.StoreInt64((*int64)(&t.duration), int64(duration))
 		for {
-			if atomic.LoadInt32(&t.status) == removed {
+			switch atomic.LoadInt32(&t.status) {
+			case removed:
 				return false
-			} else {
-				if t.t.Load().(*time.Timer).Reset(duration) {
-					break
+			case posted, firingPaused:
+				//回调执行完之后按新的间隔调度
+				return true
+			case paused:
+				atomic.StoreInt64(&t.remain, int64(duration))
+				if atomic.LoadInt32(&t.status) == paused {
+					return true
+				}
+			default:
+				if this.s.reschedule(t, duration) {
+					return true
 				}
 			}
 		}
-		return true
 	}
 }
 
 func (this *p) remove(t *Timer) bool {
 	if atomic.CompareAndSwapInt32(&t.status, waitting, removed) {
-		t.t.Load().(*time.Timer).Stop()
-		if t.index > 0 {
-			this.Lock()
-			delete(this.index2Timer, t.index)
-			this.Unlock()
-		}
+		this.s.unschedule(t)
+		this.unregister(t)
+		return true
+	} else if atomic.CompareAndSwapInt32(&t.status, posted, removed) || atomic.CompareAndSwapInt32(&t.status, paused, removed) {
+		//回调已经投递但尚未执行,执行时会被忽略
+		this.unregister(t)
 		return true
 	} else {
 		atomic.StoreInt32(&t.status, removed)
@@ -187,8 +321,11 @@ func (this *p) removeByIndex(index uint64) (bool, interface{}) {
 	t, ok := this.index2Timer[index]
 	if ok {
 		if atomic.CompareAndSwapInt32(&t.status, waitting, removed) {
-			t.t.Load().(*time.Timer).Stop()
-			delete(this.index2Timer, t.index)
+			this.s.unschedule(t)
+			this.unregisterLocked(t)
+			return true, t.ctx
+		} else if atomic.CompareAndSwapInt32(&t.status, posted, removed) || atomic.CompareAndSwapInt32(&t.status, paused, removed) {
+			this.unregisterLocked(t)
 			return true, t.ctx
 		} else {
 			atomic.StoreInt32(&t.status, removed)
@@ -200,57 +337,114 @@ func (this *p) removeByIndex(index uint64) (bool, interface{}) {
 }
 
 //一次性定时器
-func (this *p) Once(timeout time.Duration, callback func(*Timer, interface{}), ctx interface{}) *Timer {
-	return this.newTimer(timeout, false, callback, ctx, 0)
+func (this *p) Once(timeout time.Duration, callback func(*Timer, interface{}), ctx interface{}, eventQue ...EventQueue) *Timer {
+	return this.newTimer(timeout, false, callback, ctx, 0, eventQue)
 }
 
-func (this *p) OnceWithIndex(timeout time.Duration, callback func(*Timer, interface{}), ctx interface{}, index uint64) *Timer {
+func (this *p) OnceWithIndex(timeout time.Duration, callback func(*Timer, interface{}), ctx interface{}, index uint64, eventQue ...EventQueue) *Timer {
 	if index > 0 {
-		return this.newTimer(timeout, false, callback, ctx, index)
+		return this.newTimer(timeout, false, callback, ctx, index, eventQue)
 	} else {
 		return nil
 	}
 }
 
 //重复定时器
-func (this *p) Repeat(duration time.Duration, callback func(*Timer, interface{}), ctx interface{}) *Timer {
-	return this.newTimer(duration, true, callback, ctx, 0)
+func (this *p) Repeat(duration time.Duration, callback func(*Timer, interface{}), ctx interface{}, eventQue ...EventQueue) *Timer {
+	return this.newTimer(duration, true, callback, ctx, 0, eventQue)
 }
 
 type TimerMgr struct {
-	slots []*p
+	slots    []*p
+	s        scheduler
+	clock    clock.Clock
+	next     uint32
+	tracking int32
+	used     int32 //已经创建过不带索引的定时器,之后不能再启用tracking
 }
 
-func NewTimerMgr(num int) *TimerMgr {
+func getClock(c []clock.Clock) clock.Clock {
+	if len(c) > 0 {
+		return clock.Get(c[0])
+	} else {
+		return clock.Real
+	}
+}
+
+/*
+ *  每个定时器使用一个clock.Timer调度
+ *  c:  使用的时钟,默认为clock.Real,测试中可以使用clock.Fake手动推进时间
+ */
+func NewTimerMgr(num int, c ...clock.Clock) *TimerMgr {
+	cc := getClock(c)
+	return newTimerMgr(num, goScheduler{clock: cc}, cc)
+}
+
+/*
+ *  使用分层时间轮调度,精度为tick。
+ *  适合大量超时时间较长、通常在到期前被取消的定时器(例如请求超时),
+ *  回调在时间轮的goroutine上依次执行,不能阻塞。不再使用时调用Stop。
+ *  使用clock.Fake时回调在调用Advance的goroutine上执行。
+ */
+func NewWheelTimerMgr(num int, tick time.Duration, c ...clock.Clock) *TimerMgr {
+	cc := getClock(c)
+	return newTimerMgr(num, newTimingWheel(tick, cc), cc)
+}
+
+func newTimerMgr(num int, s scheduler, c clock.Clock) *TimerMgr {
 
 	m := &TimerMgr{
 		slots: make([]*p, num),
+		s:     s,
+		clock: c,
 	}
 
 	for i, _ := range m.slots {
-		m.slots[i] = newp()
+		m.slots[i] = newp(s, c)
 	}
 
 	return m
 }
 
+func (this *TimerMgr) Clock() clock.Clock {
+	return this.clock
+}
+
+//启用tracking时没有索引的定时器轮流放到各个slot以分散锁,否则不需要加锁,都放到slots[0]
+func (this *TimerMgr) nextSlot() *p {
+	if atomic.LoadInt32(&this.tracking) == 0 {
+		if atomic.LoadInt32(&this.used) == 0 {
+			atomic.StoreInt32(&this.used, 1)
+		}
+		return this.slots[0]
+	}
+	return this.slots[int(atomic.AddUint32(&this.next, 1)%uint32(len(this.slots)))]
+}
+
+/*
+ *  停止调度,尚未到期的定时器不会再被执行
+ */
+func (this *TimerMgr) Stop() {
+	this.s.stop()
+}
+
 //一次性定时器
-func (this *TimerMgr) Once(timeout time.Duration, callback func(*Timer, interface{}), ctx interface{}) *Timer {
-	return this.slots[0].newTimer(timeout, false, callback, ctx, 0)
+func (this *TimerMgr) Once(timeout time.Duration, callback func(*Timer, interface{}), ctx interface{}, eventQue ...EventQueue) *Timer {
+	return this.nextSlot().newTimer(timeout, false, callback, ctx, 0, eventQue)
 }
 
-func (this *TimerMgr) OnceWithIndex(timeout time.Duration, callback func(*Timer, interface{}), ctx interface{}, index uint64) *Timer {
+func (this *TimerMgr) OnceWithIndex(timeout time.Duration, callback func(*Timer, interface{}), ctx interface{}, index uint64, eventQue ...EventQueue) *Timer {
 	if index > 0 {
 		slot := int(index) % len(this.slots)
-		return this.slots[slot].newTimer(timeout, false, callback, ctx, index)
+		return this.slots[slot].newTimer(timeout, false, callback, ctx, index, eventQue)
 	} else {
 		return nil
 	}
 }
 
 //重复定时器
-func (this *TimerMgr) Repeat(duration time.Duration, callback func(*Timer, interface{}), ctx interface{}) *Timer {
-	return this.slots[0].newTimer(duration, true, callback, ctx, 0)
+func (this *TimerMgr) Repeat(duration time.Duration, callback func(*Timer, interface{}), ctx interface{}, eventQue ...EventQueue) *Timer {
+	return this.nextSlot().newTimer(duration, true, callback, ctx, 0, eventQue)
 }
 
 func (this *TimerMgr) GetTimerByIndex(index uint64) *Timer {
@@ -267,6 +461,10 @@ func (this *TimerMgr) CancelByIndex(index uint64) (bool, interface{}) {
  *  终止定时器
  *  注意：因为定时器在单独go程序中调度，Cancel不保证能终止定时器的下次执行（例如定时器马上将要被调度执行，此时在另外
  *        一个go程中调用Cancel），对于重复定时器，可以保证定时器最多在执行一次之后终止。
+ *
+ *        创建时指定了eventQue的定时器，回调在eventQue中执行。到期后回调已经投递但尚未执行时Cancel返回true，
+ *        回调不会被执行。因此在eventQue中调用Cancel返回true就保证回调不会再被执行。
+ *        eventQue关闭导致投递失败时定时器终止。
  */
 func (this *Timer) Cancel() bool {
 	return this.p.remove(this)
@@ -283,17 +481,17 @@ func (this *Timer) ResetDuration(duration time.Duration) bool {
 }
 
 //一次性定时器
-func Once(timeout time.Duration, callback func(*Timer, interface{}), ctx interface{}) *Timer {
-	return globalMgr.Once(timeout, callback, ctx)
+func Once(timeout time.Duration, callback func(*Timer, interface{}), ctx interface{}, eventQue ...EventQueue) *Timer {
+	return globalMgr.Once(timeout, callback, ctx, eventQue...)
 }
 
 //重复定时器
-func Repeat(duration time.Duration, callback func(*Timer, interface{}), ctx interface{}) *Timer {
-	return globalMgr.Repeat(duration, callback, ctx)
+func Repeat(duration time.Duration, callback func(*Timer, interface{}), ctx interface{}, eventQue ...EventQueue) *Timer {
+	return globalMgr.Repeat(duration, callback, ctx, eventQue...)
 }
 
-func OnceWithIndex(timeout time.Duration, callback func(*Timer, interface{}), ctx interface{}, index uint64) *Timer {
-	return globalMgr.OnceWithIndex(timeout, callback, ctx, index)
+func OnceWithIndex(timeout time.Duration, callback func(*Timer, interface{}), ctx interface{}, index uint64, eventQue ...EventQueue) *Timer {
+	return globalMgr.OnceWithIndex(timeout, callback, ctx, index, eventQue...)
 }
 
 func GetTimerByIndex(index uint64) *Timer {
@@ -4,8 +4,9 @@ package timer
 //go test -v -run=^$ -bench Benchmark -count 10
 import (
 	"fmt"
-	"github.com/sniperHW/kendynet/event"
+	"github.com/sniperHW/kendynet/clock"
 	"github.com/stretchr/testify/assert"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -24,6 +25,49 @@ func BenchmarkTimer(b *testing.B) {
 	}
 }
 
+func benchmarkTimerMgr(b *testing.B, mgr *TimerMgr) {
+	b.ReportAllocs()
+	timers := make([]*Timer, b.N)
+	for i := 0; i < b.N; i++ {
+		timers[i] = mgr.OnceWithIndex(10*time.Second, func(_ *Timer, ctx interface{}) {
+		}, nil, uint64(i+1))
+	}
+
+	for i, _ := range timers {
+		mgr.CancelByIndex(uint64(i + 1))
+	}
+}
+
+func BenchmarkTimerMgr(b *testing.B) {
+	benchmarkTimerMgr(b, NewTimerMgr(61))
+}
+
+func BenchmarkWheelTimerMgr(b *testing.B) {
+	mgr := NewWheelTimerMgr(61, time.Millisecond)
+	defer mgr.Stop()
+	benchmarkTimerMgr(b, mgr)
+}
+
+func benchmarkTimerMgrParallel(b *testing.B, mgr *TimerMgr) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mgr.Once(10*time.Second, func(_ *Timer, ctx interface{}) {
+			}, nil).Cancel()
+		}
+	})
+}
+
+func BenchmarkTimerMgrParallel(b *testing.B) {
+	benchmarkTimerMgrParallel(b, NewTimerMgr(61))
+}
+
+func BenchmarkWheelTimerMgrParallel(b *testing.B) {
+	mgr := NewWheelTimerMgr(61, time.Millisecond)
+	defer mgr.Stop()
+	benchmarkTimerMgrParallel(b, mgr)
+}
+
 func BenchmarkGoTimer(b *testing.B) {
 	b.ReportAllocs()
 	timers := make([]*time.Timer, b.N)
@@ -66,35 +110,6 @@ func TestTimer(t *testing.T) {
 
 	}
 
-	{
-
-		queue := event.NewEventQueue()
-
-		go queue.Run()
-
-		die := make(chan struct{})
-		i := 0
-		timer_ := Repeat(100*time.Millisecond, func(timer_ *Timer, ctx interface{}) {
-			queue.PostNoWait(func() {
-				i++
-				fmt.Println("Repeat timer", i)
-				if i == 10 {
-					timer_.Cancel()
-					close(die)
-				}
-			})
-		}, nil)
-
-		<-die
-
-		assert.Equal(t, i, 10)
-
-		assert.Equal(t, timer_.Cancel(), false)
-
-		queue.Close()
-
-	}
-
 	{
 		die := make(chan struct{})
 		timer_ := Once(1*time.Second, func(timer_ *Timer, ctx interface{}) {
@@ -225,3 +240,474 @@ func TestTimer(t *testing.T) {
 	}
 
 }
+
+func TestWheelTimer(t *testing.T) {
+	mgr := NewWheelTimerMgr(7, time.Millisecond)
+	defer mgr.Stop()
+
+	{
+		//跨越多层的定时器
+		for _, d := range []time.Duration{0, 5 * time.Millisecond, 300 * time.Millisecond, 1200 * time.Millisecond} {
+			die := make(chan time.Time)
+			start := time.Now()
+			mgr.Once(d, func(_ *Timer, ctx interface{}) {
+				die <- time.Now()
+			}, nil)
+			elapsed := (<-die).Sub(start)
+			assert.True(t, elapsed >= d, "%v fired after %v", d, elapsed)
+			assert.True(t, elapsed < d+50*time.Millisecond, "%v fired after %v", d, elapsed)
+		}
+	}
+
+	{
+		fired := make(chan struct{}, 1)
+		timer_ := mgr.Once(50*time.Millisecond, func(_ *Timer, ctx interface{}) {
+			fired <- struct{}{}
+		}, nil)
+		assert.Equal(t, true, timer_.Cancel())
+		assert.Equal(t, false, timer_.Cancel())
+
+		mgr.OnceWithIndex(50*time.Millisecond, func(_ *Timer, ctx interface{}) {
+			fired <- struct{}{}
+		}, 1, uint64(8))
+		assert.Nil(t, mgr.OnceWithIndex(time.Second, func(_ *Timer, ctx interface{}) {}, 1, uint64(8)))
+		assert.NotNil(t, mgr.GetTimerByIndex(uint64(8)))
+		ok, ctx := mgr.CancelByIndex(uint64(8))
+		assert.Equal(t, true, ok)
+		assert.Equal(t, 1, ctx.(int))
+		ok, _ = mgr.CancelByIndex(uint64(8))
+		assert.Equal(t, false, ok)
+
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, 0, len(fired))
+	}
+
+	{
+		die := make(chan time.Time)
+		start := time.Now()
+		timer_ := mgr.Once(time.Second, func(_ *Timer, ctx interface{}) {
+			die <- time.Now()
+		}, nil)
+		assert.Equal(t, true, timer_.ResetFireTime(20*time.Millisecond))
+		elapsed := (<-die).Sub(start)
+		assert.True(t, elapsed >= 20*time.Millisecond && elapsed < 500*time.Millisecond)
+		assert.Equal(t, false, timer_.ResetFireTime(time.Second))
+	}
+
+	{
+		die := make(chan struct{})
+		var i int32
+		timer_ := mgr.Repeat(10*time.Millisecond, func(timer_ *Timer, ctx interface{}) {
+			if atomic.AddInt32(&i, 1) == 5 {
+				timer_.Cancel()
+				close(die)
+			}
+		}, nil)
+		assert.Equal(t, true, timer_.ResetDuration(5*time.Millisecond))
+		<-die
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal(t, int32(5), atomic.LoadInt32(&i))
+	}
+
+	{
+		//大量定时器
+		var count int32
+		die := make(chan struct{})
+		for i := 0; i < 10000; i++ {
+			mgr.Once(time.Duration(i%300)*time.Millisecond, func(_ *Timer, ctx interface{}) {
+				if atomic.AddInt32(&count, 1) == 10000 {
+					close(die)
+				}
+			}, nil)
+		}
+		select {
+		case <-die:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timers not fired", atomic.LoadInt32(&count))
+		}
+	}
+
+	mgr.Stop()
+	fired := make(chan struct{}, 1)
+	mgr.Once(0, func(_ *Timer, ctx interface{}) {
+		fired <- struct{}{}
+	}, nil)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, len(fired))
+}
+
+func TestCron(t *testing.T) {
+	utc := time.UTC
+	next := func(spec string, from time.Time) time.Time {
+		s, err := ParseCron(spec, utc)
+		assert.Nil(t, err)
+		return s.Next(from)
+	}
+
+	from := time.Date(2020, 1, 31, 23, 59, 59, 0, utc)
+	assert.Equal(t, time.Date(2020, 2, 1, 0, 0, 0, 0, utc), next("* * * * * *", from))
+	assert.Equal(t, time.Date(2020, 2, 1, 0, 0, 0, 0, utc), next("0 * * * *", from))
+	assert.Equal(t, time.Date(2020, 2, 1, 0, 0, 15, 0, utc), next("*/15 * * * * *", time.Date(2020, 2, 1, 0, 0, 0, 0, utc)))
+	assert.Equal(t, time.Date(2020, 2, 1, 8, 30, 0, 0, utc), next("0 30 8 * * ?", from))
+	assert.Equal(t, time.Date(2020, 2, 29, 0, 0, 0, 0, utc), next("0 0 0 29 2 *", from))
+	assert.Equal(t, time.Date(2024, 2, 29, 0, 0, 0, 0, utc), next("0 0 0 29 FEB *", time.Date(2020, 2, 29, 0, 0, 0, 0, utc)))
+	assert.Equal(t, time.Date(2020, 2, 3, 9, 0, 0, 0, utc), next("0 0 9 * * MON-FRI", from))
+	assert.Equal(t, time.Date(2020, 2, 2, 0, 0, 0, 0, utc), next("@weekly", from))
+	assert.Equal(t, time.Date(2020, 2, 2, 0, 0, 0, 0, utc), next("0 0 0 * * 7", from))
+	assert.Equal(t, time.Date(2020, 3, 1, 0, 0, 0, 0, utc), next("@monthly", time.Date(2020, 2, 1, 0, 0, 0, 0, utc)))
+	assert.Equal(t, time.Date(2020, 2, 1, 0, 0, 10, 0, utc), next("10-20/5,40 * * * * *", from))
+	//日和周都指定时满足其一即可
+	assert.Equal(t, time.Date(2020, 2, 2, 0, 0, 0, 0, utc), next("0 0 0 15 * SUN", from))
+	assert.Equal(t, time.Date(2020, 2, 5, 0, 0, 0, 0, utc), next("0 0 0 1-10/2 * *", time.Date(2020, 2, 3, 0, 0, 0, 0, utc)))
+	assert.True(t, next("0 0 0 30 2 *", from).IsZero())
+
+	for _, spec := range []string{"", "* * * *", "60 * * * * *", "* * 24 * * *", "* * * 0 * *", "*/0 * * * * *", "5-1 * * * * *", "@every", "TZ=Nowhere/City * * * * * *", "* * * * FOO *"} {
+		_, err := ParseCron(spec)
+		assert.NotNil(t, err, spec)
+	}
+
+	if ny, err := time.LoadLocation("America/New_York"); nil == err {
+		s, err := ParseCron("CRON_TZ=America/New_York 0 30 2 * * *")
+		assert.Nil(t, err)
+		assert.Equal(t, ny, s.Location())
+		//2020-03-08 02:00时钟拨快到03:00,02:30顺延到03:30
+		n := s.Next(time.Date(2020, 3, 7, 12, 0, 0, 0, ny))
+		assert.Equal(t, time.Date(2020, 3, 8, 3, 30, 0, 0, ny), n)
+		assert.Equal(t, time.Date(2020, 3, 9, 2, 30, 0, 0, ny), s.Next(n))
+
+		//2020-11-01 02:00时钟拨回到01:00,01:30只执行一次
+		s, _ = ParseCron("0 30 1 * * *", ny)
+		n = s.Next(time.Date(2020, 10, 31, 12, 0, 0, 0, ny))
+		assert.Equal(t, 1, n.Hour())
+		n = s.Next(n)
+		assert.Equal(t, 2, n.Day())
+		assert.Equal(t, 1, n.Hour())
+
+		//按小时执行不受影响
+		s, _ = ParseCron("0 0 * * * *", ny)
+		n = s.Next(time.Date(2020, 3, 8, 1, 0, 0, 0, ny))
+		assert.Equal(t, time.Date(2020, 3, 8, 3, 0, 0, 0, ny), n)
+	}
+
+	{
+		fired := make(chan time.Time, 10)
+		timer_, err := Cron("* * * * * *", func(_ *Timer, ctx interface{}) {
+			fired <- time.Now()
+		}, nil)
+		assert.Nil(t, err)
+		t1 := <-fired
+		t2 := <-fired
+		assert.Equal(t, t1.Unix()+1, t2.Unix())
+		assert.Equal(t, false, timer_.ResetDuration(time.Millisecond))
+		timer_.Cancel()
+
+		_, err = Cron("0 0 0 30 2 *", func(_ *Timer, ctx interface{}) {}, nil)
+		assert.NotNil(t, err)
+	}
+
+	{
+		fired := make(chan time.Time, 1)
+		when := time.Now().Add(50 * time.Millisecond)
+		At(when, func(_ *Timer, ctx interface{}) {
+			fired <- time.Now()
+		}, nil)
+		assert.False(t, (<-fired).Before(when))
+
+		At(time.Now().Add(-time.Second), func(_ *Timer, ctx interface{}) {
+			fired <- time.Now()
+		}, nil)
+		<-fired
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	{
+		c := clock.NewFake(start)
+		mgr := NewTimerMgr(1, c)
+		assert.Equal(t, clock.Clock(c), mgr.Clock())
+
+		var once, repeat int
+		mgr.Once(time.Second, func(_ *Timer, ctx interface{}) {
+			once++
+		}, nil)
+		r := mgr.Repeat(300*time.Millisecond, func(_ *Timer, ctx interface{}) {
+			repeat++
+		}, nil)
+		mgr.OnceWithIndex(2*time.Second, func(_ *Timer, ctx interface{}) {
+			assert.Fail(t, "cancelled timer fired")
+		}, nil, 1)
+
+		c.Advance(999 * time.Millisecond)
+		assert.Equal(t, 0, once)
+		assert.Equal(t, 3, repeat)
+		c.Advance(time.Millisecond)
+		assert.Equal(t, 1, once)
+
+		ok, _ := mgr.CancelByIndex(1)
+		assert.True(t, ok)
+		assert.True(t, r.ResetDuration(time.Second))
+		c.Advance(time.Second)
+		assert.Equal(t, 4, repeat)
+		r.Cancel()
+		c.Advance(time.Hour)
+		assert.Equal(t, 4, repeat)
+		assert.Equal(t, 0, c.Pending())
+
+		var at time.Time
+		mgr.At(start.Add(2*time.Hour), func(_ *Timer, ctx interface{}) {
+			at = c.Now()
+		}, nil)
+		c.Advance(time.Hour)
+		assert.Equal(t, start.Add(2*time.Hour), at)
+
+		var fired []time.Time
+		_, err := mgr.Cron("0 0 * * * *", func(_ *Timer, ctx interface{}) {
+			fired = append(fired, c.Now())
+		}, nil)
+		assert.Nil(t, err)
+		c.Advance(3 * time.Hour)
+		assert.Equal(t, []time.Time{start.Add(3 * time.Hour), start.Add(4 * time.Hour), start.Add(5 * time.Hour)}, fired)
+	}
+
+	{
+		c := clock.NewFake(start)
+		mgr := NewWheelTimerMgr(1, 10*time.Millisecond, c)
+		defer mgr.Stop()
+
+		var fired time.Time
+		mgr.Once(time.Second, func(_ *Timer, ctx interface{}) {
+			fired = c.Now()
+		}, nil)
+		c.Advance(time.Second)
+		assert.True(t, fired.IsZero())
+		c.Advance(20 * time.Millisecond)
+		assert.False(t, fired.Before(start.Add(time.Second)))
+		assert.False(t, fired.After(start.Add(time.Second+20*time.Millisecond)))
+
+		mgr.Stop()
+		assert.Equal(t, 0, c.Pending())
+	}
+}
+
+//调度前回调onSchedule,用于在调度的过程中插入操作
+type hookScheduler struct {
+	goScheduler
+	onSchedule func(*Timer)
+}
+
+func (this *hookScheduler) schedule(t *Timer, d time.Duration) {
+	if nil != this.onSchedule {
+		this.onSchedule(t)
+	}
+	this.goScheduler.schedule(t, d)
+}
+
+func TestTimerPause(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := clock.NewFake(start)
+	mgr := NewTimerMgr(3, c)
+	mgr.EnableTracking()
+
+	{
+		var fired int
+		once := mgr.Once(10*time.Second, func(_ *Timer, ctx interface{}) {
+			fired++
+		}, nil)
+		c.Advance(4 * time.Second)
+		assert.Equal(t, 6*time.Second, once.Remaining())
+		assert.Equal(t, start.Add(10*time.Second).UnixNano(), once.NextFireTime().UnixNano())
+		assert.True(t, once.Pause())
+		assert.False(t, once.Pause())
+		assert.True(t, once.IsPaused())
+		assert.True(t, once.NextFireTime().IsZero())
+		c.Advance(time.Hour)
+		assert.Equal(t, 0, fired)
+		assert.Equal(t, 6*time.Second, once.Remaining())
+
+		assert.True(t, once.Resume())
+		assert.False(t, once.Resume())
+		c.Advance(6*time.Second - time.Millisecond)
+		assert.Equal(t, 0, fired)
+		c.Advance(time.Millisecond)
+		assert.Equal(t, 1, fired)
+		assert.Equal(t, time.Duration(0), once.Remaining())
+		assert.False(t, once.Pause())
+	}
+
+	//回调中暂停重复定时器
+	{
+		var fired int
+		repeat := mgr.Repeat(time.Second, func(timer *Timer, ctx interface{}) {
+			fired++
+			assert.True(t, timer.Pause())
+		}, nil)
+		c.Advance(time.Second)
+		assert.Equal(t, 1, fired)
+		assert.True(t, repeat.IsPaused())
+		assert.Equal(t, time.Second, repeat.Remaining())
+		c.Advance(time.Hour)
+		assert.Equal(t, 1, fired)
+		repeat.Resume()
+		c.Advance(time.Second)
+		assert.Equal(t, 2, fired)
+		assert.True(t, repeat.Cancel())
+	}
+
+	//暂停整个TimerMgr
+	{
+		var fired []string
+		cb := func(_ *Timer, ctx interface{}) {
+			fired = append(fired, ctx.(string))
+		}
+		a := mgr.Once(time.Second, cb, "a")
+		b := mgr.OnceWithIndex(2*time.Second, cb, "b", 1)
+		mgr.Repeat(3*time.Second, cb, "r")
+		assert.True(t, a.Pause())
+
+		mgr.Pause()
+		assert.True(t, mgr.IsPaused())
+		assert.True(t, b.IsPaused())
+		d := mgr.Once(4*time.Second, cb, "d")
+		assert.True(t, d.IsPaused())
+		c.Advance(time.Hour)
+		assert.Equal(t, 0, len(fired))
+
+		infos := mgr.Snapshot()
+		assert.Equal(t, 4, len(infos))
+		assert.Equal(t, a, infos[0].Timer)
+		assert.Equal(t, "b", infos[1].Ctx)
+		assert.Equal(t, uint64(1), infos[1].Index)
+		assert.True(t, infos[2].Repeat)
+		assert.Equal(t, 4*time.Second, infos[3].Remaining)
+		for _, v := range infos {
+			assert.True(t, v.Paused)
+			assert.True(t, v.NextFire.IsZero())
+		}
+
+		//TimerMgr恢复前定时器仍处于暂停
+		assert.True(t, b.Pause())
+		assert.True(t, b.Resume())
+		assert.True(t, b.IsPaused())
+
+		mgr.Resume()
+		assert.False(t, mgr.IsPaused())
+		assert.True(t, a.IsPaused())
+		assert.False(t, b.IsPaused())
+		c.Advance(4 * time.Second)
+		assert.Equal(t, []string{"b", "r", "d"}, fired)
+
+		infos = mgr.Snapshot()
+		assert.Equal(t, 2, len(infos))
+		assert.Equal(t, "a", infos[0].Ctx)
+		assert.True(t, infos[0].Paused)
+		assert.Equal(t, time.Second, infos[0].Remaining)
+		assert.Equal(t, "r", infos[1].Ctx)
+		assert.Equal(t, 2*time.Second, infos[1].Remaining)
+		assert.Equal(t, c.Now().Add(2*time.Second).UnixNano(), infos[1].NextFire.UnixNano())
+
+		//暂停中的定时器可以取消
+		assert.True(t, a.Cancel())
+		assert.True(t, infos[1].Timer.Cancel())
+		assert.Equal(t, 0, len(mgr.Snapshot()))
+		assert.Equal(t, 0, c.Pending())
+	}
+
+	//没有启用tracking时TimerMgr的Pause/Snapshot panic,Timer自身的暂停不受影响
+	{
+		mgr := NewTimerMgr(1, c)
+		var fired []string
+		cb := func(_ *Timer, ctx interface{}) {
+			fired = append(fired, ctx.(string))
+		}
+		a := mgr.Once(time.Second, cb, "a")
+		assert.Panics(t, func() { mgr.Pause() })
+		assert.Panics(t, func() { mgr.Snapshot() })
+		assert.False(t, mgr.IsPaused())
+		//已经创建了不带索引的定时器,不能再启用
+		assert.Panics(t, func() { mgr.EnableTracking() })
+
+		assert.True(t, a.Pause())
+		c.Advance(time.Second)
+		assert.Equal(t, 0, len(fired))
+		assert.True(t, a.Resume())
+		c.Advance(time.Second)
+		assert.Equal(t, []string{"a"}, fired)
+
+		//只创建过带索引的定时器时可以启用
+		mgr = NewTimerMgr(1, c)
+		b := mgr.OnceWithIndex(time.Second, cb, "b", 1)
+		mgr.EnableTracking()
+		mgr.Pause()
+		assert.True(t, b.IsPaused())
+		assert.Equal(t, 1, len(mgr.Snapshot()))
+		mgr.Resume()
+		c.Advance(time.Second)
+		assert.Equal(t, []string{"a", "b"}, fired)
+		assert.Equal(t, 0, len(mgr.Snapshot()))
+	}
+
+	//重复定时器回调返回后重新调度的同时在其它goroutine暂停/恢复
+	for _, resume := range []bool{false, true} {
+		var fired int
+		var timer_ *Timer
+		done := make(chan struct{})
+		hook := &hookScheduler{goScheduler: goScheduler{clock: c}}
+		hook.onSchedule = func(scheduled *Timer) {
+			if scheduled == timer_ && fired == 1 {
+				hook.onSchedule = nil
+				go func() {
+					assert.True(t, timer_.Pause())
+					if resume {
+						assert.True(t, timer_.Resume())
+					}
+					close(done)
+				}()
+				//重新调度持有p的锁时等不到暂停完成
+				select {
+				case <-done:
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+		}
+		mgr := newTimerMgr(1, hook, c)
+		timer_ = mgr.Repeat(time.Second, func(_ *Timer, ctx interface{}) {
+			fired++
+		}, nil)
+		c.Advance(time.Second)
+		<-done
+		assert.Equal(t, 1, fired)
+		if resume {
+			assert.False(t, timer_.IsPaused())
+		} else {
+			//剩余时间为下一次的间隔
+			assert.True(t, timer_.IsPaused())
+			assert.Equal(t, time.Second, timer_.Remaining())
+			c.Advance(time.Hour)
+			assert.Equal(t, 1, fired)
+			assert.True(t, timer_.Resume())
+		}
+		//只调度了一次
+		assert.Equal(t, 1, c.Pending())
+		c.Advance(time.Second)
+		assert.Equal(t, 2, fired)
+		assert.True(t, timer_.Cancel())
+		assert.Equal(t, 0, c.Pending())
+	}
+
+	//cron定时器恢复后按表达式重新计算
+	{
+		var fired []time.Time
+		cron, _ := mgr.Cron("0 0 * * * *", func(_ *Timer, ctx interface{}) {
+			fired = append(fired, c.Now())
+		}, nil)
+		cron.Pause()
+		c.Advance(90 * time.Minute)
+		cron.Resume()
+		c.Advance(time.Hour)
+		assert.Equal(t, 1, len(fired))
+		assert.Equal(t, 0, fired[0].Minute())
+		cron.Cancel()
+	}
+}
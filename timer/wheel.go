@@ -0,0 +1,210 @@
+package timer
+
+import (
+	"container/list"
+	"github.com/sniperHW/kendynet/clock"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ *  分层时间轮
+ *
+ *  第0层256个槽,每槽1个tick,第i层(i>=1)64个槽,每槽256*64^(i-1)个tick,共5层,
+ *  超过2^32个tick的定时器先放在最高层,到期前重新计算位置。
+ *  添加/删除定时器为O(1),由clock.AfterFunc每个tick推进一次,到期的回调在推进的goroutine上依次执行,
+ *  所以回调不能阻塞。定时精度为tick,超时时间向上取整到tick的整数倍。
+ */
+
+const (
+	wheelRootBits  = 8
+	wheelLevelBits = 6
+	wheelLevels    = 5
+	wheelRootSize  = 1 << wheelRootBits
+	wheelLevelSize = 1 << wheelLevelBits
+	wheelMaxTicks  = uint64(1)<<(wheelRootBits+wheelLevelBits*(wheelLevels-1)) - 1
+)
+
+type wheelNode struct {
+	elem   *list.Element
+	bucket *list.List
+	expire uint64 //到期的tick
+}
+
+type timingWheel struct {
+	sync.Mutex
+	tick    time.Duration
+	clock   clock.Clock
+	start   time.Time
+	now     uint64 //已经处理完的tick
+	levels  [wheelLevels][]*list.List
+	ticker  clock.Timer
+	stopped bool
+}
+
+func newTimingWheel(tick time.Duration, c clock.Clock) *timingWheel {
+	if tick <= 0 {
+		panic("tick <= 0")
+	}
+
+	w := &timingWheel{
+		tick:  tick,
+		clock: c,
+		start: c.Now(),
+	}
+
+	for i := range w.levels {
+		size := wheelLevelSize
+		if i == 0 {
+			size = wheelRootSize
+		}
+		w.levels[i] = make([]*list.List, size)
+		for j := range w.levels[i] {
+			w.levels[i][j] = list.New()
+		}
+	}
+
+	w.Lock()
+	w.ticker = c.AfterFunc(tick, w.onTick)
+	w.Unlock()
+
+	return w
+}
+
+func (this *timingWheel) onTick() {
+	this.advance(uint64(this.clock.Since(this.start) / this.tick))
+	this.Lock()
+	if !this.stopped {
+		this.ticker.Reset(this.tick)
+	}
+	this.Unlock()
+}
+
+func (this *timingWheel) stop() {
+	this.Lock()
+	defer this.Unlock()
+	if !this.stopped {
+		this.stopped = true
+		this.ticker.Stop()
+	}
+}
+
+//推进到tick target,执行到期的定时器
+func (this *timingWheel) advance(target uint64) {
+	var expired []*Timer
+	this.Lock()
+	for this.now < target {
+		this.now++
+		this.cascade()
+		bucket := this.levels[0][this.now&(wheelRootSize-1)]
+		for e := bucket.Front(); nil != e; e = bucket.Front() {
+			t := bucket.Remove(e).(*Timer)
+			t.w.elem = nil
+			t.w.bucket = nil
+			expired = append(expired, t)
+		}
+	}
+	this.Unlock()
+
+	for _, v := range expired {
+		v.fire()
+	}
+}
+
+//第0层转完一圈时,将上层对应槽中的定时器重新放到下层
+func (this *timingWheel) cascade() {
+	shift := uint(wheelRootBits)
+	for level := 1; level < wheelLevels; level++ {
+		if this.now&(uint64(1)<<shift-1) != 0 {
+			return
+		}
+		idx := (this.now >> shift) & (wheelLevelSize - 1)
+		bucket := this.levels[level][idx]
+		for e := bucket.Front(); nil != e; e = bucket.Front() {
+			t := bucket.Remove(e).(*Timer)
+			t.w.elem = nil
+			t.w.bucket = nil
+			this.add(t)
+		}
+		shift += wheelLevelBits
+	}
+}
+
+//调用时持有锁
+func (this *timingWheel) add(t *Timer) {
+	delta := t.w.expire - this.now
+	if t.w.expire < this.now {
+		delta = 0
+	}
+	if delta > wheelMaxTicks {
+		delta = wheelMaxTicks
+	}
+
+	expire := this.now + delta
+	var bucket *list.List
+	if delta < wheelRootSize {
+		bucket = this.levels[0][expire&(wheelRootSize-1)]
+	} else {
+		shift := uint(wheelRootBits)
+		level := 1
+		for ; level < wheelLevels-1; level++ {
+			if delta < uint64(1)<<(shift+wheelLevelBits) {
+				break
+			}
+			shift += wheelLevelBits
+		}
+		bucket = this.levels[level][(expire>>shift)&(wheelLevelSize-1)]
+	}
+	t.w.bucket = bucket
+	t.w.elem = bucket.PushBack(t)
+}
+
+//调用时持有锁
+func (this *timingWheel) del(t *Timer) bool {
+	if nil == t.w.bucket {
+		return false
+	}
+	t.w.bucket.Remove(t.w.elem)
+	t.w.elem = nil
+	t.w.bucket = nil
+	return true
+}
+
+//调用时持有锁,同时记录定时器的到期时间
+func (this *timingWheel) expireAt(t *Timer, d time.Duration) uint64 {
+	now := this.clock.Now()
+	atomic.StoreInt64(&t.deadline, now.Add(d).UnixNano())
+	cur := uint64(now.Sub(this.start) / this.tick)
+	if cur < this.now {
+		cur = this.now
+	}
+	if d < 0 {
+		d = 0
+	}
+	//当前tick可能已经过去了一部分,多等一个tick保证不提前触发
+	return cur + uint64((d+this.tick-1)/this.tick) + 1
+}
+
+func (this *timingWheel) schedule(t *Timer, d time.Duration) {
+	this.Lock()
+	defer this.Unlock()
+	this.del(t)
+	t.w.expire = this.expireAt(t, d)
+	this.add(t)
+}
+
+func (this *timingWheel) unschedule(t *Timer) bool {
+	this.Lock()
+	defer this.Unlock()
+	return this.del(t)
+}
+
+func (this *timingWheel) reschedule(t *Timer, d time.Duration) bool {
+	this.Lock()
+	defer this.Unlock()
+	active := this.del(t)
+	t.w.expire = this.expireAt(t, d)
+	this.add(t)
+	return active
+}